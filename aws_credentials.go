@@ -0,0 +1,191 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// AWSCredentialProvider loads the SDK configuration, including credentials, that AWSS3Service creates
+// its client from
+type AWSCredentialProvider interface {
+	LoadConfig(ctx context.Context) (aws.Config, error)
+	// how long a loaded configuration can be used before it must be loaded again, 0 when its
+	// credentials are refreshed by the SDK's credential cache
+	SessionDuration() time.Duration
+}
+
+// the names AWS credential providers are selected by in Config
+const (
+	StaticCredentialProvider      = "static"
+	EnvCredentialProvider         = "env"
+	ProfileCredentialProvider     = "profile"
+	WebIdentityCredentialProvider = "web-identity"
+	AssumeRoleCredentialProvider  = "assume-role"
+	SAML2AWSCredentialProvider    = "saml2aws"
+)
+
+// sdkCredentialProvider loads configuration whose credentials the SDK refreshes itself
+type sdkCredentialProvider func(ctx context.Context) (aws.Config, error)
+
+func (p sdkCredentialProvider) LoadConfig(ctx context.Context) (aws.Config, error) {
+	return p(ctx)
+}
+
+func (p sdkCredentialProvider) SessionDuration() time.Duration {
+	return 0
+}
+
+// NewStaticCredentialProvider authenticates with fixed access keys, sessionToken may be empty
+func NewStaticCredentialProvider(region, accessKeyID, secretAccessKey, sessionToken string) AWSCredentialProvider {
+	return sdkCredentialProvider(func(ctx context.Context) (aws.Config, error) {
+		if accessKeyID == "" || secretAccessKey == "" {
+			return aws.Config{}, fmt.Errorf("Failed to load static credentials: an access key id and secret access key are required")
+		}
+		return loadConfig(ctx, config.WithRegion(region),
+			config.WithCredentialsProvider(countingCredentialsProvider{credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, sessionToken)}))
+	})
+}
+
+// NewEnvCredentialProvider authenticates with the keys in AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+func NewEnvCredentialProvider(region string) AWSCredentialProvider {
+	return sdkCredentialProvider(func(ctx context.Context) (aws.Config, error) {
+		envConfig, err := config.NewEnvConfig()
+		if err != nil {
+			return aws.Config{}, fmt.Errorf("Failed to read AWS environment: %v", err)
+		}
+		if !envConfig.Credentials.HasKeys() {
+			return aws.Config{}, fmt.Errorf("Failed to load environment credentials: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set")
+		}
+		return loadConfig(ctx, config.WithRegion(region),
+			config.WithCredentialsProvider(countingCredentialsProvider{credentials.StaticCredentialsProvider{Value: envConfig.Credentials}}))
+	})
+}
+
+// NewProfileCredentialProvider authenticates as a profile of the shared config and credentials files,
+// an empty profile uses the SDK's default credential chain
+func NewProfileCredentialProvider(region, profile string) AWSCredentialProvider {
+	return sdkCredentialProvider(func(ctx context.Context) (aws.Config, error) {
+		return loadConfig(ctx, config.WithRegion(region), config.WithSharedConfigProfile(profile))
+	})
+}
+
+// NewWebIdentityCredentialProvider assumes roleARN with the OIDC token in tokenFile (e.g. IRSA on EKS).
+// When roleARN and tokenFile are empty they are read from AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE.
+func NewWebIdentityCredentialProvider(region, roleARN, tokenFile, sessionName string) AWSCredentialProvider {
+	return sdkCredentialProvider(func(ctx context.Context) (aws.Config, error) {
+		cfg, err := loadConfig(ctx, config.WithRegion(region))
+		if err != nil || (roleARN == "" && tokenFile == "") {
+			return cfg, err
+		}
+		if roleARN == "" || tokenFile == "" {
+			return aws.Config{}, fmt.Errorf("Failed to load web identity credentials: a role ARN and token file are both required")
+		}
+		provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(cfg), roleARN, stscreds.IdentityTokenFile(tokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = sessionName
+		})
+		cfg.Credentials = aws.NewCredentialsCache(countingCredentialsProvider{provider})
+		return cfg, nil
+	})
+}
+
+// NewAssumeRoleCredentialProvider assumes roleARN using the credentials of base
+func NewAssumeRoleCredentialProvider(base AWSCredentialProvider, roleARN, externalID, sessionName string) AWSCredentialProvider {
+	return &assumeRoleCredentialProvider{base: base, roleARN: roleARN, externalID: externalID, sessionName: sessionName}
+}
+
+type assumeRoleCredentialProvider struct {
+	base        AWSCredentialProvider
+	roleARN     string
+	externalID  string
+	sessionName string
+}
+
+func (p *assumeRoleCredentialProvider) LoadConfig(ctx context.Context) (aws.Config, error) {
+	if p.roleARN == "" {
+		return aws.Config{}, fmt.Errorf("Failed to load assume role credentials: a role ARN is required")
+	}
+	cfg, err := p.base.LoadConfig(ctx)
+	if err != nil {
+		return cfg, err
+	}
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), p.roleARN, func(o *stscreds.AssumeRoleOptions) {
+		if p.sessionName != "" {
+			o.RoleSessionName = p.sessionName
+		}
+		if p.externalID != "" {
+			o.ExternalID = aws.String(p.externalID)
+		}
+	})
+	cfg.Credentials = aws.NewCredentialsCache(countingCredentialsProvider{provider})
+	return cfg, nil
+}
+
+// the role is assumed with the base credentials, so they bound how long the configuration can be used
+func (p *assumeRoleCredentialProvider) SessionDuration() time.Duration {
+	return p.base.SessionDuration()
+}
+
+// NewSAML2AWSCredentialProvider runs the saml2aws script, which writes credentials for profile into the
+// shared credentials file, each time a session of sessionDuration seconds is started.  It is kept for
+// deployments that predate the SDK providers.
+func NewSAML2AWSCredentialProvider(saml2awsBin, profile, region string, sessionDuration float64) AWSCredentialProvider {
+	return &saml2awsCredentialProvider{saml2awsBin: saml2awsBin, profile: profile, region: region, sessionDuration: sessionDuration}
+}
+
+type saml2awsCredentialProvider struct {
+	saml2awsBin     string
+	profile         string
+	region          string
+	sessionDuration float64
+}
+
+func (p *saml2awsCredentialProvider) LoadConfig(ctx context.Context) (aws.Config, error) {
+	err := generateToken(p.saml2awsBin)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("Failed to generate AWS token: %q", err)
+	}
+	// saml2AWS returns without error, but without being fully setup, lets pause
+	time.Sleep(time.Minute)
+	return loadConfig(ctx, config.WithRegion(p.region), config.WithSharedConfigProfile(p.profile))
+}
+
+func (p *saml2awsCredentialProvider) SessionDuration() time.Duration {
+	return time.Duration(p.sessionDuration * float64(time.Second))
+}
+
+func generateToken(saml2awsBin string) error {
+	cmd := exec.Command("sh", saml2awsBin)
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to run %q, err: %v", saml2awsBin, err)
+	}
+	return nil
+}
+
+func loadConfig(ctx context.Context, optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, optFns...)
+	if err != nil {
+		return cfg, fmt.Errorf("Failed to load SDK configuration: %v", err)
+	}
+	return cfg, nil
+}
+
+// countingCredentialsProvider counts each retrieval of credentials.  It is wrapped in the SDK's credential
+// cache, which only retrieves credentials when the cached ones are about to expire.
+type countingCredentialsProvider struct {
+	aws.CredentialsProvider
+}
+
+func (p countingCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	creds, err := p.CredentialsProvider.Retrieve(ctx)
+	credentialRefreshes.WithLabelValues(outcomeOf(err)).Inc()
+	return creds, err
+}
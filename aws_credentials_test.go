@@ -0,0 +1,72 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAWSCredentialProviders(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-key-id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+
+	tests := []struct {
+		name      string
+		config    Config
+		wantKeyID string
+		wantErr   bool
+	}{
+		{"Static", Config{AWSCredentials: StaticCredentialProvider, AWSRegion: "us-east-1", AWSAccessKeyID: "static-key-id", AWSSecretAccessKey: "static-secret"}, "static-key-id", false},
+		{"StaticWithoutKeys", Config{AWSCredentials: StaticCredentialProvider, AWSRegion: "us-east-1"}, "", true},
+		{"Env", Config{AWSCredentials: EnvCredentialProvider, SAMLRegion: "us-east-1"}, "env-key-id", false},
+		{"AssumeRoleWithoutRole", Config{AWSCredentials: AssumeRoleCredentialProvider, AWSRegion: "us-east-1"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := tt.config.AWSCredentialProvider()
+			if err != nil {
+				t.Fatalf("cannot create provider: %q", err)
+			}
+			if provider.SessionDuration() != 0 {
+				t.Errorf("got session duration %v want 0", provider.SessionDuration())
+			}
+			cfg, err := provider.LoadConfig(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error loading config")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cannot load config: %q", err)
+			}
+			if cfg.Region != "us-east-1" {
+				t.Errorf("got region %q want %q", cfg.Region, "us-east-1")
+			}
+			// the SDK caches the credentials, the S3 client uses its cache rather than caching them again
+			if cached := cacheCredentials(cfg.Credentials); cached != cfg.Credentials {
+				t.Errorf("credentials of type %T were cached again", cfg.Credentials)
+			}
+			creds, err := cfg.Credentials.Retrieve(context.Background())
+			if err != nil {
+				t.Fatalf("cannot retrieve credentials: %q", err)
+			}
+			if creds.AccessKeyID != tt.wantKeyID {
+				t.Errorf("got access key id %q want %q", creds.AccessKeyID, tt.wantKeyID)
+			}
+		})
+	}
+
+	t.Run("UnknownProvider", func(t *testing.T) {
+		if _, err := (Config{AWSCredentials: "kerberos"}).AWSCredentialProvider(); err == nil {
+			t.Errorf("expected an error for an unknown provider")
+		}
+	})
+
+	t.Run("SAML2AWSWithoutScript", func(t *testing.T) {
+		for _, name := range []string{"", SAML2AWSCredentialProvider} {
+			if _, err := (Config{AWSCredentials: name}).AWSCredentialProvider(); err == nil {
+				t.Errorf("expected an error for the %q provider without a saml2aws script", name)
+			}
+		}
+	})
+}
@@ -3,98 +3,99 @@ package smile_databricks_gateway
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"os/exec"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	st "github.mskcc.org/cdsi/cdsi-protobuf/smile/generated/v1/go"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type AWSS3Service struct {
-	saml2AWSBin     string
-	samlProfile     string
-	samlRegion      string
-	sessionStart    time.Time
-	sessionDuration float64
-	client          *s3.Client
+	clients  *s3ClientHolder
+	timeouts S3Timeouts
 }
 
-func NewAWSS3Service(saml2awsBin, samlProfile, samlRegion string, sessionDuration float64) *AWSS3Service {
-	return &AWSS3Service{saml2AWSBin: saml2awsBin, samlProfile: samlProfile, samlRegion: samlRegion, sessionDuration: sessionDuration}
+// S3Timeouts bounds how long each S3 operation may take, 0 means no timeout.  Waiting for a
+// session to be loaded is not included.
+type S3Timeouts struct {
+	Put    time.Duration
+	Get    time.Duration
+	Delete time.Duration
+	List   time.Duration
+	Head   time.Duration
 }
 
-func (a *AWSS3Service) PutRequest(bucketKey, bucketName string, sr SmileRequest) error {
-	s3Client, err := a.getClient()
-	if err != nil {
-		return fmt.Errorf("Failed to get s3 client: '%s': %q", sr.IgoRequestID, err)
-	}
-	err = put[SmileRequest](s3Client, bucketKey, bucketName, sr)
-	if err != nil {
-		return fmt.Errorf("Failed to PutRequest: '%s': %q", sr.IgoRequestID, err)
+func DefaultS3Timeouts() S3Timeouts {
+	return S3Timeouts{
+		Put:    30 * time.Second,
+		Get:    30 * time.Second,
+		Delete: 30 * time.Second,
+		List:   60 * time.Second,
+		Head:   10 * time.Second,
 	}
-	return nil
 }
 
-func (a *AWSS3Service) PutIGOSample(bucketKey, bucketName string, ss SmileSample) error {
-	s3Client, err := a.getClient()
-	if err != nil {
-		return fmt.Errorf("Failed to get s3 client: '%s': %q", ss.SampleName, err)
-	}
-	err = put[SmileSample](s3Client, bucketKey, bucketName, ss)
-	if err != nil {
-		return fmt.Errorf("Failed to PutSample: '%s': %q", ss.SampleName, err)
-	}
-	return nil
+var _ ObjectStore = (*AWSS3Service)(nil)
+
+const (
+	S3BucketKey    = "S3 Bucket"
+	ObjectBytesKey = "Object Bytes"
+)
+
+var s3Tracer = otel.Tracer("github.com/mskcc/smile-databricks-gateway/s3")
+
+func NewAWSS3Service(credentialProvider AWSCredentialProvider, timeouts S3Timeouts) *AWSS3Service {
+	return &AWSS3Service{clients: newS3ClientHolder(credentialProvider), timeouts: timeouts}
 }
 
-func (a *AWSS3Service) PutTEMPOSample(bucketKey, bucketName string, ts st.TempoSample) error {
-	s3Client, err := a.getClient()
-	if err != nil {
-		return fmt.Errorf("Failed to get s3 client: '%s': %q", ts.PrimaryId, err)
-	}
-	err = put[st.TempoSample](s3Client, bucketKey, bucketName, ts)
-	if err != nil {
-		return fmt.Errorf("Failed to PutSample: '%s': %q", ts.PrimaryId, err)
-	}
-	return nil
+// Close stops the background refresh of the AWS session
+func (a *AWSS3Service) Close() {
+	a.clients.stop()
 }
 
-func put[T any](s3Client *s3.Client, awsBucketKey, awsDestBucket string, t T) error {
-	rJson, err := json.Marshal(t)
-	if err != nil {
-		return fmt.Errorf("Failed to marshal: %q", err)
-	}
+// PutObject writes content into the given bucket under bucketKey
+func (a *AWSS3Service) PutObject(ctx context.Context, bucketKey, bucketName string, content []byte, metadata map[string]string) (err error) {
+	ctx, span := startS3Span(ctx, "PutObject", bucketName, bucketKey)
+	span.SetAttributes(attribute.Int(ObjectBytesKey, len(content)))
+	defer func() { endS3Span(span, err) }()
 
-	err = putObject(s3Client, []byte(rJson), awsBucketKey, awsDestBucket)
+	s3Client, err := a.clients.get(ctx)
 	if err != nil {
-		return fmt.Errorf("Failed to putObject: %q", err)
+		return fmt.Errorf("Failed to create S3 client %s:%s: %q", bucketName, bucketKey, err)
 	}
-	return nil
-}
-
-func putObject(client *s3.Client, content []byte, bucketKey, bucketName string) error {
 	input := &s3.PutObjectInput{
 		Bucket:      aws.String(bucketName),
 		Key:         aws.String(bucketKey),
 		Body:        bytes.NewReader(content),
 		ContentType: aws.String("application/json"),
+		Metadata:    metadata,
 	}
 
-	_, err := client.PutObject(context.TODO(), input)
+	opCtx, cancel := withTimeout(ctx, a.timeouts.Put)
+	defer cancel()
+	start := time.Now()
+	_, err = s3Client.PutObject(opCtx, input)
+	observeS3Request("PutObject", start, err)
 	if err != nil {
-		return fmt.Errorf("Failed to upload object, %v", err)
+		return classifyS3Error(fmt.Errorf("Failed to upload object, %w", err))
 	}
 
 	return nil
 }
 
-func (a *AWSS3Service) DeleteObject(bucketKey, bucketName string) error {
-	s3Client, err := a.getClient()
+func (a *AWSS3Service) DeleteObject(ctx context.Context, bucketKey, bucketName string) (err error) {
+	ctx, span := startS3Span(ctx, "DeleteObject", bucketName, bucketKey)
+	defer func() { endS3Span(span, err) }()
+
+	s3Client, err := a.clients.get(ctx)
 	if err != nil {
 		return fmt.Errorf("Failed to create S3 client %s:%s: %q", bucketName, bucketKey, err)
 	}
@@ -103,107 +104,208 @@ func (a *AWSS3Service) DeleteObject(bucketKey, bucketName string) error {
 		Key:    aws.String(bucketKey),
 	}
 
-	_, err = s3Client.DeleteObject(context.TODO(), input)
+	opCtx, cancel := withTimeout(ctx, a.timeouts.Delete)
+	defer cancel()
+	start := time.Now()
+	_, err = s3Client.DeleteObject(opCtx, input)
+	observeS3Request("DeleteObject", start, err)
 	if err != nil {
-		return fmt.Errorf("Failed to delete object, %v", err)
+		return classifyS3Error(fmt.Errorf("Failed to delete object, %w", err))
 	}
 	return nil
 }
 
-func (a *AWSS3Service) GetRequestObject(bucketKey, bucketName string) (SmileRequest, error) {
-	var sr SmileRequest
-	data, err := a.getObjectData(bucketKey, bucketName)
+func (a *AWSS3Service) GetObject(ctx context.Context, bucketKey, bucketName string) (data []byte, err error) {
+	ctx, span := startS3Span(ctx, "GetObject", bucketName, bucketKey)
+	defer func() {
+		span.SetAttributes(attribute.Int(ObjectBytesKey, len(data)))
+		endS3Span(span, err)
+	}()
+
+	s3Client, err := a.clients.get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create S3 client %s:%s: %q", bucketName, bucketKey, err)
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(bucketKey),
+	}
+	// the timeout covers reading the body as well
+	opCtx, cancel := withTimeout(ctx, a.timeouts.Get)
+	defer cancel()
+	start := time.Now()
+	output, err := s3Client.GetObject(opCtx, input)
 	if err != nil {
-		return sr, fmt.Errorf("Failed to read object %s:%s: %v", bucketName, bucketKey, err)
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			err = fmt.Errorf("Failed to get object %s:%s: %w", bucketName, bucketKey, ErrObjectNotFound)
+			observeS3Request("GetObject", start, err)
+			return nil, err
+		}
+		observeS3Request("GetObject", start, err)
+		return nil, classifyS3Error(fmt.Errorf("Failed to get object %s:%s: %w", bucketName, bucketKey, err))
 	}
-
-	sr, err = UnmarshalT[SmileRequest](data)
+	defer output.Body.Close()
+	data, err = io.ReadAll(output.Body)
+	observeS3Request("GetObject", start, err)
 	if err != nil {
-		return sr, fmt.Errorf("Failed to unmarshal object %s:%s: %v", bucketName, bucketKey, err)
+		return nil, fmt.Errorf("Failed to read object %s:%s: %v", bucketName, bucketKey, err)
 	}
 
-	return sr, nil
+	return data, nil
 }
 
-func (a *AWSS3Service) GetSampleObject(bucketKey, bucketName string) (SmileSample, error) {
-	var ss SmileSample
-	data, err := a.getObjectData(bucketKey, bucketName)
-	if err != nil {
-		return ss, fmt.Errorf("Failed to read object %s:%s: %v", bucketName, bucketKey, err)
-	}
+// ListObjects returns the keys in the bucket beginning with prefix
+func (a *AWSS3Service) ListObjects(ctx context.Context, prefix, bucketName string) (keys []string, err error) {
+	ctx, span := startS3Span(ctx, "ListObjectsV2", bucketName, prefix)
+	defer func() { endS3Span(span, err) }()
 
-	ss, err = UnmarshalT[SmileSample](data)
+	s3Client, err := a.clients.get(ctx)
 	if err != nil {
-		return ss, fmt.Errorf("Failed to unmarshal object %s:%s: %v", bucketName, bucketKey, err)
+		return nil, fmt.Errorf("Failed to create S3 client %s:%s: %q", bucketName, prefix, err)
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(prefix),
+	}
+	paginator := s3.NewListObjectsV2Paginator(s3Client, input)
+	for paginator.HasMorePages() {
+		page, err := a.listPage(ctx, paginator)
+		if err != nil {
+			return nil, classifyS3Error(fmt.Errorf("Failed to list objects %s:%s: %w", bucketName, prefix, err))
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
 	}
+	return keys, nil
+}
 
-	return ss, nil
+// listPage requests the next page of a listing, each page is a separate request with its own timeout
+func (a *AWSS3Service) listPage(ctx context.Context, paginator *s3.ListObjectsV2Paginator) (*s3.ListObjectsV2Output, error) {
+	opCtx, cancel := withTimeout(ctx, a.timeouts.List)
+	defer cancel()
+	start := time.Now()
+	page, err := paginator.NextPage(opCtx)
+	observeS3Request("ListObjectsV2", start, err)
+	return page, err
 }
 
-func (a *AWSS3Service) getObjectData(bucketKey, bucketName string) ([]byte, error) {
-	s3Client, err := a.getClient()
+func (a *AWSS3Service) HeadObject(ctx context.Context, bucketKey, bucketName string) (info ObjectInfo, err error) {
+	ctx, span := startS3Span(ctx, "HeadObject", bucketName, bucketKey)
+	defer func() {
+		span.SetAttributes(attribute.Int64(ObjectBytesKey, info.Size))
+		// a missing key is an expected outcome of a head, not an error
+		if errors.Is(err, ErrObjectNotFound) {
+			endS3Span(span, nil)
+			return
+		}
+		endS3Span(span, err)
+	}()
+
+	info = ObjectInfo{Key: bucketKey}
+	s3Client, err := a.clients.get(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create S3 client %s:%s: %q", bucketName, bucketKey, err)
+		return info, fmt.Errorf("Failed to create S3 client %s:%s: %q", bucketName, bucketKey, err)
 	}
-	input := &s3.GetObjectInput{
+	input := &s3.HeadObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(bucketKey),
 	}
-	output, err := s3Client.GetObject(context.TODO(), input)
+	opCtx, cancel := withTimeout(ctx, a.timeouts.Head)
+	defer cancel()
+	start := time.Now()
+	output, err := s3Client.HeadObject(opCtx, input)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get object %s:%s: %v", bucketName, bucketKey, err)
+		// HeadObject has no body, so a missing key surfaces as a generic NotFound
+		var nf *types.NotFound
+		if errors.As(err, &nf) {
+			err = fmt.Errorf("Failed to head object %s:%s: %w", bucketName, bucketKey, ErrObjectNotFound)
+			observeS3Request("HeadObject", start, err)
+			return info, err
+		}
+		observeS3Request("HeadObject", start, err)
+		return info, classifyS3Error(fmt.Errorf("Failed to head object %s:%s: %w", bucketName, bucketKey, err))
 	}
-	defer output.Body.Close()
-	data, err := io.ReadAll(output.Body)
+	observeS3Request("HeadObject", start, nil)
+	info.Size = aws.ToInt64(output.ContentLength)
+	info.LastModified = aws.ToTime(output.LastModified)
+	info.Metadata = output.Metadata
+	return info, nil
+}
+
+// HeadBucket checks that the bucket exists and can be accessed with the session's credentials
+func (a *AWSS3Service) HeadBucket(ctx context.Context, bucketName string) (err error) {
+	ctx, span := startS3Span(ctx, "HeadBucket", bucketName, "")
+	defer func() { endS3Span(span, err) }()
+
+	s3Client, err := a.clients.get(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read object %s:%s: %v", bucketName, bucketKey, err)
+		return fmt.Errorf("Failed to create S3 client %s: %q", bucketName, err)
+	}
+	opCtx, cancel := withTimeout(ctx, a.timeouts.Head)
+	defer cancel()
+	start := time.Now()
+	_, err = s3Client.HeadBucket(opCtx, &s3.HeadBucketInput{Bucket: aws.String(bucketName)})
+	observeS3Request("HeadBucket", start, err)
+	if err != nil {
+		return classifyS3Error(fmt.Errorf("Failed to head bucket %s: %w", bucketName, err))
 	}
+	return nil
+}
 
-	return data, nil
+// SessionHealthCheck reports the age of the AWS session, it fails when the last attempt to load a
+// session failed and there is no session that has not expired
+func (a *AWSS3Service) SessionHealthCheck() HealthCheck {
+	return HealthCheck{
+		Name: "aws session",
+		Check: func(ctx context.Context) (string, error) {
+			return a.clients.status()
+		},
+	}
 }
 
-func generateToken(saml2awsBin string) error {
-	cmd := exec.Command("sh", saml2awsBin)
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("Failed to run %q, err: %v", saml2awsBin, err)
+// startS3Span starts a child span of ctx for one S3 operation, bucketKey is a prefix for listings and
+// empty for bucket operations
+func startS3Span(ctx context.Context, operation, bucketName, bucketKey string) (context.Context, trace.Span) {
+	ctx, span := s3Tracer.Start(ctx, "S3 "+operation, trace.WithSpanKind(trace.SpanKindClient))
+	span.SetAttributes(attribute.String(S3BucketKey, bucketName))
+	if bucketKey != "" {
+		span.SetAttributes(attribute.String(ObjectKeyKey, bucketKey))
 	}
-	return nil
+	return ctx, span
 }
 
-func createClient(credsProfile, region string) (*s3.Client, error) {
-	var client *s3.Client
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(region),
-		config.WithSharedConfigProfile(credsProfile))
+func endS3Span(span trace.Span, err error) {
 	if err != nil {
-		return client, fmt.Errorf("Failed to load SDK configuration: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
-	return s3.NewFromConfig(cfg), nil
+	span.End()
 }
 
-func (a *AWSS3Service) getClient() (*s3.Client, error) {
-	if a.client == nil || a.sessionIsExpired() {
-		err := generateToken(a.saml2AWSBin)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to generate AWS token: %q", err)
-		}
-		// saml2AWS returns without error, but without being fully setup, lets pause
-		time.Sleep(time.Minute)
-		s3Client, err := createClient(a.samlProfile, a.samlRegion)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to create S3 client: %q", err)
-		}
-
-		a.sessionStart = time.Now()
-		a.client = s3Client
+// withTimeout bounds ctx by timeout unless it is 0
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return ctx, func() {}
 	}
-	return a.client, nil
+	return context.WithTimeout(ctx, timeout)
+}
+
+// S3 error codes that will recur on every attempt, anything else (throttling, 5xx,
+// expired credentials, network errors) is treated as transient
+var permanentS3ErrorCodes = map[string]bool{
+	"NoSuchBucket":      true,
+	"InvalidBucketName": true,
+	"KeyTooLongError":   true,
+	"InvalidArgument":   true,
+	"InvalidRequest":    true,
 }
 
-func (a *AWSS3Service) sessionIsExpired() bool {
-	if time.Since(a.sessionStart).Seconds() < a.sessionDuration {
-		return false
+func classifyS3Error(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && permanentS3ErrorCodes[apiErr.ErrorCode()] {
+		return permanentError(err)
 	}
-	return true
+	return err
 }
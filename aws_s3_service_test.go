@@ -1,14 +1,32 @@
 package smile_databricks_gateway
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestAWSS3(t *testing.T) {
+	if TestConfig.IGOAWSBucket == "" {
+		t.Skip("no IGO AWS bucket configured in TestConfig")
+	}
 
-	awsS3Service := NewAWSS3Service(TestConfig.SAML2AWSBin, TestConfig.SAMLProfile, TestConfig.SAMLRegion, TestConfig.AWSSessionDuration)
+	awsS3Service := NewAWSS3Service(NewSAML2AWSCredentialProvider(TestConfig.SAML2AWSBin, TestConfig.SAMLProfile, TestConfig.SAMLRegion, TestConfig.AWSSessionDuration), DefaultS3Timeouts())
 
 	t.Run("PutRequest", func(t *testing.T) {
 		putRequest, err := UnmarshalT[SmileRequest]([]byte(RequestJSON))
@@ -16,18 +34,18 @@ func TestAWSS3(t *testing.T) {
 			t.Fatalf("cannot unmarshal request: %q", err)
 		}
 		filename := fmt.Sprintf("%s_request.json", putRequest.IgoRequestID)
-		err = awsS3Service.PutRequest(filename, TestConfig.IGOAWSBucket, putRequest)
+		_, err = PutRequest(context.Background(), awsS3Service, filename, TestConfig.IGOAWSBucket, putRequest)
 		if err != nil {
 			t.Fatalf("cannot PutRequest: %q", err)
 		}
-		gotRequest, err := awsS3Service.GetRequestObject(filename, TestConfig.IGOAWSBucket)
+		gotRequest, err := GetRequestObject(context.Background(), awsS3Service, filename, TestConfig.IGOAWSBucket)
 		if err != nil {
 			t.Fatalf("cannot GetRequest: %q", err)
 		}
 		if !reflect.DeepEqual(gotRequest, putRequest) {
 			t.Errorf("got %v want %v", gotRequest, putRequest)
 		}
-		err = awsS3Service.DeleteObject(filename, TestConfig.IGOAWSBucket)
+		err = awsS3Service.DeleteObject(context.Background(), filename, TestConfig.IGOAWSBucket)
 		if err != nil {
 			t.Fatalf("cannot DeleteObject: %q", err)
 		}
@@ -40,20 +58,116 @@ func TestAWSS3(t *testing.T) {
 		}
 		putSample := putRequest.Samples[0]
 		filename := fmt.Sprintf("%s_sample.json", putSample.SampleName)
-		err = awsS3Service.PutSample(filename, TestConfig.IGOAWSBucket, putSample)
+		_, err = PutIGOSample(context.Background(), awsS3Service, filename, TestConfig.IGOAWSBucket, putSample)
 		if err != nil {
 			t.Fatalf("cannot PutSample: %q", err)
 		}
-		gotSample, err := awsS3Service.GetSampleObject(filename, TestConfig.IGOAWSBucket)
+		gotSample, err := GetSampleObject(context.Background(), awsS3Service, filename, TestConfig.IGOAWSBucket)
 		if err != nil {
 			t.Fatalf("cannot GetSample: %q", err)
 		}
 		if !reflect.DeepEqual(gotSample, putSample) {
 			t.Errorf("got %v want %v", gotSample, putSample)
 		}
-		err = awsS3Service.DeleteObject(filename, TestConfig.IGOAWSBucket)
+		err = awsS3Service.DeleteObject(context.Background(), filename, TestConfig.IGOAWSBucket)
 		if err != nil {
 			t.Fatalf("cannot DeleteObject: %q", err)
 		}
 	})
 }
+
+// newFakeS3Service returns an AWSS3Service whose requests, whatever bucket they address, are served by handler
+func newFakeS3Service(t *testing.T, handler http.HandlerFunc, timeouts S3Timeouts) *AWSS3Service {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	dialer := &net.Dialer{}
+	httpClient := &http.Client{Transport: &http.Transport{
+		// requests are addressed to <bucket>.127.0.0.1
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}}
+	provider := sdkCredentialProvider(func(ctx context.Context) (aws.Config, error) {
+		return aws.Config{
+			Region:           "us-east-1",
+			Credentials:      credentials.NewStaticCredentialsProvider("key-id", "secret", ""),
+			BaseEndpoint:     aws.String(server.URL),
+			HTTPClient:       httpClient,
+			RetryMaxAttempts: 1,
+		}, nil
+	})
+	return NewAWSS3Service(provider, timeouts)
+}
+
+func TestAWSS3ServiceContext(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	// the provider is global, the recorder must not see the spans of later tests
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	awsS3Service := newFakeS3Service(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "slow.json") {
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-r.Context().Done():
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}, S3Timeouts{Put: 100 * time.Millisecond})
+
+	lastSpan := func(t *testing.T) sdktrace.ReadOnlySpan {
+		spans := recorder.Ended()
+		if len(spans) == 0 {
+			t.Fatalf("no spans ended")
+		}
+		return spans[len(spans)-1]
+	}
+
+	t.Run("SpanHasBucketKeyAndBytes", func(t *testing.T) {
+		if err := awsS3Service.PutObject(context.Background(), "fast.json", testIGOBucket, []byte("{}"), nil); err != nil {
+			t.Fatalf("cannot PutObject: %q", err)
+		}
+		span := lastSpan(t)
+		if span.Name() != "S3 PutObject" {
+			t.Errorf("got span %q want %q", span.Name(), "S3 PutObject")
+		}
+		want := map[attribute.Key]attribute.Value{
+			S3BucketKey:    attribute.StringValue(testIGOBucket),
+			ObjectKeyKey:   attribute.StringValue("fast.json"),
+			ObjectBytesKey: attribute.IntValue(2),
+		}
+		for _, kv := range span.Attributes() {
+			if value, ok := want[kv.Key]; ok {
+				if kv.Value != value {
+					t.Errorf("got %s %v want %v", kv.Key, kv.Value.Emit(), value.Emit())
+				}
+				delete(want, kv.Key)
+			}
+		}
+		if len(want) != 0 {
+			t.Errorf("span is missing attributes %v", want)
+		}
+	})
+
+	t.Run("OperationTimesOut", func(t *testing.T) {
+		start := time.Now()
+		err := awsS3Service.PutObject(context.Background(), "slow.json", testIGOBucket, []byte("{}"), nil)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got err %v want %v", err, context.DeadlineExceeded)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("put took %s, the timeout is %s", elapsed, 100*time.Millisecond)
+		}
+		if span := lastSpan(t); span.Status().Code != codes.Error {
+			t.Errorf("got span status %v want %v", span.Status().Code, codes.Error)
+		}
+	})
+
+	t.Run("OperationIsCancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		if err := awsS3Service.PutObject(ctx, "slow.json", testIGOBucket, []byte("{}"), nil); !errors.Is(err, context.Canceled) {
+			t.Errorf("got err %v want %v", err, context.Canceled)
+		}
+	})
+}
@@ -0,0 +1,298 @@
+package smile_databricks_gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// BackfillOptions tunes how Backfill writes historical requests
+type BackfillOptions struct {
+	Layout Layout
+	// the number of requests written concurrently
+	Workers int
+	// requests written per second, 0 for no limit
+	RateLimit float64
+	// where progress is recorded so that an interrupted backfill resumes where it stopped, empty for none
+	CheckpointFile string
+	// write requests the gateway has already written from a SMILE message, which are otherwise skipped
+	Force bool
+}
+
+// BackfillCheckpoint records how far a backfill got through each of its input files
+type BackfillCheckpoint struct {
+	// the number of leading lines of each file that have been written
+	Files map[string]int `json:"files"`
+}
+
+type BackfillResult struct {
+	Written int
+	// lines that could never be written (undecodable requests or permanent failures), they are not retried on resume
+	Failed int
+	// lines that failed transiently, they are attempted again on resume
+	Unfinished int
+	// lines written by an earlier run, according to the checkpoint
+	Resumed int
+	// requests skipped because the gateway has already written them from a SMILE message
+	Skipped int
+}
+
+// Backfill writes the requests in source, a file of newline delimited SmileRequest JSON or a directory of
+// them, the way new requests published by SMILE are written.  Requests are written concurrently, ordered
+// by request and sample as messages are.  When ctx is done no more requests are started, those being
+// written are finished.  A request that fails transiently holds the checkpoint of its file back, so that
+// it is attempted again when the backfill is resumed.  Requests whose manifest was written from a SMILE message
+// may be newer than the history and are skipped, unless options.Force is set.
+func Backfill(ctx context.Context, store ObjectStore, bucketName, source string, options BackfillOptions) (BackfillResult, error) {
+	var result BackfillResult
+	files, err := backfillFiles(source)
+	if err != nil {
+		return result, err
+	}
+	progress, err := loadBackfillProgress(options.CheckpointFile)
+	if err != nil {
+		return result, err
+	}
+	limit := rate.Inf
+	if options.RateLimit > 0 {
+		limit = rate.Limit(options.RateLimit)
+	}
+	limiter := rate.NewLimiter(limit, 1)
+
+	// requests being written when ctx is done are finished
+	writeCtx := context.WithoutCancel(ctx)
+	var written, skipped, unfinished atomic.Int64
+	pool := newWorkerPool(backfillFlow, options.Workers, options.Workers, newKeySequencer(), func(line backfillLine) {
+		wrote, err := backfillRequest(writeCtx, store, bucketName, line.request, options)
+		switch {
+		case err == nil && !wrote:
+			skipped.Add(1)
+			progress.finish(line.file, line.number)
+		case err == nil:
+			written.Add(1)
+			progress.finish(line.file, line.number)
+		case ClassifyError(err) == PermanentError:
+			log.Printf("Failed to backfill %s:%d, it will not be retried: %v\n", line.file, line.number, err)
+			progress.fail(line.file, line.number)
+		default:
+			log.Printf("Failed to backfill %s:%d, it is attempted again on resume: %v\n", line.file, line.number, err)
+			unfinished.Add(1)
+		}
+	})
+
+	var errs []error
+	for _, file := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		resumed, err := backfillFile(ctx, file, progress, limiter, pool)
+		result.Resumed += resumed
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+	}
+	pool.stop()
+	pool.wait()
+	result.Written = int(written.Load())
+	result.Skipped = int(skipped.Load())
+	result.Failed = progress.numFailed()
+	result.Unfinished = int(unfinished.Load())
+	errs = append(errs, progress.save())
+	return result, errors.Join(errs...)
+}
+
+// backfillRequest commits request unless the gateway has written it from a SMILE message, it reports whether
+// request was written
+func backfillRequest(ctx context.Context, store ObjectStore, bucketName string, request SmileRequest, options BackfillOptions) (bool, error) {
+	manifest, err := get[RequestManifest](ctx, store, options.Layout.ManifestKey(request.IgoRequestID), bucketName)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return false, err
+	}
+	if manifest.MessageSequence != 0 && !options.Force {
+		return false, nil
+	}
+	// the stored sequence is kept, the manifest must not look older than the message that wrote it
+	return CommitIGORequest(ctx, store, bucketName, options.Layout, request, &Message{Sequence: manifest.MessageSequence})
+}
+
+type backfillLine struct {
+	file    string
+	number  int
+	request SmileRequest
+}
+
+// the longest line Backfill reads, requests with many samples can run to megabytes
+const maxBackfillLine = 64 << 20
+
+// backfillFile submits the requests in file that are beyond its checkpoint, returning how many were skipped.
+// It stops early when ctx is done.
+func backfillFile(ctx context.Context, file string, progress *backfillProgress, limiter *rate.Limiter, pool *workerPool[backfillLine]) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to open backfill file %s: %q", file, err)
+	}
+	defer f.Close()
+	checkpoint := progress.checkpoint(file)
+	resumed := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxBackfillLine)
+	for number := 1; scanner.Scan(); number++ {
+		if number <= checkpoint {
+			resumed++
+			continue
+		}
+		if len(scanner.Bytes()) == 0 {
+			progress.finish(file, number)
+			continue
+		}
+		var request SmileRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			log.Printf("Failed to unmarshal backfill request %s:%d, it will not be retried: %q\n", file, number, err)
+			progress.fail(file, number)
+			continue
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			return resumed, nil
+		}
+		pool.submit(newIGORequestKeys(request), backfillLine{file: file, number: number, request: request})
+	}
+	if err := scanner.Err(); err != nil {
+		return resumed, fmt.Errorf("Failed to read backfill file %s: %q", file, err)
+	}
+	return resumed, nil
+}
+
+// backfillFiles returns source, or the regular files in source when it is a directory, in name order
+func backfillFiles(source string) ([]string, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read backfill source: %q", err)
+	}
+	if !info.IsDir() {
+		return []string{source}, nil
+	}
+	entries, err := os.ReadDir(source)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read backfill source: %q", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			files = append(files, filepath.Join(source, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// backfillProgress tracks which lines have been written, lines finish out of order but the checkpoint of
+// a file only moves past a line once every line before it has finished
+type backfillProgress struct {
+	path string
+
+	mu       sync.Mutex
+	saved    BackfillCheckpoint
+	lastSave time.Time
+	failed   int
+	// lines beyond the checkpoint of each file that have finished
+	finished map[string]map[int]bool
+}
+
+func loadBackfillProgress(path string) (*backfillProgress, error) {
+	progress := &backfillProgress{path: path, saved: BackfillCheckpoint{Files: make(map[string]int)}, finished: make(map[string]map[int]bool)}
+	if path == "" {
+		return progress, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read backfill checkpoint %s: %q", path, err)
+	}
+	if err := json.Unmarshal(data, &progress.saved); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal backfill checkpoint %s: %q", path, err)
+	}
+	if progress.saved.Files == nil {
+		progress.saved.Files = make(map[string]int)
+	}
+	return progress, nil
+}
+
+func (p *backfillProgress) checkpoint(file string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.saved.Files[file]
+}
+
+func (p *backfillProgress) numFailed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failed
+}
+
+// fail finishes a line that can never be written
+func (p *backfillProgress) fail(file string, number int) {
+	p.mu.Lock()
+	p.failed++
+	p.mu.Unlock()
+	p.finish(file, number)
+}
+
+// finish records that a line has been written, saving the checkpoint at most every checkpointInterval
+func (p *backfillProgress) finish(file string, number int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished[file] == nil {
+		p.finished[file] = make(map[int]bool)
+	}
+	p.finished[file][number] = true
+	for p.finished[file][p.saved.Files[file]+1] {
+		delete(p.finished[file], p.saved.Files[file]+1)
+		p.saved.Files[file]++
+	}
+	if time.Since(p.lastSave) >= checkpointInterval {
+		if err := p.saveLocked(); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+}
+
+// how often the checkpoint is saved while a backfill runs
+const checkpointInterval = time.Second
+
+func (p *backfillProgress) save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.saveLocked()
+}
+
+// saveLocked writes the checkpoint, replacing the previous one only once it is complete, p.mu must be held
+func (p *backfillProgress) saveLocked() error {
+	if p.path == "" {
+		return nil
+	}
+	p.lastSave = time.Now()
+	data, err := json.MarshalIndent(p.saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal backfill checkpoint: %q", err)
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("Failed to write backfill checkpoint %s: %q", p.path, err)
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		return fmt.Errorf("Failed to write backfill checkpoint %s: %q", p.path, err)
+	}
+	return nil
+}
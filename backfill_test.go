@@ -0,0 +1,157 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "igo"
+	first := testRequest(t)
+	second := testRequest(t)
+	second.IgoRequestID = "IGO_TEST_REQUEST_2"
+	second.Samples[0].PrimaryID = "22022_CC_4"
+	third := testRequest(t)
+	third.IgoRequestID = "IGO_TEST_REQUEST_3"
+	third.Samples[0].PrimaryID = "22022_CC_5"
+	line := func(request SmileRequest) string {
+		data, err := json.Marshal(request)
+		if err != nil {
+			t.Fatalf("cannot marshal request: %q", err)
+		}
+		return string(data)
+	}
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input")
+	if err := os.Mkdir(input, 0o755); err != nil {
+		t.Fatalf("cannot create input: %q", err)
+	}
+	files := map[string][]string{
+		"a.ndjson": {line(first), line(second), "", "not a request"},
+		"b.ndjson": {line(third)},
+	}
+	for name, lines := range files {
+		if err := os.WriteFile(filepath.Join(input, name), []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			t.Fatalf("cannot write %s: %q", name, err)
+		}
+	}
+	checkpointFile := filepath.Join(dir, "checkpoint.json")
+	options := BackfillOptions{Layout: OverwriteLayout, Workers: 2, RateLimit: 1000, CheckpointFile: checkpointFile}
+	readCheckpoint := func(t *testing.T) map[string]int {
+		t.Helper()
+		data, err := os.ReadFile(checkpointFile)
+		if err != nil {
+			t.Fatalf("cannot read checkpoint: %q", err)
+		}
+		var checkpoint BackfillCheckpoint
+		if err := json.Unmarshal(data, &checkpoint); err != nil {
+			t.Fatalf("cannot unmarshal checkpoint: %q", err)
+		}
+		return checkpoint.Files
+	}
+
+	t.Run("TransientFailureHoldsCheckpoint", func(t *testing.T) {
+		store := &keyFailingObjectStore{ObjectStore: NewMemoryObjectStore(), suffix: "22022_CC_4_sample.json", err: errors.New("SlowDown")}
+		result, err := Backfill(ctx, store, bucket, input, options)
+		if err != nil {
+			t.Fatalf("cannot Backfill: %q", err)
+		}
+		if result != (BackfillResult{Written: 2, Failed: 1, Unfinished: 1}) {
+			t.Errorf("got result %+v want 2 written, 1 failed and 1 unfinished", result)
+		}
+		want := map[string]int{filepath.Join(input, "a.ndjson"): 1, filepath.Join(input, "b.ndjson"): 1}
+		if got := readCheckpoint(t); !reflect.DeepEqual(got, want) {
+			t.Errorf("got checkpoint %v want %v", got, want)
+		}
+
+		// resuming attempts the failed request again along with the lines after it
+		result, err = Backfill(ctx, store.ObjectStore, bucket, input, options)
+		if err != nil {
+			t.Fatalf("cannot Backfill: %q", err)
+		}
+		if result != (BackfillResult{Written: 1, Failed: 1, Resumed: 2}) {
+			t.Errorf("got result %+v want 1 written, 1 failed and 2 resumed", result)
+		}
+		want[filepath.Join(input, "a.ndjson")] = 4
+		if got := readCheckpoint(t); !reflect.DeepEqual(got, want) {
+			t.Errorf("got checkpoint %v want %v", got, want)
+		}
+		for _, request := range []SmileRequest{first, second, third} {
+			manifest, err := get[RequestManifest](ctx, store, request.IgoRequestID+"_manifest.json", bucket)
+			if err != nil {
+				t.Fatalf("cannot get manifest of %s: %q", request.IgoRequestID, err)
+			}
+			if len(manifest.Samples) != 1 || manifest.Samples[0].PrimaryID != request.Samples[0].PrimaryID {
+				t.Errorf("got manifest samples %+v want %s", manifest.Samples, request.Samples[0].PrimaryID)
+			}
+			if _, err := GetSampleObject(ctx, store, request.Samples[0].PrimaryID+"_sample.json", bucket); err != nil {
+				t.Errorf("sample of %s was not written: %q", request.IgoRequestID, err)
+			}
+		}
+	})
+
+	t.Run("RequestsWrittenFromMessagesAreSkipped", func(t *testing.T) {
+		store := NewMemoryObjectStore()
+		// the gateway has written a newer version of the first request from a SMILE message
+		newer := testRequest(t)
+		newer.Samples[0].OncotreeCode = "MEL"
+		if _, err := CommitIGORequest(ctx, store, bucket, OverwriteLayout, newer, &Message{Sequence: 7}); err != nil {
+			t.Fatalf("cannot CommitIGORequest: %q", err)
+		}
+		options := BackfillOptions{Layout: OverwriteLayout, Workers: 2}
+		result, err := Backfill(ctx, store, bucket, input, options)
+		if err != nil {
+			t.Fatalf("cannot Backfill: %q", err)
+		}
+		if result != (BackfillResult{Written: 2, Failed: 1, Skipped: 1}) {
+			t.Errorf("got result %+v want 2 written, 1 failed and 1 skipped", result)
+		}
+		gotSample, err := GetSampleObject(ctx, store, first.Samples[0].PrimaryID+"_sample.json", bucket)
+		if err != nil {
+			t.Fatalf("cannot get sample: %q", err)
+		}
+		if !reflect.DeepEqual(gotSample, newer.Samples[0]) {
+			t.Errorf("got %v want the sample written from the message %v", gotSample, newer.Samples[0])
+		}
+
+		// forcing writes the history, without making the manifest look older than the message that wrote it
+		options.Force = true
+		if result, err = Backfill(ctx, store, bucket, input, options); err != nil {
+			t.Fatalf("cannot Backfill: %q", err)
+		}
+		if result != (BackfillResult{Written: 3, Failed: 1}) {
+			t.Errorf("got result %+v want 3 written and 1 failed", result)
+		}
+		if gotSample, err = GetSampleObject(ctx, store, first.Samples[0].PrimaryID+"_sample.json", bucket); err != nil {
+			t.Fatalf("cannot get sample: %q", err)
+		}
+		if !reflect.DeepEqual(gotSample, first.Samples[0]) {
+			t.Errorf("got %v want the backfilled sample %v", gotSample, first.Samples[0])
+		}
+		manifest, err := get[RequestManifest](ctx, store, first.IgoRequestID+"_manifest.json", bucket)
+		if err != nil {
+			t.Fatalf("cannot get manifest: %q", err)
+		}
+		if manifest.MessageSequence != 7 {
+			t.Errorf("got manifest sequence %d want 7", manifest.MessageSequence)
+		}
+	})
+
+	t.Run("CompletedBackfillIsNotRepeated", func(t *testing.T) {
+		result, err := Backfill(ctx, NewMemoryObjectStore(), bucket, input, options)
+		if err != nil {
+			t.Fatalf("cannot Backfill: %q", err)
+		}
+		if result != (BackfillResult{Resumed: 5}) {
+			t.Errorf("got result %+v want every line resumed", result)
+		}
+	})
+}
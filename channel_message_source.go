@@ -0,0 +1,293 @@
+package smile_databricks_gateway
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChannelMessageSource is an in-process MessageSource.  Like a JetStream stream it retains
+// every published message, so a subscription receives, in order, all matching messages
+// published before and after it was created.  Each subscription invokes its handler from
+// a single goroutine, as a NATS push consumer does, and naked messages are redelivered.
+type ChannelMessageSource struct {
+	mu            sync.Mutex
+	published     []*channelPublication
+	subscriptions []*channelSubscription
+	closed        bool
+}
+
+type channelSubscription struct {
+	subjectFilter string
+	handler       MessageHandler
+	mu            sync.Mutex
+	cond          *sync.Cond
+	queue         []*Message
+	closed        bool
+	// reports whether a publication is at or after the point the subscription starts from, nil to start
+	// from the beginning of the stream
+	from func(p *channelPublication) bool
+}
+
+type channelPublication struct {
+	subject   string
+	data      []byte
+	header    map[string][]string
+	sequence  uint64
+	timestamp time.Time
+	ack       *ChannelAck
+}
+
+var _ ReplayableMessageSource = (*ChannelMessageSource)(nil)
+
+func NewChannelMessageSource() *ChannelMessageSource {
+	return &ChannelMessageSource{}
+}
+
+func (c *ChannelMessageSource) Subscribe(consumer, subjectFilter string, handler MessageHandler) error {
+	_, err := c.subscribe(subjectFilter, nil, handler)
+	return err
+}
+
+// SubscribeFrom delivers the messages published from start on, like Subscribe it goes on to deliver the
+// messages published after it
+func (c *ChannelMessageSource) SubscribeFrom(subjectFilter string, start ReplayStart, handler func(msg *Message, pending uint64)) (bool, error) {
+	from := func(p *channelPublication) bool {
+		if start.Sequence > 0 {
+			return p.sequence >= start.Sequence
+		}
+		return !p.timestamp.Before(start.Time)
+	}
+	numDelivered, err := c.subscribe(subjectFilter, from, func(m *Message) {
+		handler(m, c.pendingAfter(subjectFilter, m.Sequence))
+	})
+	return numDelivered == 0, err
+}
+
+// subscribe delivers the published messages matching subjectFilter and from, returning how many there were
+func (c *ChannelMessageSource) subscribe(subjectFilter string, from func(p *channelPublication) bool, handler MessageHandler) (int, error) {
+	sub := &channelSubscription{subjectFilter: subjectFilter, from: from, handler: handler}
+	sub.cond = sync.NewCond(&sub.mu)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, fmt.Errorf("Failed to subscribe %q: message source is shut down", subjectFilter)
+	}
+	numDelivered := 0
+	for _, p := range c.published {
+		if sub.deliver(p, 1) {
+			numDelivered++
+		}
+	}
+	c.subscriptions = append(c.subscriptions, sub)
+	go sub.run()
+	return numDelivered, nil
+}
+
+// pendingAfter returns the number of published messages matching subjectFilter after sequence
+func (c *ChannelMessageSource) pendingAfter(subjectFilter string, sequence uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := uint64(0)
+	for _, p := range c.published {
+		if p.sequence > sequence && subjectMatches(subjectFilter, p.subject) {
+			pending++
+		}
+	}
+	return pending
+}
+
+// Publish delivers data on subject to all matching subscriptions.  The returned
+// ChannelAck reports how the message was settled by its handler.
+func (c *ChannelMessageSource) Publish(subject string, data []byte) *ChannelAck {
+	return c.publish(subject, data, nil)
+}
+
+func (c *ChannelMessageSource) PublishMessage(subject string, data []byte, header map[string][]string) error {
+	c.publish(subject, data, header)
+	return nil
+}
+
+// Published returns every message published on subject, in order.  The returned
+// messages are copies for inspection and cannot be settled.
+func (c *ChannelMessageSource) Published(subject string) []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var published []Message
+	for _, p := range c.published {
+		if p.subject == subject {
+			published = append(published, Message{Subject: p.subject, Data: p.data, Header: p.header, Sequence: p.sequence, Timestamp: p.timestamp})
+		}
+	}
+	return published
+}
+
+func (c *ChannelMessageSource) publish(subject string, data []byte, header map[string][]string) *ChannelAck {
+	p := &channelPublication{subject: subject, data: data, header: header, timestamp: time.Now().UTC(), ack: NewChannelAck()}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return p.ack
+	}
+	// stream sequence numbers start at 1
+	p.sequence = uint64(len(c.published) + 1)
+	c.published = append(c.published, p)
+	for _, sub := range c.subscriptions {
+		sub.deliver(p, 1)
+	}
+	return p.ack
+}
+
+// Shutdown stops delivery, messages not yet handed to a handler are discarded
+func (c *ChannelMessageSource) Shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, sub := range c.subscriptions {
+		sub.close()
+	}
+}
+
+// deliver queues p for the handler if the subscription matches it, reporting whether it did
+func (s *channelSubscription) deliver(p *channelPublication, numDelivered uint64) bool {
+	if !subjectMatches(s.subjectFilter, p.subject) || (s.from != nil && !s.from(p)) {
+		return false
+	}
+	m := NewMessage(p.subject, p.data, &channelDelivery{publication: p, sub: s, numDelivered: numDelivered})
+	m.Header = p.header
+	m.NumDelivered = numDelivered
+	m.Sequence = p.sequence
+	m.Timestamp = p.timestamp
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.queue = append(s.queue, m)
+	s.cond.Signal()
+	return true
+}
+
+func (s *channelSubscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.queue = nil
+	s.cond.Signal()
+}
+
+func (s *channelSubscription) run() {
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		m := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		s.handler(m)
+	}
+}
+
+// subjectMatches implements NATS subject filter semantics: '*' matches a single token and
+// a trailing '>' matches one or more remaining tokens
+func subjectMatches(filter, subject string) bool {
+	filterTokens := strings.Split(filter, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, ft := range filterTokens {
+		if ft == ">" {
+			return i == len(filterTokens)-1 && len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) {
+			return false
+		}
+		if ft != "*" && ft != subjectTokens[i] {
+			return false
+		}
+	}
+	return len(filterTokens) == len(subjectTokens)
+}
+
+// channelDelivery settles a single delivery of a publication, redelivering it when naked
+type channelDelivery struct {
+	publication  *channelPublication
+	sub          *channelSubscription
+	numDelivered uint64
+}
+
+func (d *channelDelivery) Ack() error {
+	d.publication.ack.record(&d.publication.ack.acks, true)
+	return nil
+}
+
+func (d *channelDelivery) Nak() error {
+	return d.NakWithDelay(0)
+}
+
+func (d *channelDelivery) NakWithDelay(delay time.Duration) error {
+	d.publication.ack.record(&d.publication.ack.naks, false)
+	time.AfterFunc(delay, func() {
+		d.sub.deliver(d.publication, d.numDelivered+1)
+	})
+	return nil
+}
+
+func (d *channelDelivery) Term() error {
+	d.publication.ack.record(&d.publication.ack.terms, true)
+	return nil
+}
+
+// ChannelAck records how a message published on a ChannelMessageSource was settled
+type ChannelAck struct {
+	mu      sync.Mutex
+	acks    int
+	naks    int
+	terms   int
+	settled chan struct{}
+}
+
+func NewChannelAck() *ChannelAck {
+	return &ChannelAck{settled: make(chan struct{})}
+}
+
+// Settled is closed once the message has been acked or terminated
+func (a *ChannelAck) Settled() <-chan struct{} {
+	return a.settled
+}
+
+func (a *ChannelAck) Acks() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.acks
+}
+
+func (a *ChannelAck) Naks() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.naks
+}
+
+func (a *ChannelAck) Terms() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.terms
+}
+
+func (a *ChannelAck) record(counter *int, final bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	*counter++
+	if !final {
+		return
+	}
+	select {
+	case <-a.settled:
+	default:
+		close(a.settled)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+
+	sdg "github.com/mskcc/smile-databricks-gateway"
+)
+
+// runBackfill writes historical requests from newline delimited JSON files into the IGO bucket, stopping
+// (resumably, when a checkpoint is given) on interrupt
+func runBackfill(config sdg.Config) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	objectStore := newRetryingObjectStore(config, newObjectStore(config))
+	layout, err := config.ParseLayout()
+	handleError(err, "Invalid layout")
+
+	options := sdg.BackfillOptions{Layout: layout, Workers: config.Workers, RateLimit: config.RateLimit, CheckpointFile: config.Checkpoint, Force: config.Force}
+	result, err := sdg.Backfill(ctx, objectStore, config.IGOAWSBucket, config.Input, options)
+	log.Printf("Backfilled %d requests: %d failed, %d to be attempted again on resume, %d already written, %d skipped as written from SMILE\n",
+		result.Written, result.Failed, result.Unfinished, result.Resumed, result.Skipped)
+	handleError(err, "Requests cannot be backfilled")
+	if ctx.Err() != nil {
+		log.Println("Backfill interrupted")
+		os.Exit(1)
+	}
+	if result.Failed > 0 || result.Unfinished > 0 {
+		os.Exit(1)
+	}
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 
 	"github.com/docopt/docopt-go"
 	sdg "github.com/mskcc/smile-databricks-gateway"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel"
 )
 
@@ -31,12 +34,25 @@ Usage:
                            --tracerport=<port>
                            --ddservicename=<name>
                            --slackurl=<url>
-                           --saml2aws=<saml2aws>
-                           --saml2profile=<profile>
-                           --saml2region=<region>
                            --igoawsbucket=<bucket>
                            --tempoawsbucket=<bucket>
-                           --awssessionduration=<duration>
+                           [--quarantineprefix=<prefix>]
+                           [options]
+  smile-databricks-gateway quarantine list --bucket=<bucket> --quarantineprefix=<prefix>
+                           [options]
+  smile-databricks-gateway quarantine redrive --bucket=<bucket> --quarantineprefix=<prefix>
+                           [options]
+                           --momurl=<momurl> --momcert=<momcert> --momkey=<momkey> --momcons=<momcons> --mompw=<mompw>
+                           [<key>...]
+  smile-databricks-gateway reconcile --igoawsbucket=<bucket> --smilerequests=<source> [--repair]
+                           [options]
+  smile-databricks-gateway backfill --igoawsbucket=<bucket> --input=<path> [--checkpoint=<file>] [--force]
+                           [options]
+  smile-databricks-gateway replay (--startseq=<seq> | --starttime=<time>) [--dryrun]
+                           --momurl=<momurl> --momcert=<momcert> --momkey=<momkey> --momcons=<momcons> --mompw=<mompw>
+                           --momsub=<momsub> --momnrf=<momnrf> --momurf=<momurf> --momusf=<momusf> --momrsf=<momrsf> --momuef=<momuef>
+                           --igoawsbucket=<bucket> --tempoawsbucket=<bucket>
+                           [options]
 Options:
   -h --help                           Show this screen.
   --momurl=<momurl>                   The messaging system URL.
@@ -50,16 +66,76 @@ Options:
   --momusf=<momusf>                   The messaging system update sample topic filter.
   --momrsf=<momrsf>                   The messaging system release tempo samples topic filter.
   --momuef=<momuef>                   The messaging system update tempo sample embargo topic filter.
+  --momdrf=<momdrf>                   The messaging system delete samples and redact requests topic filter, deletions are
+                                      not processed when omitted
   --tracerhost=<hostname>             OTel Tracer hostname.
   --tracerport=<port>                 OTel Tracer port.
   --ddservicename=<name>              Datadog service name.
   --slackurl=<url>                    The URL to the slack channel for notification of new Extract project availability
-  --saml2aws=<saml2aws>               The saml2aws script
-  --saml2profile=<profile>            The aws creds profile
-  --saml2region=<region>              The aws region
   --igoawsbucket=<bucket>             The dest bucket for igo metadata (smile data sourced from IGO lims rest)
   --tempoawsbucket=<bucket>           The dest bucket for tempo metadata (smile data sourced from TEMPO)
-  --awssessionduration=<duration>     The time of the aws session (in seconds)
+  --awscreds=<provider>               How AWS credentials are obtained: static, env, profile, web-identity, assume-role
+                                      or saml2aws (legacy, the default, which requires --saml2aws) [default: saml2aws]
+  --awsregion=<region>                The aws region, defaults to --saml2region
+  --awsprofile=<profile>              The aws creds profile for the profile and assume-role providers, defaults to --saml2profile
+  --awsaccesskeyid=<id>               The access key id for the static provider
+  --awssecretaccesskey=<key>          The secret access key for the static provider
+  --awssessiontoken=<token>           The session token for the static provider
+  --awsrolearn=<arn>                  The role assumed by the web-identity and assume-role providers
+  --awswebidentitytokenfile=<file>    The OIDC token file for the web-identity provider
+  --awsexternalid=<id>                The external id for the assume-role provider
+  --awsrolesessionname=<name>         The session name for the web-identity and assume-role providers
+  --saml2aws=<saml2aws>               The saml2aws script, required when --awscreds is saml2aws
+  --saml2profile=<profile>            The aws creds profile
+  --saml2region=<region>              The aws region
+  --awssessionduration=<duration>     The time of the aws session (in seconds), used by the saml2aws provider [default: 3600]
+  --localstore=<dir>                  Write to a local directory (one subdirectory per bucket) instead of S3
+  --maxdeliver=<count>                Deliveries after which a failing message is terminated, 0 for no limit [default: 5]
+  --nakdelay=<delay>                  Delay before a transiently failing message is redelivered (in seconds) [default: 30]
+  --deadletter=<subject>              The messaging system subject undecodable messages are republished on
+  --quarantineprefix=<prefix>         The bucket prefix undecodable messages are written under (e.g. _quarantine/)
+  --layout=<layout>                   Where objects are written: overwrite (<id>_request.json etc., latest version only)
+                                      or versioned (requests/dt=YYYY-MM-DD/<id>/<sequence>_<uuid>_request.json etc.) [default: overwrite]
+  --requestkey=<template>             A Go text/template over the IGO request replacing <id>_request.json in the overwrite
+                                      layout, e.g. igo/{{.IgoProjectID}}/{{.IgoRequestID}}/request.json
+  --samplekey=<template>              A Go text/template over the IGO sample replacing <id>_sample.json in the overwrite
+                                      layout, e.g. igo/{{.AdditionalProperties.IgoRequestID}}/{{.PrimaryID}}/sample.json
+  --clinicalkey=<template>            A Go text/template over the TEMPO sample replacing <id>_clinical.json in the overwrite
+                                      layout, e.g. tempo/{{.PrimaryId}}/clinical.json
+  --workers=<count>                   The number of messages of each type processed concurrently [default: 4]
+  --igorequestbuf=<size>              The number of IGO request messages queued for a worker before the subscriber blocks [default: 1]
+  --igosamplebuf=<size>               The number of IGO sample messages queued for a worker before the subscriber blocks [default: 1]
+  --temposamplebuf=<size>             The number of TEMPO sample messages queued for a worker before the subscriber blocks [default: 1]
+  --httpaddr=<addr>                   The address /metrics, /healthz and /readyz are served on (e.g. :8080), not served when omitted
+  --draintimeout=<seconds>            How long in-flight messages are given to finish on shutdown before their writes
+                                      are cancelled and the messages redelivered, 0 for no limit [default: 60]
+  --s3puttimeout=<seconds>            The timeout of each S3 put, 0 for no timeout [default: 30]
+  --s3gettimeout=<seconds>            The timeout of each S3 get, 0 for no timeout [default: 30]
+  --s3deletetimeout=<seconds>         The timeout of each S3 delete, 0 for no timeout [default: 30]
+  --s3listtimeout=<seconds>           The timeout of each page of an S3 listing, 0 for no timeout [default: 60]
+  --s3headtimeout=<seconds>           The timeout of each S3 head, 0 for no timeout [default: 10]
+  --retrymaxattempts=<count>          Attempts of an object store operation that fails transiently, 1 for no retries [default: 5]
+  --retrybasedelay=<seconds>          The delay before the first retry, doubled for each retry after it [default: 0.2]
+  --retrymaxdelay=<seconds>           The longest delay between retries [default: 10]
+  --retryjitter=<fraction>            The fraction of each retry delay that is randomized, between 0 and 1 [default: 0.5]
+  --stagingcleanup=<seconds>          How often new IGO requests abandoned part way through their staged commit are
+                                      finished or removed from _staging/, 0 to disable [default: 600]
+  --stagingmaxage=<seconds>           How long a staged commit must go untouched before it is considered abandoned [default: 3600]
+  --embargoaudit=<prefix>             The TEMPO bucket prefix the embargo decision made for each TEMPO sample is recorded
+                                      under, empty to disable [default: _audit/embargo/]
+  --bucket=<bucket>                   The bucket holding quarantined messages
+  --smilerequests=<source>            A JSON file or http(s) URL holding an export of SMILE requests (an array of requests)
+  --repair                            Commit requests with missing or stale objects or manifests again, orphaned objects
+                                      are only reported
+  --input=<path>                      A file of newline delimited SMILE request JSON, or a directory of them, to backfill
+  --checkpoint=<file>                 The file backfill progress is recorded in, an interrupted backfill resumes from it
+  --ratelimit=<count>                 The number of requests backfilled per second, 0 for no limit [default: 0]
+  --force                             Backfill requests the gateway has already written from SMILE messages, which are
+                                      otherwise skipped as they may be newer than the backfill
+  --startseq=<seq>                    The stream sequence a replay starts at
+  --starttime=<time>                  The time a replay starts at, the first message published at or after it (RFC 3339)
+  --dryrun                            Print what a replay would write instead of writing it, without using S3: writes are
+                                      compared with the objects in --localstore when given, otherwise every write is printed
 `
 
 func setupSignalListener(cancel context.CancelFunc, wg *sync.WaitGroup) {
@@ -90,6 +166,23 @@ func main() {
 	err = args.Bind(&config)
 	handleError(err, "Error binding arguments")
 
+	if config.Quarantine {
+		runQuarantine(config)
+		return
+	}
+	if config.Reconcile {
+		runReconcile(config)
+		return
+	}
+	if config.Backfill {
+		runBackfill(config)
+		return
+	}
+	if config.Replay {
+		runReplay(config)
+		return
+	}
+
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 
@@ -100,14 +193,64 @@ func main() {
 	defer shutdownTracer()
 	tracer := otel.Tracer(config.DatadogServiceName + "-tracer")
 
-	awsS3Service := sdg.NewAWSS3Service(config.SAML2AWSBin, config.SAMLProfile, config.SAMLRegion, config.AWSSessionDuration)
+	// health checks use the store directly, they should report a failure rather than retry it
+	baseStore := newObjectStore(config)
+	if awsS3Service, ok := baseStore.(*sdg.AWSS3Service); ok {
+		defer awsS3Service.Close()
+	}
+	objectStore := newRetryingObjectStore(config, baseStore)
 
 	// setup smile service
-	smileService, err := sdg.NewSmileService(config.MomUrl, config.MomCert, config.MomKey, config.MomCons, config.MomPw, awsS3Service)
-	handleError(err, "SMILE Service cannot be created")
-	if err := smileService.Run(ctx, config.MomCons, config.MomSub, config.MomNrf, config.MomUrf, config.MomUsf, config.IGOAWSBucket, config.MomRsf, config.MomUef, config.TEMPOAWSBucket, tracer, config.SlackURL); err != nil {
+	natsMessageSource, err := sdg.NewNATSMessageSource(config.MomUrl, config.MomCert, config.MomKey, config.MomCons, config.MomPw)
+	handleError(err, "NATS message source cannot be created")
+	options, err := config.SmileServiceOptions()
+	handleError(err, "Invalid smile service options")
+	smileService := sdg.NewSmileService(natsMessageSource, objectStore, options)
+
+	if config.HTTPAddr != "" {
+		checks := []sdg.HealthCheck{natsMessageSource.ConnectionHealthCheck(), smileService.LastMessageHealthCheck()}
+		if awsS3Service, ok := baseStore.(*sdg.AWSS3Service); ok {
+			checks = append(checks, awsS3Service.SessionHealthCheck())
+		}
+		checks = append(checks, sdg.BucketHealthCheck(baseStore, config.IGOAWSBucket), sdg.BucketHealthCheck(baseStore, config.TEMPOAWSBucket))
+		httpServer := serveHTTP(config.HTTPAddr, checks)
+		defer httpServer.Shutdown(context.Background())
+	}
+
+	if err := smileService.Run(ctx, config.MomCons, config.MomSub, config.MomNrf, config.MomUrf, config.MomUsf, config.MomDrf, config.IGOAWSBucket, config.MomRsf, config.MomUef, config.TEMPOAWSBucket, tracer, config.SlackURL); err != nil {
 		os.Exit(1)
 	}
 	log.Println("Exiting SMILE Databricks Gateway...")
 
 }
+
+func serveHTTP(addr string, checks []sdg.HealthCheck) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", sdg.LivenessHandler(checks))
+	mux.Handle("/readyz", sdg.ReadinessHandler(checks))
+	httpServer := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			handleError(err, "HTTP server failed")
+		}
+	}()
+	return httpServer
+}
+
+func newObjectStore(config sdg.Config) sdg.ObjectStore {
+	if config.LocalStoreDir != "" {
+		objectStore, err := sdg.NewFileObjectStore(config.LocalStoreDir)
+		handleError(err, "Local object store cannot be created")
+		return objectStore
+	}
+	credentialProvider, err := config.AWSCredentialProvider()
+	handleError(err, "AWS credential provider cannot be created")
+	return sdg.NewAWSS3Service(credentialProvider, config.S3Timeouts())
+}
+
+func newRetryingObjectStore(config sdg.Config, store sdg.ObjectStore) sdg.ObjectStore {
+	retryingStore, err := sdg.NewRetryingObjectStore(store, config.RetryPolicy())
+	handleError(err, "Invalid retry policy")
+	return retryingStore
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	sdg "github.com/mskcc/smile-databricks-gateway"
+)
+
+// runQuarantine lists messages the gateway could not decode or re-drives them onto their original subject
+func runQuarantine(config sdg.Config) {
+	ctx := context.Background()
+	objectStore := newRetryingObjectStore(config, newObjectStore(config))
+
+	keys := config.Keys
+	if len(keys) == 0 {
+		var err error
+		keys, err = sdg.ListQuarantinedMessages(ctx, objectStore, config.QuarantinePrefix, config.Bucket)
+		handleError(err, "Quarantined messages cannot be listed")
+	}
+
+	if config.List {
+		for _, key := range keys {
+			qm, err := sdg.GetQuarantinedMessage(ctx, objectStore, key, config.Bucket)
+			handleError(err, "Quarantined message cannot be read")
+			fmt.Printf("%s\t%s\t%s\tdeliveries=%d\t%s\n", key, qm.QuarantinedAt.Format(time.RFC3339), qm.Subject, qm.NumDelivered, qm.Error)
+		}
+		return
+	}
+
+	natsMessageSource, err := sdg.NewNATSMessageSource(config.MomUrl, config.MomCert, config.MomKey, config.MomCons, config.MomPw)
+	handleError(err, "NATS message source cannot be created")
+	defer natsMessageSource.Shutdown()
+	for _, key := range keys {
+		err := sdg.RedriveQuarantinedMessage(ctx, objectStore, natsMessageSource, key, config.Bucket)
+		handleError(err, "Quarantined message cannot be re-driven")
+		log.Printf("Re-drove quarantined message: %s\n", key)
+	}
+	log.Printf("Re-drove %d quarantined messages\n", len(keys))
+}
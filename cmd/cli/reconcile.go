@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	sdg "github.com/mskcc/smile-databricks-gateway"
+)
+
+// runReconcile reports the requests, samples and manifests that are missing or stale in the IGO bucket,
+// and the objects in it SMILE does not know about, repairing the missing and stale ones when asked
+func runReconcile(config sdg.Config) {
+	ctx := context.Background()
+	objectStore := newRetryingObjectStore(config, newObjectStore(config))
+	layout, err := config.ParseLayout()
+	handleError(err, "Invalid layout")
+
+	requests, err := sdg.LoadSmileRequests(ctx, config.SmileRequests)
+	handleError(err, "SMILE requests cannot be loaded")
+	report, err := sdg.Reconcile(ctx, objectStore, config.IGOAWSBucket, layout, requests, config.Repair)
+	handleError(err, "Bucket cannot be reconciled")
+
+	for _, finding := range report.Findings {
+		repaired := ""
+		if finding.Repaired {
+			repaired = "repaired"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", finding.Status, finding.Kind, finding.ID, finding.Key, repaired)
+	}
+	log.Printf("Reconciled %d requests and %d objects: %d findings, %d unrepaired\n", len(requests), report.NumChecked, len(report.Findings), report.Unrepaired())
+	if report.Unrepaired() > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	sdg "github.com/mskcc/smile-databricks-gateway"
+	"go.opentelemetry.io/otel"
+)
+
+// runReplay lands every message on --momsub from a stream sequence or time again, exiting once it has caught
+// up with the stream.  With --dryrun the writes are printed instead of made and S3 is never used.
+func runReplay(config sdg.Config) {
+	start := sdg.ReplayStart{Sequence: uint64(config.StartSeq)}
+	if config.StartTime != "" {
+		startTime, err := time.Parse(time.RFC3339, config.StartTime)
+		handleError(err, "Invalid replay start time")
+		start.Time = startTime
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var objectStore sdg.ObjectStore
+	switch {
+	case config.DryRun && config.LocalStoreDir != "":
+		objectStore = sdg.NewDryRunObjectStore(newObjectStore(config), os.Stdout)
+	case config.DryRun:
+		// without a local store to compare with, every write is printed
+		objectStore = sdg.NewDryRunObjectStore(sdg.NewMemoryObjectStore(), os.Stdout)
+	default:
+		objectStore = newRetryingObjectStore(config, newObjectStore(config))
+	}
+
+	natsMessageSource, err := sdg.NewNATSMessageSource(config.MomUrl, config.MomCert, config.MomKey, config.MomCons, config.MomPw)
+	handleError(err, "NATS message source cannot be created")
+	replaySource := sdg.NewReplaySource(natsMessageSource, start)
+	go func() {
+		select {
+		case <-replaySource.Done():
+			log.Println("Replay caught up with the stream, draining...")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	options, err := config.SmileServiceOptions()
+	handleError(err, "Invalid smile service options")
+	// undecodable messages were dead-lettered and quarantined when they were first delivered, and abandoned
+	// staging is cleaned up by the running gateway
+	options.DeadLetterSubject = ""
+	options.QuarantinePrefix = ""
+	options.StagingCleanupInterval = 0
+	smileService := sdg.NewSmileService(replaySource, objectStore, options)
+
+	// replays do not notify slack
+	err = smileService.Run(ctx, config.MomCons, config.MomSub, config.MomNrf, config.MomUrf, config.MomUsf, config.MomDrf, config.IGOAWSBucket, config.MomRsf, config.MomUef, config.TEMPOAWSBucket, otel.Tracer("replay"), "")
+	handleError(err, "Messages cannot be replayed")
+
+	counts := replaySource.Counts()
+	log.Printf("Replayed messages: %d acked, %d naked, %d terminated\n", counts.Acked.Load(), counts.Naked.Load(), counts.Termed.Load())
+	if counts.Naked.Load() > 0 || counts.Termed.Load() > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,5 +1,10 @@
 package smile_databricks_gateway
 
+import (
+	"fmt"
+	"time"
+)
+
 type Config struct {
 	MomUrl             string  `docopt:"--momurl"`
 	MomCert            string  `docopt:"--momcert"`
@@ -12,6 +17,7 @@ type Config struct {
 	MomUsf             string  `docopt:"--momusf"`
 	MomRsf             string  `docopt:"--momrsf"`
 	MomUef             string  `docopt:"--momuef"`
+	MomDrf             string  `docopt:"--momdrf"`
 	OTELTracerHost     string  `docopt:"--tracerhost"`
 	OTELTracerPort     int     `docopt:"--tracerport"`
 	DatadogServiceName string  `docopt:"--ddservicename"`
@@ -22,6 +28,159 @@ type Config struct {
 	IGOAWSBucket       string  `docopt:"--igoawsbucket"`
 	TEMPOAWSBucket     string  `docopt:"--tempoawsbucket"`
 	AWSSessionDuration float64 `docopt:"--awssessionduration"`
+	LocalStoreDir      string  `docopt:"--localstore"`
+	MaxDeliver         int     `docopt:"--maxdeliver"`
+	NakDelay           float64 `docopt:"--nakdelay"`
+	DeadLetterSubject  string  `docopt:"--deadletter"`
+	QuarantinePrefix   string  `docopt:"--quarantineprefix"`
+	Layout             string  `docopt:"--layout"`
+	RequestKey         string  `docopt:"--requestkey"`
+	SampleKey          string  `docopt:"--samplekey"`
+	ClinicalKey        string  `docopt:"--clinicalkey"`
+	Workers            int     `docopt:"--workers"`
+	IGORequestBufSize  int     `docopt:"--igorequestbuf"`
+	IGOSampleBufSize   int     `docopt:"--igosamplebuf"`
+	TEMPOSampleBufSize int     `docopt:"--temposamplebuf"`
+	HTTPAddr           string  `docopt:"--httpaddr"`
+	DrainTimeout       float64 `docopt:"--draintimeout"`
+	S3PutTimeout       float64 `docopt:"--s3puttimeout"`
+	S3GetTimeout       float64 `docopt:"--s3gettimeout"`
+	S3DeleteTimeout    float64 `docopt:"--s3deletetimeout"`
+	S3ListTimeout      float64 `docopt:"--s3listtimeout"`
+	S3HeadTimeout      float64 `docopt:"--s3headtimeout"`
+	RetryMaxAttempts   int     `docopt:"--retrymaxattempts"`
+	RetryBaseDelay     float64 `docopt:"--retrybasedelay"`
+	RetryMaxDelay      float64 `docopt:"--retrymaxdelay"`
+	RetryJitter        float64 `docopt:"--retryjitter"`
+	StagingCleanup     float64 `docopt:"--stagingcleanup"`
+	StagingMaxAge      float64 `docopt:"--stagingmaxage"`
+	EmbargoAuditPrefix string  `docopt:"--embargoaudit"`
+
+	// AWS credentials
+	AWSCredentials          string `docopt:"--awscreds"`
+	AWSRegion               string `docopt:"--awsregion"`
+	AWSProfile              string `docopt:"--awsprofile"`
+	AWSAccessKeyID          string `docopt:"--awsaccesskeyid"`
+	AWSSecretAccessKey      string `docopt:"--awssecretaccesskey"`
+	AWSSessionToken         string `docopt:"--awssessiontoken"`
+	AWSRoleARN              string `docopt:"--awsrolearn"`
+	AWSWebIdentityTokenFile string `docopt:"--awswebidentitytokenfile"`
+	AWSExternalID           string `docopt:"--awsexternalid"`
+	AWSRoleSessionName      string `docopt:"--awsrolesessionname"`
+
+	// quarantine subcommand
+	Quarantine bool     `docopt:"quarantine"`
+	List       bool     `docopt:"list"`
+	Redrive    bool     `docopt:"redrive"`
+	Bucket     string   `docopt:"--bucket"`
+	Keys       []string `docopt:"<key>"`
+
+	// reconcile subcommand
+	Reconcile     bool   `docopt:"reconcile"`
+	SmileRequests string `docopt:"--smilerequests"`
+	Repair        bool   `docopt:"--repair"`
+
+	// backfill subcommand
+	Backfill   bool    `docopt:"backfill"`
+	Input      string  `docopt:"--input"`
+	Checkpoint string  `docopt:"--checkpoint"`
+	RateLimit  float64 `docopt:"--ratelimit"`
+	Force      bool    `docopt:"--force"`
+
+	// replay subcommand
+	Replay    bool   `docopt:"replay"`
+	StartSeq  int    `docopt:"--startseq"`
+	StartTime string `docopt:"--starttime"`
+	DryRun    bool   `docopt:"--dryrun"`
+}
+
+// ParseLayout returns the layout objects are written with, applying the key templates if there are any
+func (c Config) ParseLayout() (Layout, error) {
+	layout, err := ParseLayout(c.Layout)
+	if err != nil {
+		return layout, err
+	}
+	templates, err := ParseKeyTemplates(c.RequestKey, c.SampleKey, c.ClinicalKey)
+	if err != nil || templates == nil {
+		return layout, err
+	}
+	return layout.WithKeyTemplates(templates)
+}
+
+func (c Config) SmileServiceOptions() (SmileServiceOptions, error) {
+	layout, err := c.ParseLayout()
+	if err != nil {
+		return SmileServiceOptions{}, err
+	}
+	return SmileServiceOptions{
+		MaxDeliver:             c.MaxDeliver,
+		NakDelay:               seconds(c.NakDelay),
+		DeadLetterSubject:      c.DeadLetterSubject,
+		QuarantinePrefix:       c.QuarantinePrefix,
+		Layout:                 layout,
+		Workers:                c.Workers,
+		IGORequestBufSize:      c.IGORequestBufSize,
+		IGOSampleBufSize:       c.IGOSampleBufSize,
+		TEMPOSampleBufSize:     c.TEMPOSampleBufSize,
+		DrainTimeout:           seconds(c.DrainTimeout),
+		StagingCleanupInterval: seconds(c.StagingCleanup),
+		StagingMaxAge:          seconds(c.StagingMaxAge),
+		EmbargoAuditPrefix:     c.EmbargoAuditPrefix,
+	}, nil
+}
+
+func (c Config) S3Timeouts() S3Timeouts {
+	return S3Timeouts{
+		Put:    seconds(c.S3PutTimeout),
+		Get:    seconds(c.S3GetTimeout),
+		Delete: seconds(c.S3DeleteTimeout),
+		List:   seconds(c.S3ListTimeout),
+		Head:   seconds(c.S3HeadTimeout),
+	}
+}
+
+func (c Config) RetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: c.RetryMaxAttempts,
+		BaseDelay:   seconds(c.RetryBaseDelay),
+		MaxDelay:    seconds(c.RetryMaxDelay),
+		Jitter:      c.RetryJitter,
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// AWSCredentialProvider returns the provider selected by --awscreds, the saml2aws region and profile
+// are used when --awsregion and --awsprofile are not given.  The saml2aws provider needs the --saml2aws script.
+func (c Config) AWSCredentialProvider() (AWSCredentialProvider, error) {
+	region := c.AWSRegion
+	if region == "" {
+		region = c.SAMLRegion
+	}
+	profile := c.AWSProfile
+	if profile == "" {
+		profile = c.SAMLProfile
+	}
+	switch c.AWSCredentials {
+	case StaticCredentialProvider:
+		return NewStaticCredentialProvider(region, c.AWSAccessKeyID, c.AWSSecretAccessKey, c.AWSSessionToken), nil
+	case EnvCredentialProvider:
+		return NewEnvCredentialProvider(region), nil
+	case ProfileCredentialProvider:
+		return NewProfileCredentialProvider(region, profile), nil
+	case WebIdentityCredentialProvider:
+		return NewWebIdentityCredentialProvider(region, c.AWSRoleARN, c.AWSWebIdentityTokenFile, c.AWSRoleSessionName), nil
+	case AssumeRoleCredentialProvider:
+		return NewAssumeRoleCredentialProvider(NewProfileCredentialProvider(region, profile), c.AWSRoleARN, c.AWSExternalID, c.AWSRoleSessionName), nil
+	case "", SAML2AWSCredentialProvider:
+		if c.SAML2AWSBin == "" {
+			return nil, fmt.Errorf("Failed to select AWS credential provider: --saml2aws is required by the %s provider, or choose another with --awscreds", SAML2AWSCredentialProvider)
+		}
+		return NewSAML2AWSCredentialProvider(c.SAML2AWSBin, profile, region, c.AWSSessionDuration), nil
+	}
+	return nil, fmt.Errorf("Failed to select AWS credential provider: unknown provider %q", c.AWSCredentials)
 }
 
 var TestConfig = Config{
@@ -0,0 +1,187 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// IGODeletion is published by SMILE when samples are removed from a request, or when a request is withdrawn
+type IGODeletion struct {
+	IgoRequestID string   `json:"igoRequestId"`
+	PrimaryIDs   []string `json:"primaryIds"`
+	// the whole request is withdrawn, along with every sample in its manifest
+	Redacted bool   `json:"redacted"`
+	Reason   string `json:"reason"`
+}
+
+// Tombstone replaces a deleted request or sample, the DLT pipeline applies it as a delete.  It keeps the
+// fields the pipeline keys requests and samples by.
+type Tombstone struct {
+	IgoRequestID         string               `json:"igoRequestId,omitempty"`
+	PrimaryID            string               `json:"primaryId,omitempty"`
+	AdditionalProperties *tombstoneProperties `json:"additionalProperties,omitempty"`
+	Deleted              bool                 `json:"deleted"`
+	Reason               string               `json:"reason,omitempty"`
+}
+
+type tombstoneProperties struct {
+	IgoRequestID string `json:"igoRequestId"`
+}
+
+func requestTombstone(igoRequestID, reason string) Tombstone {
+	return Tombstone{IgoRequestID: igoRequestID, Deleted: true, Reason: reason}
+}
+
+func sampleTombstone(igoRequestID, primaryID, reason string) Tombstone {
+	return Tombstone{PrimaryID: primaryID, AdditionalProperties: &tombstoneProperties{IgoRequestID: igoRequestID}, Deleted: true, Reason: reason}
+}
+
+// removeSample drops a sample from the manifest, if it is listed
+func (m *RequestManifest) removeSample(primaryID string) {
+	m.Samples = slices.DeleteFunc(m.Samples, func(s ManifestSample) bool { return s.PrimaryID == primaryID })
+}
+
+// deletedPrimaryIDs returns the samples a deletion applies to, for a withdrawn request these include every
+// sample in its manifest
+func deletedPrimaryIDs(manifest RequestManifest, deletion IGODeletion) []string {
+	primaryIDs := slices.Clone(deletion.PrimaryIDs)
+	if !deletion.Redacted {
+		return primaryIDs
+	}
+	for _, sample := range manifest.Samples {
+		if !slices.Contains(primaryIDs, sample.PrimaryID) {
+			primaryIDs = append(primaryIDs, sample.PrimaryID)
+		}
+	}
+	return primaryIDs
+}
+
+// tombstoneKeys returns the keys the tombstones of a withdrawn request and of its deleted samples are written
+// to.  In place, they replace the objects listed in the manifest, whose keys may have been rendered from fields
+// a deletion does not carry.  Versioned tombstones land at a new key like any other version.
+func tombstoneKeys(layout Layout, manifest RequestManifest, deletion IGODeletion, primaryIDs []string, msg *Message) (string, []string, error) {
+	igoRequestID := deletion.IgoRequestID
+	requestKey := manifest.Request.Key
+	if deletion.Redacted && (requestKey == "" || layout.isVersioned()) {
+		key, err := layout.RequestKey(SmileRequest{IgoRequestID: igoRequestID}, msg)
+		if err != nil {
+			return "", nil, err
+		}
+		requestKey = key
+	}
+	sampleKeys := make([]string, 0, len(primaryIDs))
+	for _, primaryID := range primaryIDs {
+		i := slices.IndexFunc(manifest.Samples, func(s ManifestSample) bool { return s.PrimaryID == primaryID })
+		if i >= 0 && !layout.isVersioned() {
+			sampleKeys = append(sampleKeys, manifest.Samples[i].Key)
+			continue
+		}
+		key, err := layout.IGOSampleKey(SmileSample{PrimaryID: primaryID, AdditionalProperties: &AdditionalProperties{IgoRequestID: igoRequestID}}, msg)
+		if err != nil {
+			return "", nil, err
+		}
+		sampleKeys = append(sampleKeys, key)
+	}
+	return requestKey, sampleKeys, nil
+}
+
+// droppedPrimaryIDs returns the samples in the manifest of an updated request that the update no longer
+// lists.  An update that carries no sample list, or an empty one, drops nothing, withdrawing every sample of a
+// request takes a redacted deletion.
+func droppedPrimaryIDs(ctx context.Context, store ObjectStore, bucketName, manifestKey string, request SmileRequest) ([]string, error) {
+	if len(request.Samples) == 0 {
+		return nil, nil
+	}
+	manifest, err := get[RequestManifest](ctx, store, manifestKey, bucketName)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read manifest of updated request: '%s': %w", request.IgoRequestID, err)
+	}
+	var dropped []string
+	for _, sample := range manifest.Samples {
+		if !slices.ContainsFunc(request.Samples, func(s SmileSample) bool { return s.PrimaryID == sample.PrimaryID }) {
+			dropped = append(dropped, sample.PrimaryID)
+		}
+	}
+	return dropped, nil
+}
+
+// CommitIGODeletion replaces the deleted samples, and the request when it is withdrawn, with tombstones
+// and removes them from the manifest.  The tombstones and manifest are committed together.  It returns the
+// number of samples deleted, none when a message newer than msg has since written the request.  Events are
+// recorded on the span of ctx.
+func CommitIGODeletion(ctx context.Context, store ObjectStore, bucketName string, layout Layout, deletion IGODeletion, msg *Message) (int, error) {
+	span := trace.SpanFromContext(ctx)
+	manifestKey := layout.ManifestKey(deletion.IgoRequestID)
+	manifest, err := get[RequestManifest](ctx, store, manifestKey, bucketName)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return 0, fmt.Errorf("Failed to read manifest of request: '%s': %w", deletion.IgoRequestID, err)
+	}
+	primaryIDs := deletedPrimaryIDs(manifest, deletion)
+	requestKey, sampleKeys, err := tombstoneKeys(layout, manifest, deletion, primaryIDs, msg)
+	if err != nil {
+		return 0, err
+	}
+	commit := NewStagedCommit(store, bucketName, deletion.IgoRequestID, msg)
+	for i, primaryID := range primaryIDs {
+		tombstone := sampleTombstone(deletion.IgoRequestID, primaryID, deletion.Reason)
+		result, err := stage[Tombstone](ctx, commit, sampleKeys[i], tombstone)
+		if err != nil {
+			return 0, abortCommit(ctx, commit, fmt.Errorf("Failed to StageTombstone: '%s': %w", primaryID, err))
+		}
+		addSkippedEvent(span, result)
+		span.AddEvent(sampleTombstoneSucMsg, trace.WithAttributes(attribute.String(IGOSampleNameKey, primaryID)))
+	}
+	if deletion.Redacted {
+		result, err := stage[Tombstone](ctx, commit, requestKey, requestTombstone(deletion.IgoRequestID, deletion.Reason))
+		if err != nil {
+			return 0, abortCommit(ctx, commit, fmt.Errorf("Failed to StageTombstone: '%s': %w", deletion.IgoRequestID, err))
+		}
+		addSkippedEvent(span, result)
+		span.AddEvent(requestTombstoneSucMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, deletion.IgoRequestID)))
+	}
+	result, err := StageManifest(ctx, commit, manifestKey, deletion.IgoRequestID, msg, func(m *RequestManifest) {
+		for _, primaryID := range primaryIDs {
+			m.removeSample(primaryID)
+		}
+		if deletion.Redacted {
+			m.Deleted = true
+		}
+	})
+	if err != nil {
+		return 0, abortCommit(ctx, commit, err)
+	}
+	addSkippedEvent(span, result)
+	committed, err := commit.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !committed {
+		span.AddEvent(supersededCommitMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, deletion.IgoRequestID)))
+		return 0, nil
+	}
+	span.AddEvent(commitSucMsg, trace.WithAttributes(attribute.Int(NumObjectsCommittedKey, len(commit.objects))))
+	return len(primaryIDs), nil
+}
+
+// isTombstone reports whether the object at bucketKey is a tombstone
+func isTombstone(ctx context.Context, store ObjectStore, bucketKey, bucketName string) bool {
+	tombstone, err := get[Tombstone](ctx, store, bucketKey, bucketName)
+	return err == nil && tombstone.Deleted
+}
+
+// the keys a deletion is ordered by, it changes the request manifest as well as the samples
+func igoDeletionKeys(deletion IGODeletion) []string {
+	keys := make([]string, 0, len(deletion.PrimaryIDs)+1)
+	for _, primaryID := range deletion.PrimaryIDs {
+		keys = append(keys, "sample:"+primaryID)
+	}
+	return append(keys, "request:"+deletion.IgoRequestID)
+}
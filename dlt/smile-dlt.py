@@ -3,7 +3,7 @@ import dlt
 from pyspark.sql import SparkSession
 from pyspark.sql.window import Window
 from pyspark.sql.functions import *
-from pyspark.sql.types import StructField, StringType
+from pyspark.sql.types import StructField, StringType, StructType, ArrayType, LongType, BooleanType
 
 volume_path = spark.conf.get("volume_path")
 
@@ -22,6 +22,9 @@ def bronze_raw():
                 .option("cloudFiles.allowOverwrites", True)
                 .option("wholetext", True)
                 .load(volume_path)
+                # objects are staged under _staging/ until every object of a request has been written, then
+                # promoted one at a time, see committed_requests and committed_samples below
+                .filter(~col("_metadata.file_path").contains("/_staging/"))
                 .withColumn("inputFilename", col("_metadata.file_name"))
                 .withColumn("fullFilePath", col("_metadata.file_path"))
                 .withColumn("fileMetadata", col("_metadata"))
@@ -37,12 +40,26 @@ def bronze_raw():
         )
         return bronze_df
 
+# objects are routed to the tables below by the end of their key, <kind>.json, which the gateway's key
+# templates are required to keep.
+# files written with the versioned layout are named <sequence>_<uuid>_<kind>.json, where sequence is the
+# position of the SMILE message in its stream.  files written in place have no sequence and sort first.
+def message_sequence():
+    sequence = regexp_extract(col("inputFileName"), r"^(\d{20})_", 1)
+    return when(sequence == "", lit(0)).otherwise(sequence.cast("long"))
+
+# deleted samples and withdrawn requests are replaced by tombstones with "deleted": true, they are applied
+# as deletes so that the rows leave the silver tables
+def deleted():
+    return coalesce(col("parsed_json.deleted"), lit(False))
+
 ###########################################################################
 ## process requests
 
 # this schema allows us to get to the igo request id from request json
 json_request_schema = StructType([
     StructField("igoRequestId", StringType(), True),
+    StructField("deleted", BooleanType(), True),
 ])
 
 @dlt.table(
@@ -57,6 +74,8 @@ def bronze_requests():
         .select(
             col("parsed_json.igoRequestId").alias("IGO_REQUEST_ID"),
             col("value").alias("REQUEST_JSON"),
+            deleted().alias("DELETED"),
+            message_sequence().alias("MESSAGE_SEQUENCE"),
             col("ingestTime").alias("INGEST_TIME")
         ))
     return bronze_requests
@@ -71,7 +90,9 @@ dlt.apply_changes(
     source = "bronze_requests",
     keys = ["IGO_REQUEST_ID"],
     stored_as_scd_type = "1",
-    sequence_by = "INGEST_TIME"
+    sequence_by = struct("MESSAGE_SEQUENCE", "INGEST_TIME"),
+    apply_as_deletes = expr("DELETED = true"),
+    except_column_list = ["DELETED"]
 )
 
 ###########################################################################
@@ -87,6 +108,7 @@ json_sample_schema = StructType([
     StructField("cmoSampleName", StringType(), True),
     StructField("cfDNA2dBarcode", StringType(), True),
     StructField("cmoPatientId", StringType(), True),
+    StructField("deleted", BooleanType(), True),
 ])
 
 @dlt.table(
@@ -106,6 +128,8 @@ def bronze_samples():
             col("parsed_json.cfDNA2dBarcode").alias("CFDNA2DBARCODE"),
             col("parsed_json.cmoPatientID").alias("CMO_PATIENT_ID"),
             col("value").alias("SAMPLE_JSON"),
+            deleted().alias("DELETED"),
+            message_sequence().alias("MESSAGE_SEQUENCE"),
             col("ingestTime").alias("INGEST_TIME")
         ))
     return bronze_samples
@@ -119,5 +143,81 @@ dlt.apply_changes(
     source = "bronze_samples",
     keys = ["IGO_REQUEST_ID", "IGO_PRIMARY_ID"],
     stored_as_scd_type = "1",
-    sequence_by = "INGEST_TIME"
+    sequence_by = struct("MESSAGE_SEQUENCE", "INGEST_TIME"),
+    apply_as_deletes = expr("DELETED = true"),
+    except_column_list = ["DELETED"]
+)
+
+###########################################################################
+## process request manifests
+
+# this schema is for parsing the manifest the gateway keeps for each request
+json_manifest_schema = StructType([
+    StructField("igoRequestId", StringType(), True),
+    StructField("samples", ArrayType(StructType([
+        StructField("primaryId", StringType(), True),
+        StructField("key", StringType(), True),
+        StructField("hash", StringType(), True),
+    ])), True),
+    StructField("messageSequence", LongType(), True),
+    StructField("writtenAt", StringType(), True),
+    StructField("deleted", BooleanType(), True),
+])
+
+@dlt.table(
+    name = "bronze_manifests",
+    comment = "This table contains all request manifests as they arrive as *_manifest.json files on the landing volume (s3)."
+)
+def bronze_manifests():
+    bronze_data = dlt.read_stream("bronze_raw")
+    bronze_manifests = (bronze_data
+        .filter(col("inputFileName").endswith("manifest.json"))
+        .withColumn("parsed_json", from_json(col("value"), json_manifest_schema))
+        .select(
+            col("parsed_json.igoRequestId").alias("IGO_REQUEST_ID"),
+            transform(col("parsed_json.samples"), lambda s: s.primaryId).alias("IGO_PRIMARY_IDS"),
+            size(col("parsed_json.samples")).alias("NUM_SAMPLES"),
+            col("value").alias("MANIFEST_JSON"),
+            deleted().alias("DELETED"),
+            col("parsed_json.messageSequence").alias("MESSAGE_SEQUENCE"),
+            col("ingestTime").alias("INGEST_TIME")
+        ))
+    return bronze_manifests
+
+dlt.create_streaming_table(
+    name = "silver_manifests",
+    comment = "This table contains upserted request manifests via bronze_manifests, the samples each request is expected to have."
+)
+dlt.apply_changes(
+    target = "silver_manifests",
+    source = "bronze_manifests",
+    keys = ["IGO_REQUEST_ID"],
+    stored_as_scd_type = "1",
+    sequence_by = struct("MESSAGE_SEQUENCE", "INGEST_TIME"),
+    apply_as_deletes = expr("DELETED = true"),
+    except_column_list = ["DELETED"]
+)
+
+###########################################################################
+## committed requests and samples
+
+# the objects of a new request are promoted out of _staging/ one at a time, its manifest last, so a commit
+# interrupted part way leaves some of them in the silver tables until the gateway finishes it.  the tables
+# below only keep the requests, and the samples, listed by a manifest that has landed.
+
+@dlt.table(
+    name = "committed_requests",
+    comment = "This table contains the requests of silver_requests whose manifest has landed, so every object of which was committed."
+)
+def committed_requests():
+    manifests = dlt.read("silver_manifests").select("IGO_REQUEST_ID")
+    return dlt.read("silver_requests").join(manifests, "IGO_REQUEST_ID", "left_semi")
+
+@dlt.table(
+    name = "committed_samples",
+    comment = "This table contains the samples of silver_samples listed by the manifest of their request."
 )
+def committed_samples():
+    manifest_samples = (dlt.read("silver_manifests")
+        .select("IGO_REQUEST_ID", explode("IGO_PRIMARY_IDS").alias("IGO_PRIMARY_ID")))
+    return dlt.read("silver_samples").join(manifest_samples, ["IGO_REQUEST_ID", "IGO_PRIMARY_ID"], "left_semi")
@@ -0,0 +1,93 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DryRunObjectStore reports the writes and deletes made through it instead of making them.  They are kept
+// in memory so that reads see them, everything else is read from the store it wraps.  Writes to staging are
+// not reported, the objects they are promoted to are.
+type DryRunObjectStore struct {
+	store   ObjectStore
+	written *MemoryObjectStore
+	out     io.Writer
+
+	mu sync.Mutex
+	// keys deleted through the dry run, by bucket, that reads no longer see in store
+	deleted map[string]map[string]bool
+}
+
+var _ ObjectStore = (*DryRunObjectStore)(nil)
+
+func NewDryRunObjectStore(store ObjectStore, out io.Writer) *DryRunObjectStore {
+	return &DryRunObjectStore{store: store, written: NewMemoryObjectStore(), out: out, deleted: make(map[string]map[string]bool)}
+}
+
+func (d *DryRunObjectStore) PutObject(ctx context.Context, bucketKey, bucketName string, content []byte, metadata map[string]string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.deleted[bucketName], bucketKey)
+	d.report("put", bucketKey, bucketName, fmt.Sprintf("%d bytes", len(content)))
+	return d.written.PutObject(ctx, bucketKey, bucketName, content, metadata)
+}
+
+func (d *DryRunObjectStore) GetObject(ctx context.Context, bucketKey, bucketName string) ([]byte, error) {
+	if data, err := d.written.GetObject(ctx, bucketKey, bucketName); err == nil || d.isDeleted(bucketKey, bucketName) {
+		return data, err
+	}
+	return d.store.GetObject(ctx, bucketKey, bucketName)
+}
+
+func (d *DryRunObjectStore) DeleteObject(ctx context.Context, bucketKey, bucketName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.deleted[bucketName] == nil {
+		d.deleted[bucketName] = make(map[string]bool)
+	}
+	d.deleted[bucketName][bucketKey] = true
+	d.report("delete", bucketKey, bucketName, "")
+	return d.written.DeleteObject(ctx, bucketKey, bucketName)
+}
+
+func (d *DryRunObjectStore) ListObjects(ctx context.Context, prefix, bucketName string) ([]string, error) {
+	keys, err := d.store.ListObjects(ctx, prefix, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	written, err := d.written.ListObjects(ctx, prefix, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	keys = slices.DeleteFunc(keys, func(key string) bool { return d.isDeleted(key, bucketName) })
+	keys = append(keys, written...)
+	slices.Sort(keys)
+	return slices.Compact(keys), nil
+}
+
+func (d *DryRunObjectStore) HeadObject(ctx context.Context, bucketKey, bucketName string) (ObjectInfo, error) {
+	info, err := d.written.HeadObject(ctx, bucketKey, bucketName)
+	if err == nil || !errors.Is(err, ErrObjectNotFound) || d.isDeleted(bucketKey, bucketName) {
+		return info, err
+	}
+	return d.store.HeadObject(ctx, bucketKey, bucketName)
+}
+
+func (d *DryRunObjectStore) isDeleted(bucketKey, bucketName string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deleted[bucketName][bucketKey]
+}
+
+// report writes a line describing an operation that was not made, d.mu must be held
+func (d *DryRunObjectStore) report(operation, bucketKey, bucketName, detail string) {
+	if strings.HasPrefix(bucketKey, StagingPrefix) {
+		return
+	}
+	fmt.Fprintf(d.out, "would %s\t%s:%s\t%s\n", operation, bucketName, bucketKey, detail)
+}
@@ -0,0 +1,55 @@
+package smile_databricks_gateway
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDryRunObjectStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryObjectStore()
+	if err := store.PutObject(ctx, "existing.json", testIGOBucket, []byte(`{}`), nil); err != nil {
+		t.Fatalf("cannot PutObject: %q", err)
+	}
+	var out bytes.Buffer
+	dryRun := NewDryRunObjectStore(store, &out)
+	tg := startTestGatewayWithOptions(t, dryRun, DefaultSmileServiceOptions())
+	waitForAck(t, tg.publishJSON(t, testNewRequestFilter, testRequest(t)))
+
+	if keys, _ := store.ListObjects(ctx, "", testIGOBucket); len(keys) != 1 {
+		t.Errorf("got objects %v written through a dry run want only the existing one", keys)
+	}
+	want := "would put\t" + testIGOBucket + ":IGO_TEST_REQUEST_request.json\t"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("got report %q want it to contain %q", out.String(), want)
+	}
+	for _, key := range []string{"22022_CC_3_sample.json", "IGO_TEST_REQUEST_manifest.json"} {
+		if !strings.Contains(out.String(), key) {
+			t.Errorf("got report %q want it to contain %s", out.String(), key)
+		}
+	}
+	if strings.Contains(out.String(), StagingPrefix) {
+		t.Errorf("got report %q want staging left out", out.String())
+	}
+
+	// reads see what the dry run would have written and deleted
+	keys, err := dryRun.ListObjects(ctx, "", testIGOBucket)
+	if err != nil {
+		t.Fatalf("cannot list: %q", err)
+	}
+	wantKeys := []string{"22022_CC_3_sample.json", "IGO_TEST_REQUEST_manifest.json", "IGO_TEST_REQUEST_request.json", "existing.json"}
+	if strings.Join(keys, ",") != strings.Join(wantKeys, ",") {
+		t.Errorf("got keys %v want %v", keys, wantKeys)
+	}
+	if err := dryRun.DeleteObject(ctx, "existing.json", testIGOBucket); err != nil {
+		t.Fatalf("cannot delete: %q", err)
+	}
+	if _, err := dryRun.HeadObject(ctx, "existing.json", testIGOBucket); err == nil {
+		t.Errorf("got an object deleted through the dry run want it not found")
+	}
+	if _, err := store.HeadObject(ctx, "existing.json", testIGOBucket); err != nil {
+		t.Errorf("object deleted through the dry run was deleted: %q", err)
+	}
+}
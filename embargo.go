@@ -0,0 +1,215 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	st "github.mskcc.org/cdsi/cdsi-protobuf/smile/generated/v1/go"
+)
+
+// EmbargoAction is what was done with a TEMPO sample after checking its embargo
+type EmbargoAction string
+
+const (
+	// the sample is not under embargo and was written
+	ReleasedSample EmbargoAction = "released"
+	// the sample is under embargo and nothing was written, no clinical data for it was stored
+	WithheldSample EmbargoAction = "withheld"
+	// the sample is under embargo and the clinical data stored for it was replaced by a tombstone
+	RedactedSample EmbargoAction = "redacted"
+)
+
+// EmbargoDecision records why a TEMPO sample was or was not written
+type EmbargoDecision struct {
+	PrimaryID   string        `json:"primaryId"`
+	AccessLevel string        `json:"accessLevel"`
+	EmbargoDate string        `json:"embargoDate"`
+	Action      EmbargoAction `json:"action"`
+	Reason      string        `json:"reason"`
+	// the keys of the clinical data removed when the sample was redacted
+	RemovedKeys []string `json:"removedKeys,omitempty"`
+}
+
+// EmbargoAudit is the record written under the embargo audit prefix of the TEMPO bucket for each message
+type EmbargoAudit struct {
+	Subject         string            `json:"subject"`
+	MessageSequence uint64            `json:"messageSequence"`
+	Decisions       []EmbargoDecision `json:"decisions"`
+	DecidedAt       time.Time         `json:"decidedAt"`
+}
+
+// the layouts embargo dates are parsed with, dates without a zone are UTC
+var embargoDateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", time.DateOnly}
+
+// underEmbargo reports whether sample must be kept from Databricks at now, and why.  A sample whose access
+// level is an embargo, or whose embargo date has not passed or cannot be read, is under embargo.
+func underEmbargo(sample *st.TempoSample, now time.Time) (bool, string) {
+	if strings.Contains(strings.ToLower(sample.AccessLevel), "embargo") {
+		return true, fmt.Sprintf("access level is %q", sample.AccessLevel)
+	}
+	if sample.EmbargoDate == "" {
+		return false, "no embargo"
+	}
+	for _, layout := range embargoDateLayouts {
+		if embargoDate, err := time.Parse(layout, sample.EmbargoDate); err == nil {
+			if now.Before(embargoDate) {
+				return true, fmt.Sprintf("embargoed until %s", sample.EmbargoDate)
+			}
+			return false, fmt.Sprintf("embargo ended %s", sample.EmbargoDate)
+		}
+	}
+	return true, fmt.Sprintf("embargo date %q cannot be parsed", sample.EmbargoDate)
+}
+
+// RedactTEMPOSample replaces the clinical data stored for an embargoed sample with a tombstone, removing every
+// version of it.  It returns the keys removed, none when nothing but tombstones was stored.
+func RedactTEMPOSample(ctx context.Context, store ObjectStore, bucketName string, layout Layout, sample *st.TempoSample, reason string, msg *Message) ([]string, error) {
+	keys, err := storedTEMPOSampleKeys(ctx, store, bucketName, layout, sample)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	// the tombstone is written first, so that a failure part way leaves the sample redacted or still stored
+	// for the redelivery to redact, never gone without a tombstone
+	tombstone := Tombstone{PrimaryID: sample.PrimaryId, Deleted: true, Reason: reason}
+	key, err := layout.TEMPOSampleKey(sample, msg)
+	if err != nil {
+		return nil, err
+	}
+	if layout.isVersioned() {
+		if err := updateClinicalIndex(ctx, store, bucketName, sample.PrimaryId, func(index *clinicalIndex) {
+			index.Versions = append(index.Versions, clinicalVersion{Key: key, Deleted: true})
+		}); err != nil {
+			return nil, fmt.Errorf("Failed to RedactTEMPOSample: '%s': %w", sample.PrimaryId, err)
+		}
+	}
+	result, err := put[Tombstone](ctx, store, key, bucketName, tombstone)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to RedactTEMPOSample: '%s': %w", sample.PrimaryId, err)
+	}
+	for _, key := range keys {
+		if key == result.Key {
+			continue
+		}
+		if err := store.DeleteObject(ctx, key, bucketName); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return nil, fmt.Errorf("Failed to RedactTEMPOSample: '%s': %w", sample.PrimaryId, err)
+		}
+	}
+	if layout.isVersioned() {
+		// the removed versions leave the index once they are gone
+		if err := updateClinicalIndex(ctx, store, bucketName, sample.PrimaryId, func(index *clinicalIndex) {
+			index.Versions = slices.DeleteFunc(index.Versions, func(v clinicalVersion) bool { return slices.Contains(keys, v.Key) })
+		}); err != nil {
+			return nil, fmt.Errorf("Failed to RedactTEMPOSample: '%s': %w", sample.PrimaryId, err)
+		}
+	}
+	return keys, nil
+}
+
+// storedTEMPOSampleKeys returns the keys holding clinical data of sample, tombstones are left out.  Versions
+// are looked up in the clinical index of the sample rather than listed.
+func storedTEMPOSampleKeys(ctx context.Context, store ObjectStore, bucketName string, layout Layout, sample *st.TempoSample) ([]string, error) {
+	primaryID := sample.PrimaryId
+	if layout.isVersioned() {
+		index, err := get[clinicalIndex](ctx, store, clinicalIndexKey(primaryID), bucketName)
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read clinical data index of %s: %w", primaryID, err)
+		}
+		var keys []string
+		for _, version := range index.Versions {
+			if !version.Deleted {
+				keys = append(keys, version.Key)
+			}
+		}
+		return keys, nil
+	}
+	key, err := layout.TEMPOSampleKey(sample, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = store.HeadObject(ctx, key, bucketName)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read clinical data of %s: %w", primaryID, err)
+	}
+	if isTombstone(ctx, store, key, bucketName) {
+		return nil, nil
+	}
+	return []string{key}, nil
+}
+
+// the prefix of the TEMPO bucket the versions of the clinical data of each sample are indexed under when
+// written with the versioned layout
+const clinicalIndexPrefix = "_index/clinical/"
+
+// clinicalIndex lists the keys the clinical data of a TEMPO sample was written to with the versioned layout,
+// so that redacting the sample does not list every version of every sample
+type clinicalIndex struct {
+	PrimaryID string            `json:"primaryId"`
+	Versions  []clinicalVersion `json:"versions"`
+}
+
+type clinicalVersion struct {
+	Key string `json:"key"`
+	// the version is a tombstone
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func clinicalIndexKey(primaryID string) string {
+	return clinicalIndexPrefix + primaryID + ".json"
+}
+
+// updateClinicalIndex applies update to the clinical index of primaryID, or to an empty one if there is none yet
+func updateClinicalIndex(ctx context.Context, store ObjectStore, bucketName, primaryID string, update func(*clinicalIndex)) error {
+	bucketKey := clinicalIndexKey(primaryID)
+	index, err := get[clinicalIndex](ctx, store, bucketKey, bucketName)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("Failed to read clinical data index of %s: %w", primaryID, err)
+	}
+	index.PrimaryID = primaryID
+	update(&index)
+	if _, err := put[clinicalIndex](ctx, store, bucketKey, bucketName, index); err != nil {
+		return fmt.Errorf("Failed to write clinical data index of %s: %w", primaryID, err)
+	}
+	return nil
+}
+
+// WriteTEMPOSample writes the clinical data of a sample that is not under embargo.  With the versioned layout
+// the version is indexed before it is written, so that no version is ever stored without being indexed.
+func WriteTEMPOSample(ctx context.Context, store ObjectStore, bucketName string, layout Layout, sample *st.TempoSample, msg *Message) (PutResult, error) {
+	key, err := layout.TEMPOSampleKey(sample, msg)
+	if err != nil {
+		return PutResult{Key: key}, err
+	}
+	if layout.isVersioned() {
+		if err := updateClinicalIndex(ctx, store, bucketName, sample.PrimaryId, func(index *clinicalIndex) {
+			index.Versions = append(index.Versions, clinicalVersion{Key: key})
+		}); err != nil {
+			return PutResult{Key: key}, fmt.Errorf("Failed to PutSample: '%s': %w", sample.PrimaryId, err)
+		}
+	}
+	return PutTEMPOSample(ctx, store, key, bucketName, sample)
+}
+
+// WriteEmbargoAudit records the decisions made for the samples of msg under prefix in the given bucket
+func WriteEmbargoAudit(ctx context.Context, store ObjectStore, prefix, bucketName string, msg *Message, decisions []EmbargoDecision) (string, error) {
+	audit := EmbargoAudit{Subject: msg.Subject, MessageSequence: msg.Sequence, Decisions: decisions, DecidedAt: time.Now().UTC()}
+	// keys sort by decision time
+	bucketKey := fmt.Sprintf("%s%s_%s.json", prefix, audit.DecidedAt.Format("20060102T150405.000000000Z"), uuid.NewString())
+	if _, err := put[EmbargoAudit](ctx, store, bucketKey, bucketName, audit); err != nil {
+		return "", fmt.Errorf("Failed to write embargo audit for %q: %w", msg.Subject, err)
+	}
+	return bucketKey, nil
+}
@@ -0,0 +1,34 @@
+package smile_databricks_gateway
+
+import (
+	"testing"
+	"time"
+
+	st "github.mskcc.org/cdsi/cdsi-protobuf/smile/generated/v1/go"
+)
+
+func TestUnderEmbargo(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		sample *st.TempoSample
+		want   bool
+	}{
+		{"NoEmbargo", &st.TempoSample{}, false},
+		{"PublicAccess", &st.TempoSample{AccessLevel: "MSK Public"}, false},
+		{"EmbargoAccess", &st.TempoSample{AccessLevel: "MSK Embargo"}, true},
+		{"EmbargoAccessPastDate", &st.TempoSample{AccessLevel: "MSK Embargo", EmbargoDate: "2025-01-01"}, true},
+		{"FutureDate", &st.TempoSample{EmbargoDate: "2025-06-02"}, true},
+		{"PastDate", &st.TempoSample{EmbargoDate: "2025-05-31 23:59"}, false},
+		{"FutureTimestamp", &st.TempoSample{EmbargoDate: "2025-06-01T13:00:00Z"}, true},
+		{"UnparsableDate", &st.TempoSample{EmbargoDate: "next year"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := underEmbargo(tt.sample, now)
+			if got != tt.want {
+				t.Errorf("got under embargo %t (%s) want %t", got, reason, tt.want)
+			}
+		})
+	}
+}
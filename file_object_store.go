@@ -0,0 +1,176 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileObjectStore is an ObjectStore backed by a local directory.  Each bucket
+// is a subdirectory of root and each key is a (possibly nested) file within it.
+// Object metadata is kept in a hidden JSON sidecar next to the object.
+type FileObjectStore struct {
+	root string
+}
+
+var _ ObjectStore = (*FileObjectStore)(nil)
+
+func NewFileObjectStore(root string) (*FileObjectStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("Failed to create object store root %q: %q", root, err)
+	}
+	return &FileObjectStore{root: root}, nil
+}
+
+func (f *FileObjectStore) PutObject(ctx context.Context, bucketKey, bucketName string, content []byte, metadata map[string]string) error {
+	path, err := f.objectPath(bucketKey, bucketName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("Failed to create directory for object %s:%s: %v", bucketName, bucketKey, err)
+	}
+	metadataJson, err := json.Marshal(metadata)
+	if err != nil {
+		return permanentError(fmt.Errorf("Failed to marshal metadata for object %s:%s: %v", bucketName, bucketKey, err))
+	}
+	// the sidecar is removed before the content is written and written after it, so a failed write never
+	// leaves behind a content hash of content that was not written, which would skip the retry as unchanged
+	if err := os.Remove(metadataPath(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Failed to remove metadata for object %s:%s: %v", bucketName, bucketKey, err)
+	}
+	if err := writeFileAtomic(path, content); err != nil {
+		return fmt.Errorf("Failed to write object %s:%s: %v", bucketName, bucketKey, err)
+	}
+	if err := writeFileAtomic(metadataPath(path), metadataJson); err != nil {
+		return fmt.Errorf("Failed to write metadata for object %s:%s: %v", bucketName, bucketKey, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes to a temp file and renames it so readers never see a partial file
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func metadataPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".metadata")
+}
+
+func (f *FileObjectStore) GetObject(ctx context.Context, bucketKey, bucketName string) ([]byte, error) {
+	path, err := f.objectPath(bucketKey, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Failed to get object %s:%s: %w", bucketName, bucketKey, ErrObjectNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get object %s:%s: %v", bucketName, bucketKey, err)
+	}
+	return data, nil
+}
+
+func (f *FileObjectStore) DeleteObject(ctx context.Context, bucketKey, bucketName string) error {
+	path, err := f.objectPath(bucketKey, bucketName)
+	if err != nil {
+		return err
+	}
+	// like S3, deleting a missing key is not an error
+	for _, p := range []string{path, metadataPath(path)} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("Failed to delete object %s:%s: %v", bucketName, bucketKey, err)
+		}
+	}
+	return nil
+}
+
+func (f *FileObjectStore) ListObjects(ctx context.Context, prefix, bucketName string) ([]string, error) {
+	bucketDir := filepath.Join(f.root, bucketName)
+	var keys []string
+	err := filepath.WalkDir(bucketDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		// hidden files are temp files and metadata sidecars
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketDir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list objects %s:%s: %v", bucketName, prefix, err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (f *FileObjectStore) HeadObject(ctx context.Context, bucketKey, bucketName string) (ObjectInfo, error) {
+	info := ObjectInfo{Key: bucketKey}
+	path, err := f.objectPath(bucketKey, bucketName)
+	if err != nil {
+		return info, err
+	}
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return info, fmt.Errorf("Failed to head object %s:%s: %w", bucketName, bucketKey, ErrObjectNotFound)
+	}
+	if err != nil {
+		return info, fmt.Errorf("Failed to head object %s:%s: %v", bucketName, bucketKey, err)
+	}
+	info.Size = fi.Size()
+	info.LastModified = fi.ModTime()
+	metadataJson, err := os.ReadFile(metadataPath(path))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return info, fmt.Errorf("Failed to read metadata for object %s:%s: %v", bucketName, bucketKey, err)
+	}
+	if len(metadataJson) != 0 {
+		if err := json.Unmarshal(metadataJson, &info.Metadata); err != nil {
+			return info, fmt.Errorf("Failed to unmarshal metadata for object %s:%s: %v", bucketName, bucketKey, err)
+		}
+	}
+	return info, nil
+}
+
+// objectPath maps a bucket/key onto the filesystem, refusing keys that escape the bucket directory
+func (f *FileObjectStore) objectPath(bucketKey, bucketName string) (string, error) {
+	if bucketName == "" || strings.ContainsAny(bucketName, `/\`) || bucketName == "." || bucketName == ".." {
+		return "", permanentError(fmt.Errorf("Invalid bucket name: %q", bucketName))
+	}
+	bucketDir := filepath.Join(f.root, bucketName)
+	path := filepath.Join(bucketDir, filepath.FromSlash(bucketKey))
+	if bucketKey == "" || !strings.HasPrefix(path, bucketDir+string(filepath.Separator)) {
+		return "", permanentError(fmt.Errorf("Invalid object key %s:%s", bucketName, bucketKey))
+	}
+	return path, nil
+}
@@ -0,0 +1,106 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HealthCheck reports on one component of the gateway.  Check returns a human readable
+// description of the component's state and an error when it is not working.
+type HealthCheck struct {
+	Name string
+	// liveness checks are reported by /healthz as well as /readyz, a failing liveness check
+	// tells the orchestrator the gateway must be restarted
+	Liveness bool
+	Check    func(ctx context.Context) (string, error)
+}
+
+type healthReport struct {
+	Status string                       `json:"status"`
+	Checks map[string]healthCheckResult `json:"checks"`
+}
+
+type healthCheckResult struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	healthyStatus      = "ok"
+	unhealthyStatus    = "failing"
+	healthCheckTimeout = 5 * time.Second
+)
+
+// the key looked up to check a bucket when the object store cannot head buckets, it never exists
+const healthCheckKey = "_health/check"
+
+// LivenessHandler serves /healthz, running only the liveness checks
+func LivenessHandler(checks []HealthCheck) http.Handler {
+	var liveness []HealthCheck
+	for _, check := range checks {
+		if check.Liveness {
+			liveness = append(liveness, check)
+		}
+	}
+	return healthHandler(liveness)
+}
+
+// ReadinessHandler serves /readyz, running every check
+func ReadinessHandler(checks []HealthCheck) http.Handler {
+	return healthHandler(checks)
+}
+
+// healthHandler responds 200 when all checks pass and 503 otherwise, with the result of each check as JSON
+func healthHandler(checks []HealthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+		report := healthReport{Status: healthyStatus, Checks: make(map[string]healthCheckResult, len(checks))}
+		for _, check := range checks {
+			detail, err := check.Check(ctx)
+			result := healthCheckResult{OK: err == nil, Detail: detail}
+			if err != nil {
+				result.Error = err.Error()
+				report.Status = unhealthyStatus
+			}
+			report.Checks[check.Name] = result
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != healthyStatus {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// BucketHealthCheck checks that bucketName can be reached with the object store's credentials
+func BucketHealthCheck(store ObjectStore, bucketName string) HealthCheck {
+	return HealthCheck{
+		Name: "bucket " + bucketName,
+		Check: func(ctx context.Context) (string, error) {
+			if bh, ok := store.(interface {
+				HeadBucket(ctx context.Context, bucketName string) error
+			}); ok {
+				if err := bh.HeadBucket(ctx, bucketName); err != nil {
+					return "", err
+				}
+				return "bucket is reachable", nil
+			}
+			// a missing key still proves the bucket can be read
+			if _, err := store.HeadObject(ctx, healthCheckKey, bucketName); err != nil && !errors.Is(err, ErrObjectNotFound) {
+				return "", err
+			}
+			return "bucket is reachable", nil
+		},
+	}
+}
+
+// formatAge describes how long ago t was, rounded to the second
+func formatAge(t time.Time) string {
+	return fmt.Sprintf("%s ago", time.Since(t).Round(time.Second))
+}
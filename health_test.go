@@ -0,0 +1,55 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthHandlers(t *testing.T) {
+	store := NewMemoryObjectStore()
+	smileService := NewSmileService(NewChannelMessageSource(), store, DefaultSmileServiceOptions())
+	unreachable := HealthCheck{
+		Name: "unreachable",
+		Check: func(ctx context.Context) (string, error) {
+			return "", errors.New("connection refused")
+		},
+	}
+	checks := []HealthCheck{smileService.LastMessageHealthCheck(), BucketHealthCheck(store, testIGOBucket)}
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		wantStatus int
+		wantChecks map[string]bool
+	}{
+		{"Ready", ReadinessHandler(checks), http.StatusOK, map[string]bool{"last message": true, "bucket " + testIGOBucket: true}},
+		{"NotReady", ReadinessHandler(append(checks, unreachable)), http.StatusServiceUnavailable, map[string]bool{"last message": true, "bucket " + testIGOBucket: true, "unreachable": false}},
+		// only liveness checks affect /healthz
+		{"Live", LivenessHandler(append(checks, unreachable)), http.StatusOK, map[string]bool{"last message": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			tt.handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("got status %d want %d", recorder.Code, tt.wantStatus)
+			}
+			var report healthReport
+			if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+				t.Fatalf("cannot decode health report: %q", err)
+			}
+			if len(report.Checks) != len(tt.wantChecks) {
+				t.Errorf("got checks %v want %v", report.Checks, tt.wantChecks)
+			}
+			for name, ok := range tt.wantChecks {
+				if result, found := report.Checks[name]; !found || result.OK != ok {
+					t.Errorf("got check %q %+v want ok %v", name, result, ok)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package smile_databricks_gateway
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	st "github.mskcc.org/cdsi/cdsi-protobuf/smile/generated/v1/go"
+)
+
+// Layout decides the keys requests and samples land at in a bucket
+type Layout struct {
+	name string
+	// replace the <id>_<kind>.json keys of the overwrite layout, nil when there are none
+	templates *KeyTemplates
+}
+
+var (
+	// each write replaces <id>_<kind>.json, only the latest version is kept
+	OverwriteLayout = Layout{name: "overwrite"}
+	// each write lands at a new key, <dir>/dt=YYYY-MM-DD/<id>/<sequence>_<uuid>_<kind>.json,
+	// so every version is kept and Databricks can order versions by the SMILE message sequence
+	VersionedLayout = Layout{name: "versioned"}
+)
+
+// the kinds of object written, used as the key suffix
+const (
+	requestKind  = "request"
+	sampleKind   = "sample"
+	clinicalKind = "clinical"
+	manifestKind = "manifest"
+)
+
+// the top level directory each kind of object is versioned under
+var versionedDirs = map[string]string{
+	requestKind:  "requests",
+	sampleKind:   "samples",
+	clinicalKind: "clinical",
+	manifestKind: "manifests",
+}
+
+// the zero padded width of the sequence in a versioned key, wide enough for any uint64 so
+// that keys sort in sequence order
+const sequenceWidth = 20
+
+func ParseLayout(name string) (Layout, error) {
+	switch name {
+	case OverwriteLayout.name, "":
+		return OverwriteLayout, nil
+	case VersionedLayout.name:
+		return VersionedLayout, nil
+	default:
+		return Layout{}, fmt.Errorf("Failed to parse layout: %q is not one of %q or %q", name, OverwriteLayout, VersionedLayout)
+	}
+}
+
+func (l Layout) String() string {
+	return l.name
+}
+
+func (l Layout) isVersioned() bool {
+	return l.name == VersionedLayout.name
+}
+
+// WithKeyTemplates returns the layout writing requests and samples to the keys rendered by templates.  Only
+// the overwrite layout can be templated, versioned keys are named after the message that carried them.
+func (l Layout) WithKeyTemplates(templates *KeyTemplates) (Layout, error) {
+	if l.isVersioned() {
+		return Layout{}, fmt.Errorf("Failed to apply key templates: the %s layout cannot be templated", l)
+	}
+	l.templates = templates
+	return l, nil
+}
+
+func (l Layout) RequestKey(request SmileRequest, msg *Message) (string, error) {
+	if l.templates != nil && l.templates.request != nil {
+		return l.templates.request.render(request)
+	}
+	return l.objectKey(requestKind, request.IgoRequestID, msg), nil
+}
+
+func (l Layout) IGOSampleKey(sample SmileSample, msg *Message) (string, error) {
+	if l.templates != nil && l.templates.sample != nil {
+		return l.templates.sample.render(sample)
+	}
+	return l.objectKey(sampleKind, sample.PrimaryID, msg), nil
+}
+
+func (l Layout) TEMPOSampleKey(sample *st.TempoSample, msg *Message) (string, error) {
+	if l.templates != nil && l.templates.clinical != nil {
+		return l.templates.clinical.render(sample)
+	}
+	return l.objectKey(clinicalKind, sample.PrimaryId, msg), nil
+}
+
+// ManifestKey returns the key of the manifest of a request, which is updated in place whatever the layout.
+// It is never templated, deletions only name the request and find the keys of its objects in the manifest.
+func (l Layout) ManifestKey(igoRequestID string) string {
+	key := fmt.Sprintf("%s_%s.json", igoRequestID, manifestKind)
+	if !l.isVersioned() {
+		return key
+	}
+	return versionedDirs[manifestKind] + "/" + key
+}
+
+// objectKey returns the key an object of kind with the given id that was carried by msg is written to
+func (l Layout) objectKey(kind, id string, msg *Message) string {
+	if !l.isVersioned() {
+		return fmt.Sprintf("%s_%s.json", id, kind)
+	}
+	published := msg.Timestamp
+	if published.IsZero() {
+		published = time.Now()
+	}
+	// v7 uuids sort by creation time, which orders versions that share a sequence
+	version, err := uuid.NewV7()
+	if err != nil {
+		version = uuid.New()
+	}
+	return fmt.Sprintf("%s/dt=%s/%s/%0*d_%s_%s.json", versionedDirs[kind], published.UTC().Format(time.DateOnly), id, sequenceWidth, msg.Sequence, version, kind)
+}
+
+// KeyTemplates are text/template keys executed over the request, IGO sample or TEMPO sample being written,
+// e.g. igo/{{.IgoProjectID}}/{{.IgoRequestID}}/request.json.  The fields a template uses should not change
+// over the life of an entity, an update that renders a different key leaves the previous object behind.
+type KeyTemplates struct {
+	request  *keyTemplate
+	sample   *keyTemplate
+	clinical *keyTemplate
+}
+
+type keyTemplate struct {
+	kind     string
+	template *template.Template
+}
+
+// ParseKeyTemplates parses and validates the key templates of each kind of object, an empty template keeps
+// the <id>_<kind>.json key.  It returns nil when every template is empty.
+func ParseKeyTemplates(request, sample, clinical string) (*KeyTemplates, error) {
+	if request == "" && sample == "" && clinical == "" {
+		return nil, nil
+	}
+	var templates KeyTemplates
+	var err error
+	if templates.request, err = parseKeyTemplate(requestKind, request, SmileRequest{}); err != nil {
+		return nil, err
+	}
+	if templates.sample, err = parseKeyTemplate(sampleKind, sample, SmileSample{AdditionalProperties: &AdditionalProperties{}}); err != nil {
+		return nil, err
+	}
+	if templates.clinical, err = parseKeyTemplate(clinicalKind, clinical, &st.TempoSample{}); err != nil {
+		return nil, err
+	}
+	return &templates, nil
+}
+
+// parseKeyTemplate parses text, then renders it over an empty entity to check it only uses fields entity
+// has and that its keys end in <kind>.json, the suffix the DLT pipeline picks objects up by
+func parseKeyTemplate(kind, text string, entity any) (*keyTemplate, error) {
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New(kind).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s key template: %q", kind, err)
+	}
+	var key strings.Builder
+	if err := tmpl.Execute(&key, entity); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s key template: %q", kind, err)
+	}
+	if !strings.HasSuffix(key.String(), kind+".json") {
+		return nil, fmt.Errorf("Failed to parse %s key template: %q must end in %s.json", kind, text, kind)
+	}
+	// staging, quarantine and audit records live under the prefixes starting with _
+	if strings.HasPrefix(text, "_") || strings.HasPrefix(text, "/") {
+		return nil, fmt.Errorf("Failed to parse %s key template: %q must not start with _ or /", kind, text)
+	}
+	return &keyTemplate{kind: kind, template: tmpl}, nil
+}
+
+// render executes the template over entity, a key with an empty or relative path segment, or that would land
+// among staging and quarantine, cannot be written and is a permanent error
+func (k *keyTemplate) render(entity any) (string, error) {
+	var key strings.Builder
+	if err := k.template.Execute(&key, entity); err != nil {
+		return "", permanentError(fmt.Errorf("Failed to render %s key: %q", k.kind, err))
+	}
+	segments := strings.Split(key.String(), "/")
+	if slices.Contains(segments, "") || slices.Contains(segments, ".") || slices.Contains(segments, "..") {
+		return "", permanentError(fmt.Errorf("Failed to render %s key: %q has an empty or relative path segment", k.kind, key.String()))
+	}
+	if strings.HasPrefix(key.String(), "_") {
+		return "", permanentError(fmt.Errorf("Failed to render %s key: %q must not start with _", k.kind, key.String()))
+	}
+	return key.String(), nil
+}
@@ -0,0 +1,71 @@
+package smile_databricks_gateway
+
+import (
+	"testing"
+
+	st "github.mskcc.org/cdsi/cdsi-protobuf/smile/generated/v1/go"
+)
+
+func TestParseKeyTemplates(t *testing.T) {
+	tests := []struct {
+		name                      string
+		request, sample, clinical string
+		wantErr                   bool
+	}{
+		{"Partitioned", "igo/{{.IgoProjectID}}/{{.IgoRequestID}}/request.json", "igo/{{.AdditionalProperties.IgoRequestID}}/{{.PrimaryID}}/sample.json", "tempo/{{.PrimaryId}}/clinical.json", false},
+		{"OnlySamples", "", "{{.PrimaryID}}_sample.json", "", false},
+		{"Unparsable", "{{.IgoRequestID", "", "", true},
+		{"UnknownField", "{{.ProjectID}}/request.json", "", "", true},
+		{"WrongSuffix", "igo/{{.IgoRequestID}}.json", "", "", true},
+		{"OtherKindSuffix", "", "igo/{{.PrimaryID}}/request.json", "", true},
+		{"StagingPrefix", "_staging/{{.IgoRequestID}}/request.json", "", "", true},
+		{"AbsoluteKey", "/{{.IgoRequestID}}/request.json", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKeyTemplates(tt.request, tt.sample, tt.clinical)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v want error %t", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("NoTemplates", func(t *testing.T) {
+		templates, err := ParseKeyTemplates("", "", "")
+		if err != nil || templates != nil {
+			t.Errorf("got %v, %v want no templates", templates, err)
+		}
+	})
+}
+
+func TestLayoutKeyTemplates(t *testing.T) {
+	templates, err := ParseKeyTemplates("igo/{{.IgoProjectID}}/{{.IgoRequestID}}/request.json", "", "tempo/{{.PrimaryId}}/clinical.json")
+	if err != nil {
+		t.Fatalf("cannot ParseKeyTemplates: %q", err)
+	}
+	layout, err := OverwriteLayout.WithKeyTemplates(templates)
+	if err != nil {
+		t.Fatalf("cannot apply key templates: %q", err)
+	}
+	request := testRequest(t)
+	if key, err := layout.RequestKey(request, &Message{}); err != nil || key != "igo/22022/IGO_TEST_REQUEST/request.json" {
+		t.Errorf("got request key %q, %v", key, err)
+	}
+	// kinds without a template keep their key
+	if key, err := layout.IGOSampleKey(request.Samples[0], &Message{}); err != nil || key != "22022_CC_3_sample.json" {
+		t.Errorf("got sample key %q, %v", key, err)
+	}
+	if key, err := layout.TEMPOSampleKey(&st.TempoSample{PrimaryId: "12345_A_1"}, &Message{}); err != nil || key != "tempo/12345_A_1/clinical.json" {
+		t.Errorf("got clinical key %q, %v", key, err)
+	}
+
+	// a key missing a path segment is never written
+	request.IgoProjectID = ""
+	if key, err := layout.RequestKey(request, &Message{}); err == nil || ClassifyError(err) != PermanentError {
+		t.Errorf("got key %q, %v want a permanent error", key, err)
+	}
+
+	if _, err := VersionedLayout.WithKeyTemplates(templates); err == nil {
+		t.Errorf("expected the versioned layout to reject key templates")
+	}
+}
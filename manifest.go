@@ -0,0 +1,109 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// RequestManifest lists the objects written for an IGO request, so that Databricks can tell whether every
+// sample of a request has landed.  It is kept up to date as the request and its samples are updated.
+type RequestManifest struct {
+	IgoRequestID string           `json:"igoRequestId"`
+	Request      ManifestObject   `json:"request"`
+	Samples      []ManifestSample `json:"samples"`
+	// the SMILE message sequence of the newest message that changed the manifest
+	MessageSequence uint64    `json:"messageSequence"`
+	WrittenAt       time.Time `json:"writtenAt"`
+	// the request was withdrawn, the DLT pipeline applies the manifest as a delete
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// ManifestObject is the key an object was written to along with its content hash
+type ManifestObject struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash"`
+}
+
+type ManifestSample struct {
+	PrimaryID string `json:"primaryId"`
+	ManifestObject
+}
+
+// setRequest records the object written for the request, a request that is written again is no longer withdrawn
+func (m *RequestManifest) setRequest(result PutResult) {
+	m.Deleted = false
+	m.Request = ManifestObject{Key: result.Key, Hash: result.Hash}
+}
+
+// setSample records the object written for a sample, replacing any earlier one
+func (m *RequestManifest) setSample(primaryID string, result PutResult) {
+	sample := ManifestSample{PrimaryID: primaryID, ManifestObject: ManifestObject{Key: result.Key, Hash: result.Hash}}
+	i := slices.IndexFunc(m.Samples, func(s ManifestSample) bool { return s.PrimaryID == primaryID })
+	if i < 0 {
+		m.Samples = append(m.Samples, sample)
+		return
+	}
+	m.Samples[i] = sample
+}
+
+// nextManifest applies update to the stored manifest of igoRequestID, or to an empty one if there is none yet.
+// It reports whether update changed anything, an unchanged manifest does not need to be written again.
+func nextManifest(ctx context.Context, store ObjectStore, bucketKey, bucketName, igoRequestID string, msg *Message, update func(*RequestManifest)) (RequestManifest, bool, error) {
+	current, err := get[RequestManifest](ctx, store, bucketKey, bucketName)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return current, false, err
+	}
+	if err != nil {
+		current = RequestManifest{IgoRequestID: igoRequestID, Samples: []ManifestSample{}}
+	}
+	next := current
+	next.Samples = slices.Clone(current.Samples)
+	update(&next)
+	if reflect.DeepEqual(next, current) {
+		return current, false, nil
+	}
+	// a message redelivered after a newer one has written the manifest must not make it look older, staged
+	// commits are promoted and backfills skipped by comparing with it
+	next.MessageSequence = max(current.MessageSequence, msg.Sequence)
+	next.WrittenAt = time.Now().UTC()
+	return next, true, nil
+}
+
+// UpdateManifest applies update to the manifest of igoRequestID and writes it back if it changed
+func UpdateManifest(ctx context.Context, store ObjectStore, bucketKey, bucketName, igoRequestID string, msg *Message, update func(*RequestManifest)) (PutResult, error) {
+	manifest, changed, err := nextManifest(ctx, store, bucketKey, bucketName, igoRequestID, msg, update)
+	if err != nil {
+		return PutResult{Key: bucketKey}, fmt.Errorf("Failed to UpdateManifest: '%s': %w", igoRequestID, err)
+	}
+	if !changed {
+		return PutResult{Key: bucketKey, Skipped: true}, nil
+	}
+	result, err := put[RequestManifest](ctx, store, bucketKey, bucketName, manifest)
+	if err != nil {
+		return result, fmt.Errorf("Failed to UpdateManifest: '%s': %w", igoRequestID, err)
+	}
+	return result, nil
+}
+
+// StageManifest applies update to the manifest of igoRequestID and stages it in commit if it changed.  It
+// should be staged last, so that it is promoted after the objects it lists.
+func StageManifest(ctx context.Context, commit *StagedCommit, bucketKey, igoRequestID string, msg *Message, update func(*RequestManifest)) (PutResult, error) {
+	// the commit is compared with the manifest when it is promoted, whether or not the manifest changes
+	commit.manifestKey = bucketKey
+	manifest, changed, err := nextManifest(ctx, commit.store, bucketKey, commit.bucketName, igoRequestID, msg, update)
+	if err != nil {
+		return PutResult{Key: bucketKey}, fmt.Errorf("Failed to StageManifest: '%s': %w", igoRequestID, err)
+	}
+	if !changed {
+		return PutResult{Key: bucketKey, Skipped: true}, nil
+	}
+	result, err := stage[RequestManifest](ctx, commit, bucketKey, manifest)
+	if err != nil {
+		return result, fmt.Errorf("Failed to StageManifest: '%s': %w", igoRequestID, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,48 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"testing"
+)
+
+func TestUpdateManifest(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryObjectStore()
+	const key = "IGO_TEST_REQUEST_manifest.json"
+	sample := PutResult{Key: "22022_CC_3_sample.json", Hash: "abc"}
+	update := func(m *RequestManifest) { m.setSample("22022_CC_3", sample) }
+
+	result, err := UpdateManifest(ctx, store, key, "igo", "IGO_TEST_REQUEST", &Message{Sequence: 1}, update)
+	if err != nil || result.Skipped {
+		t.Fatalf("got %+v, %v want the manifest written", result, err)
+	}
+	// a redelivery changes nothing, so the manifest is not rewritten with a new timestamp
+	result, err = UpdateManifest(ctx, store, key, "igo", "IGO_TEST_REQUEST", &Message{Sequence: 1}, update)
+	if err != nil || !result.Skipped {
+		t.Fatalf("got %+v, %v want the unchanged manifest skipped", result, err)
+	}
+
+	sample.Hash = "def"
+	if _, err := UpdateManifest(ctx, store, key, "igo", "IGO_TEST_REQUEST", &Message{Sequence: 2}, update); err != nil {
+		t.Fatalf("cannot UpdateManifest: %q", err)
+	}
+	manifest, err := get[RequestManifest](ctx, store, key, "igo")
+	if err != nil {
+		t.Fatalf("cannot get manifest: %q", err)
+	}
+	if len(manifest.Samples) != 1 || manifest.Samples[0].Hash != "def" || manifest.MessageSequence != 2 {
+		t.Errorf("got manifest %+v want the one sample replaced at sequence 2", manifest)
+	}
+
+	// an older message redelivered after a newer one does not take the sequence back
+	sample.Hash = "ghi"
+	if _, err := UpdateManifest(ctx, store, key, "igo", "IGO_TEST_REQUEST", &Message{Sequence: 1}, update); err != nil {
+		t.Fatalf("cannot UpdateManifest: %q", err)
+	}
+	if manifest, err = get[RequestManifest](ctx, store, key, "igo"); err != nil {
+		t.Fatalf("cannot get manifest: %q", err)
+	}
+	if manifest.MessageSequence != 2 {
+		t.Errorf("got manifest sequence %d want 2", manifest.MessageSequence)
+	}
+}
@@ -0,0 +1,83 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryObjectStore is an ObjectStore that keeps objects in memory.  It is intended
+// for tests and local replays where nothing should be persisted.
+type MemoryObjectStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string]memoryObject
+}
+
+type memoryObject struct {
+	content      []byte
+	metadata     map[string]string
+	lastModified time.Time
+}
+
+var _ ObjectStore = (*MemoryObjectStore)(nil)
+
+func NewMemoryObjectStore() *MemoryObjectStore {
+	return &MemoryObjectStore{buckets: make(map[string]map[string]memoryObject)}
+}
+
+func (m *MemoryObjectStore) PutObject(ctx context.Context, bucketKey, bucketName string, content []byte, metadata map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bucket, ok := m.buckets[bucketName]
+	if !ok {
+		bucket = make(map[string]memoryObject)
+		m.buckets[bucketName] = bucket
+	}
+	// copy so callers cannot mutate stored objects
+	bucket[bucketKey] = memoryObject{content: append([]byte(nil), content...), metadata: maps.Clone(metadata), lastModified: time.Now()}
+	return nil
+}
+
+func (m *MemoryObjectStore) GetObject(ctx context.Context, bucketKey, bucketName string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.buckets[bucketName][bucketKey]
+	if !ok {
+		return nil, fmt.Errorf("Failed to get object %s:%s: %w", bucketName, bucketKey, ErrObjectNotFound)
+	}
+	return append([]byte(nil), object.content...), nil
+}
+
+func (m *MemoryObjectStore) DeleteObject(ctx context.Context, bucketKey, bucketName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.buckets[bucketName], bucketKey)
+	return nil
+}
+
+func (m *MemoryObjectStore) ListObjects(ctx context.Context, prefix, bucketName string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var keys []string
+	for key := range m.buckets[bucketName] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *MemoryObjectStore) HeadObject(ctx context.Context, bucketKey, bucketName string) (ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.buckets[bucketName][bucketKey]
+	if !ok {
+		return ObjectInfo{Key: bucketKey}, fmt.Errorf("Failed to head object %s:%s: %w", bucketName, bucketKey, ErrObjectNotFound)
+	}
+	return ObjectInfo{Key: bucketKey, Size: int64(len(object.content)), LastModified: object.lastModified, Metadata: maps.Clone(object.metadata)}, nil
+}
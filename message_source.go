@@ -0,0 +1,61 @@
+package smile_databricks_gateway
+
+import "time"
+
+// Message is a single message delivered by a MessageSource.  It carries the
+// subject and payload along with the handle used to settle it with the source.
+type Message struct {
+	Subject string
+	Data    []byte
+	Header  map[string][]string
+	// the number of times this message has been delivered, including this delivery
+	NumDelivered uint64
+	// the position of the message in the stream it was published to and when it was published,
+	// zero when the source does not provide them
+	Sequence  uint64
+	Timestamp time.Time
+	acker     Acknowledger
+}
+
+// Acknowledger settles a delivered message with the source that delivered it.
+type Acknowledger interface {
+	Ack() error
+	Nak() error
+	NakWithDelay(delay time.Duration) error
+	Term() error
+}
+
+type MessageHandler func(msg *Message)
+
+// MessageSource delivers messages published on subjects matching a filter to a handler.
+// NATSMessageSource is the production implementation, ChannelMessageSource is an
+// in-process implementation for tests and local replays.
+type MessageSource interface {
+	Subscribe(consumer, subjectFilter string, handler MessageHandler) error
+	PublishMessage(subject string, data []byte, header map[string][]string) error
+	Shutdown()
+}
+
+func NewMessage(subject string, data []byte, acker Acknowledger) *Message {
+	return &Message{Subject: subject, Data: data, NumDelivered: 1, acker: acker}
+}
+
+// Ack tells the source the message has been fully processed
+func (m *Message) Ack() error {
+	return m.acker.Ack()
+}
+
+// Nak tells the source the message was not processed and should be redelivered
+func (m *Message) Nak() error {
+	return m.acker.Nak()
+}
+
+// NakWithDelay asks the source to redeliver the message once delay has elapsed
+func (m *Message) NakWithDelay(delay time.Duration) error {
+	return m.acker.NakWithDelay(delay)
+}
+
+// Term tells the source the message can never be processed and must not be redelivered
+func (m *Message) Term() error {
+	return m.acker.Term()
+}
@@ -0,0 +1,130 @@
+package smile_databricks_gateway
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "smile_databricks_gateway"
+
+// the flows messages are processed in, used to label metrics
+const (
+	newIGORequestFlow       = "igo_new_request"
+	updateIGORequestFlow    = "igo_update_request"
+	updateIGOSampleFlow     = "igo_update_sample"
+	deleteIGOFlow           = "igo_delete"
+	releaseTEMPOSamplesFlow = "tempo_release_samples"
+	updateTEMPOSamplesFlow  = "tempo_update_samples"
+	backfillFlow            = "igo_backfill"
+)
+
+var (
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_depth",
+		Help:      "Messages handed off by the subscriber and waiting for a worker, by flow.",
+	}, []string{"flow"})
+	subscriberBlocked = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "subscriber_blocked",
+		Help:      "1 while the subscriber is blocked handing a message off to a flow whose queue is full.",
+	}, []string{"flow"})
+	subscriberBlockedSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "subscriber_blocked_seconds_total",
+		Help:      "Time the subscriber spent blocked handing messages off to a flow whose queue is full.",
+	}, []string{"flow"})
+
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_received_total",
+		Help:      "Messages delivered by the message source, by subject.",
+	}, []string{"subject"})
+	messagesDecoded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_decoded_total",
+		Help:      "Messages successfully decoded, by subject.",
+	}, []string{"subject"})
+	messagesWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_written_total",
+		Help:      "Messages whose requests and samples were all written to the object store, by subject.",
+	}, []string{"subject"})
+	messagesAcked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_acked_total",
+		Help:      "Messages acked, by subject.",
+	}, []string{"subject"})
+	messagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_failed_total",
+		Help:      "Deliveries that failed, by subject and error class (transient failures are redelivered).",
+	}, []string{"subject", "class"})
+
+	slackNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "slack_notifications_total",
+		Help:      "Slack notifications, by outcome (sent or failed).",
+	}, []string{"outcome"})
+
+	s3RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_request_duration_seconds",
+		Help:      "Latency of S3 requests, by operation and outcome (success, not_found or error).",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"operation", "outcome"})
+	credentialRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "credential_refreshes_total",
+		Help:      "Refreshes of the AWS credentials used for S3, by outcome (success or error).",
+	}, []string{"outcome"})
+	objectStoreRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "object_store_retries_total",
+		Help:      "Object store operations retried after a transient failure, by operation.",
+	}, []string{"operation"})
+	stagedCommitsCleanedUp = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "staged_commits_cleaned_up_total",
+		Help:      "Abandoned staged commits, by action (finished when their commit record was written, removed otherwise).",
+	}, []string{"action"})
+	embargoDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tempo_embargo_decisions_total",
+		Help:      "TEMPO samples checked for embargo, by action (released, withheld or redacted).",
+	}, []string{"action"})
+)
+
+// outcome labels
+const (
+	successOutcome  = "success"
+	errorOutcome    = "error"
+	notFoundOutcome = "not_found"
+	sentOutcome     = "sent"
+	failedOutcome   = "failed"
+)
+
+// staged commit cleanup action labels
+const (
+	finishedAction = "finished"
+	removedAction  = "removed"
+)
+
+func outcomeOf(err error) string {
+	switch {
+	case err == nil:
+		return successOutcome
+	case errors.Is(err, ErrObjectNotFound):
+		return notFoundOutcome
+	default:
+		return errorOutcome
+	}
+}
+
+// observeS3Request records the latency of an S3 operation started at start that returned err
+func observeS3Request(operation string, start time.Time, err error) {
+	s3RequestDuration.WithLabelValues(operation, outcomeOf(err)).Observe(time.Since(start).Seconds())
+}
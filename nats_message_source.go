@@ -0,0 +1,155 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	nm "github.com/mskcc/nats-messaging-go"
+	"github.com/nats-io/nats.go"
+)
+
+// NATSMessageSource is a MessageSource backed by a JetStream durable consumer
+type NATSMessageSource struct {
+	// guards natsMessaging, which cannot be used once shut down
+	mu            sync.RWMutex
+	natsMessaging *nm.Messaging
+}
+
+var _ ReplayableMessageSource = (*NATSMessageSource)(nil)
+
+func NewNATSMessageSource(url, certPath, keyPath, consumer, password string) (*NATSMessageSource, error) {
+	natsMessaging, err := nm.NewSecureMessaging(url, certPath, keyPath, consumer, password)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a nats messaging client: %q", err)
+	}
+	return &NATSMessageSource{natsMessaging: natsMessaging}, nil
+}
+
+var errNATSShutdown = errors.New("message source is shut down")
+
+func (n *NATSMessageSource) Subscribe(consumer, subjectFilter string, handler MessageHandler) error {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.natsMessaging == nil {
+		return fmt.Errorf("Failed to subscribe %q: %w", subjectFilter, errNATSShutdown)
+	}
+	return n.natsMessaging.Subscribe(consumer, subjectFilter, func(m *nm.Msg) {
+		handler(natsMessage(m.ProviderMsg, natsAcker{m.ProviderMsg}))
+	})
+}
+
+// SubscribeFrom consumes the stream again from start with an ephemeral consumer
+func (n *NATSMessageSource) SubscribeFrom(subjectFilter string, start ReplayStart, handler func(msg *Message, pending uint64)) (bool, error) {
+	opts := []nats.SubOpt{nats.ManualAck(), nats.AckExplicit()}
+	if start.Sequence > 0 {
+		opts = append(opts, nats.StartSequence(start.Sequence))
+	} else {
+		opts = append(opts, nats.StartTime(start.Time))
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.natsMessaging == nil {
+		return false, fmt.Errorf("Failed to replay %q: %w", subjectFilter, errNATSShutdown)
+	}
+	sub, err := n.natsMessaging.Js.Subscribe(subjectFilter, func(m *nats.Msg) {
+		// without metadata the replay cannot tell whether it has caught up
+		pending := uint64(1)
+		if md, err := m.Metadata(); err == nil {
+			pending = md.NumPending
+		}
+		handler(natsMessage(m, natsAcker{m}), pending)
+	}, opts...)
+	if err != nil {
+		return false, fmt.Errorf("Failed to replay %q: %q", subjectFilter, err)
+	}
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return false, fmt.Errorf("Failed to get replay consumer info: %q", err)
+	}
+	return info.NumPending == 0 && info.Delivered.Consumer == 0, nil
+}
+
+func natsMessage(m *nats.Msg, acker Acknowledger) *Message {
+	msg := NewMessage(m.Subject, m.Data, acker)
+	msg.Header = m.Header
+	if md, err := m.Metadata(); err == nil {
+		msg.NumDelivered = md.NumDelivered
+		msg.Sequence = md.Sequence.Stream
+		msg.Timestamp = md.Timestamp
+	}
+	return msg
+}
+
+func (n *NATSMessageSource) PublishMessage(subject string, data []byte, header map[string][]string) error {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	for key, values := range header {
+		for _, value := range values {
+			msg.Header.Add(key, value)
+		}
+	}
+	// used when subscriber wants to filter/act on specific subject (see nats-messaging-go)
+	msg.Header.Set("Nats-Msg-Subject", subject)
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.natsMessaging == nil {
+		return fmt.Errorf("Failed to publish message on %q: %w", subject, errNATSShutdown)
+	}
+	if _, err := n.natsMessaging.Js.PublishMsg(msg); err != nil {
+		return fmt.Errorf("Failed to publish message on %q: %q", subject, err)
+	}
+	return nil
+}
+
+func (n *NATSMessageSource) Shutdown() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.natsMessaging != nil {
+		n.natsMessaging.Shutdown()
+		n.natsMessaging = nil
+	}
+}
+
+// ConnectionHealthCheck checks the connection to the NATS server with a JetStream account info round trip
+func (n *NATSMessageSource) ConnectionHealthCheck() HealthCheck {
+	return HealthCheck{
+		Name:     "nats",
+		Liveness: true,
+		Check: func(ctx context.Context) (string, error) {
+			n.mu.RLock()
+			defer n.mu.RUnlock()
+			if n.natsMessaging == nil {
+				return "", fmt.Errorf("Failed to check nats connection: %w", errNATSShutdown)
+			}
+			info, err := n.natsMessaging.Js.AccountInfo(nats.Context(ctx))
+			if err != nil {
+				return "", fmt.Errorf("Failed to get jetstream account info: %q", err)
+			}
+			return fmt.Sprintf("connected, %d streams and %d consumers", info.Streams, info.Consumers), nil
+		},
+	}
+}
+
+// natsAcker adapts the variadic nats.Msg ack routines to Acknowledger
+type natsAcker struct {
+	msg *nats.Msg
+}
+
+func (a natsAcker) Ack() error {
+	return a.msg.Ack()
+}
+
+func (a natsAcker) Nak() error {
+	return a.msg.Nak()
+}
+
+func (a natsAcker) NakWithDelay(delay time.Duration) error {
+	return a.msg.NakWithDelay(delay)
+}
+
+func (a natsAcker) Term() error {
+	return a.msg.Term()
+}
@@ -2,12 +2,17 @@ package smile_databricks_gateway
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 )
 
+// NotifyViaSlack posts body to slackURL, nothing is posted when slackURL is empty
 func NotifyViaSlack(ctx context.Context, body, slackURL string) error {
+	if slackURL == "" {
+		return nil
+	}
 
 	slackCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
@@ -19,8 +24,15 @@ func NotifyViaSlack(ctx context.Context, body, slackURL string) error {
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := http.DefaultClient.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	if err != nil {
+		slackNotifications.WithLabelValues(failedOutcome).Inc()
 		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slackNotifications.WithLabelValues(failedOutcome).Inc()
+		return fmt.Errorf("Failed to notify slack: %s", resp.Status)
+	}
+	slackNotifications.WithLabelValues(sentOutcome).Inc()
 	return nil
 }
@@ -0,0 +1,204 @@
+package smile_databricks_gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	st "github.mskcc.org/cdsi/cdsi-protobuf/smile/generated/v1/go"
+)
+
+// ObjectStore is the set of object operations the gateway needs from a storage backend.
+// AWSS3Service is the production implementation, FileObjectStore and MemoryObjectStore
+// allow the gateway to run against a local directory or entirely in memory.
+type ObjectStore interface {
+	PutObject(ctx context.Context, bucketKey, bucketName string, content []byte, metadata map[string]string) error
+	GetObject(ctx context.Context, bucketKey, bucketName string) ([]byte, error)
+	DeleteObject(ctx context.Context, bucketKey, bucketName string) error
+	ListObjects(ctx context.Context, prefix, bucketName string) ([]string, error)
+	HeadObject(ctx context.Context, bucketKey, bucketName string) (ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+// PutResult describes the outcome of a typed put (PutRequest, PutIGOSample, PutTEMPOSample)
+type PutResult struct {
+	Key  string
+	Hash string
+	// the object already held identical content so nothing was written
+	Skipped bool
+}
+
+// object metadata key holding the sha256 of the canonical JSON of an object.  S3 lower cases
+// user metadata keys, so keys must be lower case to compare equal after a round trip.
+const ContentHashMetadataKey = "content-sha256"
+
+// returned (wrapped) by GetObject and HeadObject when the key does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrorClass tells a caller whether retrying a failed storage operation can succeed
+type ErrorClass int
+
+const (
+	// the failure may clear up on its own (throttling, 5xx, network, credentials), retry later
+	TransientError ErrorClass = iota
+	// the failure will recur on every attempt (unmarshalable data, invalid bucket or key), do not retry
+	PermanentError
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case PermanentError:
+		return "permanent"
+	default:
+		return "transient"
+	}
+}
+
+// StoreError is returned (wrapped) by storage operations that know how their failure should be classified
+type StoreError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *StoreError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+func permanentError(err error) error {
+	return &StoreError{Class: PermanentError, Err: err}
+}
+
+// ClassifyError returns the class of a storage error, errors that have not been classified are
+// assumed to be transient so that a message is never dropped for a failure that might go away
+func ClassifyError(err error) ErrorClass {
+	var se *StoreError
+	if errors.As(err, &se) {
+		return se.Class
+	}
+	return TransientError
+}
+
+func PutRequest(ctx context.Context, store ObjectStore, bucketKey, bucketName string, sr SmileRequest) (PutResult, error) {
+	result, err := put[SmileRequest](ctx, store, bucketKey, bucketName, sr)
+	if err != nil {
+		return result, fmt.Errorf("Failed to PutRequest: '%s': %w", sr.IgoRequestID, err)
+	}
+	return result, nil
+}
+
+func PutIGOSample(ctx context.Context, store ObjectStore, bucketKey, bucketName string, ss SmileSample) (PutResult, error) {
+	result, err := put[SmileSample](ctx, store, bucketKey, bucketName, ss)
+	if err != nil {
+		return result, fmt.Errorf("Failed to PutSample: '%s': %w", ss.SampleName, err)
+	}
+	return result, nil
+}
+
+func PutTEMPOSample(ctx context.Context, store ObjectStore, bucketKey, bucketName string, ts *st.TempoSample) (PutResult, error) {
+	result, err := put[*st.TempoSample](ctx, store, bucketKey, bucketName, ts)
+	if err != nil {
+		return result, fmt.Errorf("Failed to PutSample: '%s': %w", ts.PrimaryId, err)
+	}
+	return result, nil
+}
+
+// put writes t as JSON unless the object at bucketKey already holds the same content.  Rewriting
+// identical content would needlessly re-trigger Databricks Auto Loader on the landing bucket.
+func put[T any](ctx context.Context, store ObjectStore, bucketKey, bucketName string, t T) (PutResult, error) {
+	result := PutResult{Key: bucketKey}
+	rJson, hash, err := encode(t)
+	if err != nil {
+		return result, err
+	}
+	result.Hash = hash
+	if isUnchanged(ctx, store, bucketKey, bucketName, hash) {
+		result.Skipped = true
+		return result, nil
+	}
+
+	err = store.PutObject(ctx, bucketKey, bucketName, rJson, map[string]string{ContentHashMetadataKey: result.Hash})
+	if err != nil {
+		return result, fmt.Errorf("Failed to putObject: %w", err)
+	}
+	return result, nil
+}
+
+// encode returns t as JSON along with its content hash
+func encode[T any](t T) ([]byte, string, error) {
+	rJson, err := json.Marshal(t)
+	if err != nil {
+		return nil, "", permanentError(fmt.Errorf("Failed to marshal: %q", err))
+	}
+	hash, err := contentHash(rJson)
+	if err != nil {
+		return nil, "", permanentError(fmt.Errorf("Failed to hash: %q", err))
+	}
+	return rJson, hash, nil
+}
+
+// isUnchanged reports whether the object at bucketKey already holds content with the given hash.  A failed
+// head is not fatal, we just cannot tell whether the write is redundant.
+func isUnchanged(ctx context.Context, store ObjectStore, bucketKey, bucketName, hash string) bool {
+	info, err := store.HeadObject(ctx, bucketKey, bucketName)
+	return err == nil && info.Metadata[ContentHashMetadataKey] == hash
+}
+
+// contentHash returns the hex sha256 of the canonical form of a JSON document: object keys sorted,
+// insignificant whitespace removed and numbers preserved as written
+func contentHash(jsonData []byte) (string, error) {
+	canonical, err := canonicalJSON(jsonData)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func canonicalJSON(jsonData []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	// encoding/json writes map keys in sorted order
+	return json.Marshal(v)
+}
+
+func GetRequestObject(ctx context.Context, store ObjectStore, bucketKey, bucketName string) (SmileRequest, error) {
+	return get[SmileRequest](ctx, store, bucketKey, bucketName)
+}
+
+func GetSampleObject(ctx context.Context, store ObjectStore, bucketKey, bucketName string) (SmileSample, error) {
+	return get[SmileSample](ctx, store, bucketKey, bucketName)
+}
+
+func get[T any](ctx context.Context, store ObjectStore, bucketKey, bucketName string) (T, error) {
+	var t T
+	data, err := store.GetObject(ctx, bucketKey, bucketName)
+	if err != nil {
+		return t, fmt.Errorf("Failed to read object %s:%s: %w", bucketName, bucketKey, err)
+	}
+
+	t, err = UnmarshalT[T](data)
+	if err != nil {
+		return t, permanentError(fmt.Errorf("Failed to unmarshal object %s:%s: %v", bucketName, bucketKey, err))
+	}
+
+	return t, nil
+}
@@ -0,0 +1,217 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestObjectStores(t *testing.T) {
+	fileStore, err := NewFileObjectStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("cannot create file object store: %q", err)
+	}
+	stores := map[string]ObjectStore{
+		"Memory": NewMemoryObjectStore(),
+		"File":   fileStore,
+	}
+	const bucket = "igo-test-bucket"
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			putRequest, err := UnmarshalT[SmileRequest]([]byte(RequestJSON))
+			if err != nil {
+				t.Fatalf("cannot unmarshal request: %q", err)
+			}
+			putSample := putRequest.Samples[0]
+
+			requestKey := fmt.Sprintf("%s_request.json", putRequest.IgoRequestID)
+			if _, err := PutRequest(context.Background(), store, requestKey, bucket, putRequest); err != nil {
+				t.Fatalf("cannot PutRequest: %q", err)
+			}
+			gotRequest, err := GetRequestObject(context.Background(), store, requestKey, bucket)
+			if err != nil {
+				t.Fatalf("cannot GetRequest: %q", err)
+			}
+			if !reflect.DeepEqual(gotRequest, putRequest) {
+				t.Errorf("got %v want %v", gotRequest, putRequest)
+			}
+
+			sampleKey := fmt.Sprintf("samples/%s_sample.json", putSample.PrimaryID)
+			if _, err := PutIGOSample(context.Background(), store, sampleKey, bucket, putSample); err != nil {
+				t.Fatalf("cannot PutSample: %q", err)
+			}
+			gotSample, err := GetSampleObject(context.Background(), store, sampleKey, bucket)
+			if err != nil {
+				t.Fatalf("cannot GetSample: %q", err)
+			}
+			if !reflect.DeepEqual(gotSample, putSample) {
+				t.Errorf("got %v want %v", gotSample, putSample)
+			}
+
+			keys, err := store.ListObjects(context.Background(), "samples/", bucket)
+			if err != nil {
+				t.Fatalf("cannot ListObjects: %q", err)
+			}
+			if !reflect.DeepEqual(keys, []string{sampleKey}) {
+				t.Errorf("got keys %v want %v", keys, []string{sampleKey})
+			}
+
+			info, err := store.HeadObject(context.Background(), requestKey, bucket)
+			if err != nil {
+				t.Fatalf("cannot HeadObject: %q", err)
+			}
+			if info.Key != requestKey || info.Size == 0 {
+				t.Errorf("unexpected object info: %+v", info)
+			}
+
+			for _, key := range []string{requestKey, sampleKey} {
+				if err := store.DeleteObject(context.Background(), key, bucket); err != nil {
+					t.Fatalf("cannot DeleteObject: %q", err)
+				}
+			}
+			if _, err := store.GetObject(context.Background(), requestKey, bucket); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("got %v want ErrObjectNotFound", err)
+			}
+			if _, err := store.HeadObject(context.Background(), sampleKey, bucket); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("got %v want ErrObjectNotFound", err)
+			}
+		})
+	}
+
+	t.Run("FileRejectsEscapingKeys", func(t *testing.T) {
+		if err := fileStore.PutObject(context.Background(), "../escape.json", bucket, []byte("{}"), nil); err == nil {
+			t.Errorf("expected error writing key outside of bucket")
+		}
+	})
+}
+
+func TestPutSkipsUnchangedObjects(t *testing.T) {
+	store := NewMemoryObjectStore()
+	const bucket = "igo-test-bucket"
+	request, err := UnmarshalT[SmileRequest]([]byte(RequestJSON))
+	if err != nil {
+		t.Fatalf("cannot unmarshal request: %q", err)
+	}
+	requestKey := fmt.Sprintf("%s_request.json", request.IgoRequestID)
+
+	first, err := PutRequest(context.Background(), store, requestKey, bucket, request)
+	if err != nil {
+		t.Fatalf("cannot PutRequest: %q", err)
+	}
+	if first.Skipped {
+		t.Errorf("first write of %s was skipped", requestKey)
+	}
+	info, err := store.HeadObject(context.Background(), requestKey, bucket)
+	if err != nil {
+		t.Fatalf("cannot HeadObject: %q", err)
+	}
+	if info.Metadata[ContentHashMetadataKey] != first.Hash {
+		t.Errorf("got stored hash %q want %q", info.Metadata[ContentHashMetadataKey], first.Hash)
+	}
+
+	second, err := PutRequest(context.Background(), store, requestKey, bucket, request)
+	if err != nil {
+		t.Fatalf("cannot PutRequest: %q", err)
+	}
+	if !second.Skipped || second.Hash != first.Hash {
+		t.Errorf("identical write was not skipped: %+v", second)
+	}
+
+	request.ProjectManagerName = request.ProjectManagerName + " (updated)"
+	third, err := PutRequest(context.Background(), store, requestKey, bucket, request)
+	if err != nil {
+		t.Fatalf("cannot PutRequest: %q", err)
+	}
+	if third.Skipped || third.Hash == first.Hash {
+		t.Errorf("changed write was skipped: %+v", third)
+	}
+}
+
+func TestFailedPutIsRetried(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewFileObjectStore(root)
+	if err != nil {
+		t.Fatalf("cannot create file object store: %q", err)
+	}
+	const bucket = "igo-test-bucket"
+	request, err := UnmarshalT[SmileRequest]([]byte(RequestJSON))
+	if err != nil {
+		t.Fatalf("cannot unmarshal request: %q", err)
+	}
+	requestKey := fmt.Sprintf("%s_request.json", request.IgoRequestID)
+	if _, err := PutRequest(context.Background(), store, requestKey, bucket, request); err != nil {
+		t.Fatalf("cannot PutRequest: %q", err)
+	}
+
+	// a directory in place of the object fails the content write but not the metadata write
+	path := filepath.Join(root, bucket, requestKey)
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("cannot remove object: %q", err)
+	}
+	if err := os.Mkdir(path, 0o755); err != nil {
+		t.Fatalf("cannot create directory: %q", err)
+	}
+	request.ProjectManagerName = request.ProjectManagerName + " (updated)"
+	if _, err := PutRequest(context.Background(), store, requestKey, bucket, request); err == nil {
+		t.Fatalf("expected error writing over a directory")
+	}
+	retry, err := PutRequest(context.Background(), store, requestKey, bucket, request)
+	if err == nil || retry.Skipped {
+		t.Fatalf("retry of a failed write was skipped: %+v", retry)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("cannot remove directory: %q", err)
+	}
+	retry, err = PutRequest(context.Background(), store, requestKey, bucket, request)
+	if err != nil || retry.Skipped {
+		t.Fatalf("retry of a failed write was not written: %+v (%v)", retry, err)
+	}
+	stored, err := GetRequestObject(context.Background(), store, requestKey, bucket)
+	if err != nil {
+		t.Fatalf("cannot GetRequest: %q", err)
+	}
+	if stored.ProjectManagerName != request.ProjectManagerName {
+		t.Errorf("got project manager %q want %q", stored.ProjectManagerName, request.ProjectManagerName)
+	}
+}
+
+func TestContentHashIgnoresKeyOrder(t *testing.T) {
+	a, err := contentHash([]byte(`{"b":1,"a":{"d":2.50,"c":"x"}}`))
+	if err != nil {
+		t.Fatalf("cannot hash: %q", err)
+	}
+	b, err := contentHash([]byte(`{ "a": {"c":"x", "d":2.50}, "b": 1 }`))
+	if err != nil {
+		t.Fatalf("cannot hash: %q", err)
+	}
+	if a != b {
+		t.Errorf("got different hashes %s and %s for equivalent JSON", a, b)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	_, marshalErr := put[func()](context.Background(), NewMemoryObjectStore(), "key", "bucket", func() {})
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"Unclassified", errors.New("connection reset"), TransientError},
+		{"Permanent", permanentError(errors.New("NoSuchBucket")), PermanentError},
+		{"WrappedPermanent", fmt.Errorf("Failed to PutRequest: %w", permanentError(errors.New("NoSuchBucket"))), PermanentError},
+		{"Marshal", marshalErr, PermanentError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// headers attached to a dead-lettered message describing why it could not be processed
+const (
+	DeadLetterSubjectHeader      = "Smile-Gateway-Original-Subject"
+	DeadLetterErrorHeader        = "Smile-Gateway-Error"
+	DeadLetterNumDeliveredHeader = "Smile-Gateway-Num-Delivered"
+)
+
+// QuarantinedMessage is the record written to the quarantine prefix of a bucket for a
+// message the gateway could not decode.  It holds everything needed to re-drive the message.
+type QuarantinedMessage struct {
+	Subject       string              `json:"subject"`
+	Header        map[string][]string `json:"header,omitempty"`
+	Data          []byte              `json:"data"`
+	Error         string              `json:"error"`
+	NumDelivered  uint64              `json:"numDelivered"`
+	QuarantinedAt time.Time           `json:"quarantinedAt"`
+}
+
+// deadLetterHeader copies the original message header and records the failure alongside it
+func deadLetterHeader(msg *Message, cause error) map[string][]string {
+	header := make(map[string][]string, len(msg.Header)+3)
+	for key, values := range msg.Header {
+		header[key] = append([]string(nil), values...)
+	}
+	header[DeadLetterSubjectHeader] = []string{msg.Subject}
+	header[DeadLetterErrorHeader] = []string{cause.Error()}
+	header[DeadLetterNumDeliveredHeader] = []string{strconv.FormatUint(msg.NumDelivered, 10)}
+	return header
+}
+
+// QuarantineMessage writes msg and the error that prevented it from being processed under prefix in the given bucket
+func QuarantineMessage(ctx context.Context, store ObjectStore, prefix, bucketName string, msg *Message, cause error) (string, error) {
+	qm := QuarantinedMessage{
+		Subject:       msg.Subject,
+		Header:        msg.Header,
+		Data:          msg.Data,
+		Error:         cause.Error(),
+		NumDelivered:  msg.NumDelivered,
+		QuarantinedAt: time.Now().UTC(),
+	}
+	// keys sort by quarantine time
+	bucketKey := fmt.Sprintf("%s%s_%s.json", prefix, qm.QuarantinedAt.Format("20060102T150405.000000000Z"), uuid.NewString())
+	if _, err := put[QuarantinedMessage](ctx, store, bucketKey, bucketName, qm); err != nil {
+		return "", fmt.Errorf("Failed to quarantine message from %q: %w", msg.Subject, err)
+	}
+	return bucketKey, nil
+}
+
+// ListQuarantinedMessages returns the keys of all messages quarantined under prefix in the given bucket
+func ListQuarantinedMessages(ctx context.Context, store ObjectStore, prefix, bucketName string) ([]string, error) {
+	keys, err := store.ListObjects(ctx, prefix, bucketName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list quarantined messages %s:%s: %w", bucketName, prefix, err)
+	}
+	return keys, nil
+}
+
+func GetQuarantinedMessage(ctx context.Context, store ObjectStore, bucketKey, bucketName string) (QuarantinedMessage, error) {
+	return get[QuarantinedMessage](ctx, store, bucketKey, bucketName)
+}
+
+// RedriveQuarantinedMessage republishes a quarantined message on its original subject with its original
+// header, then removes it from quarantine so it is not re-driven twice
+func RedriveQuarantinedMessage(ctx context.Context, store ObjectStore, messageSource MessageSource, bucketKey, bucketName string) error {
+	qm, err := GetQuarantinedMessage(ctx, store, bucketKey, bucketName)
+	if err != nil {
+		return err
+	}
+	if err := messageSource.PublishMessage(qm.Subject, qm.Data, qm.Header); err != nil {
+		return fmt.Errorf("Failed to re-drive quarantined message %s:%s: %w", bucketName, bucketKey, err)
+	}
+	if err := store.DeleteObject(ctx, bucketKey, bucketName); err != nil {
+		return fmt.Errorf("Failed to remove re-driven message %s:%s from quarantine: %w", bucketName, bucketKey, err)
+	}
+	return nil
+}
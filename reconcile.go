@@ -0,0 +1,253 @@
+package smile_databricks_gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ReconcileStatus is how an object in a bucket differs from what SMILE holds
+type ReconcileStatus string
+
+const (
+	// SMILE holds a request or sample whose object or manifest was never written
+	MissingObject ReconcileStatus = "missing"
+	// the object was written but no longer matches SMILE
+	StaleObject ReconcileStatus = "stale"
+	// the object is not known to SMILE, it is only reported, never removed
+	OrphanedObject ReconcileStatus = "orphaned"
+)
+
+// ReconcileFinding is an object that differs from SMILE
+type ReconcileFinding struct {
+	Status ReconcileStatus
+	// requestKind, sampleKind or manifestKind
+	Kind string
+	// the IGO request ID or sample primary ID, empty for orphans
+	ID  string
+	Key string
+	// the request the object belongs to was committed again with the content SMILE holds
+	Repaired bool
+}
+
+type ReconcileReport struct {
+	// the number of objects SMILE expects in the bucket
+	NumChecked int
+	Findings   []ReconcileFinding
+}
+
+// Unrepaired returns the number of missing and stale objects that were not repaired
+func (r ReconcileReport) Unrepaired() int {
+	unrepaired := 0
+	for _, finding := range r.Findings {
+		if finding.Status != OrphanedObject && !finding.Repaired {
+			unrepaired++
+		}
+	}
+	return unrepaired
+}
+
+// LoadSmileRequests reads an export of SMILE requests from a file or an http(s) URL.  The export is a JSON
+// array of requests or a single request, optionally quoted the way SMILE publishes them.
+func LoadSmileRequests(ctx context.Context, source string) ([]SmileRequest, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = fetch(ctx, source)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load SMILE requests from %s: %w", source, err)
+	}
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		unquoted, err := strconv.Unquote(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unquote SMILE requests from %s: %q", source, err)
+		}
+		data = []byte(unquoted)
+	}
+	if !bytes.HasPrefix(data, []byte("[")) {
+		data = slices.Concat([]byte("["), data, []byte("]"))
+	}
+	var requests []SmileRequest
+	if err := json.Unmarshal(data, &requests); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal SMILE requests from %s: %q", source, err)
+	}
+	return requests, nil
+}
+
+func fetch(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Reconcile compares the requests and samples of requests, and the manifests listing them, with the objects in
+// bucketName, reporting the ones that are missing, stale or orphaned.  With repair, each request with a missing
+// or stale object is committed again the way the gateway commits it, manifest included, so that the committed_
+// tables of the DLT pipeline show it.  Only the overwrite layout can be reconciled, versioned keys cannot be
+// predicted.  Orphans are looked for everywhere but the prefixes starting with _.
+func Reconcile(ctx context.Context, store ObjectStore, bucketName string, layout Layout, requests []SmileRequest, repair bool) (ReconcileReport, error) {
+	var report ReconcileReport
+	if layout.isVersioned() {
+		return report, fmt.Errorf("Failed to reconcile %s: the %s layout cannot be reconciled", bucketName, layout)
+	}
+	expected := make(map[string]bool)
+	for _, request := range requests {
+		findings, manifest, err := reconcileRequest(ctx, store, bucketName, layout, request, expected)
+		if err != nil {
+			return report, err
+		}
+		// the request, its samples and its manifest
+		report.NumChecked += len(request.Samples) + 2
+		if repair && len(findings) > 0 {
+			// the stored message sequence is kept, a repair is not newer than the message that wrote the request
+			committed, err := CommitIGORequest(ctx, store, bucketName, layout, request, &Message{Sequence: manifest.MessageSequence})
+			if err != nil {
+				return report, fmt.Errorf("Failed to repair %s: %w", request.IgoRequestID, err)
+			}
+			// a request written by a newer message while it was being reconciled is left as it is
+			for i := range findings {
+				findings[i].Repaired = committed
+			}
+		}
+		report.Findings = append(report.Findings, findings...)
+	}
+
+	keys, err := store.ListObjects(ctx, "", bucketName)
+	if err != nil {
+		return report, fmt.Errorf("Failed to list %s: %w", bucketName, err)
+	}
+	for _, key := range keys {
+		// staging, quarantine, audit records and indexes live under the prefixes starting with _
+		if strings.HasPrefix(key, "_") || expected[key] {
+			continue
+		}
+		for _, kind := range []string{requestKind, sampleKind, manifestKind} {
+			// deleted requests and samples are replaced by tombstones, SMILE no longer knows about them
+			if strings.HasSuffix(key, kind+".json") && !isTombstone(ctx, store, key, bucketName) {
+				report.Findings = append(report.Findings, ReconcileFinding{Status: OrphanedObject, Kind: kind, Key: key})
+			}
+		}
+	}
+	return report, nil
+}
+
+// reconcileRequest compares request, its samples and its manifest with the objects in bucketName, adding their
+// keys to expected.  It returns the findings along with the stored manifest, an empty one when it is missing.
+func reconcileRequest(ctx context.Context, store ObjectStore, bucketName string, layout Layout, request SmileRequest, expected map[string]bool) ([]ReconcileFinding, RequestManifest, error) {
+	var findings []ReconcileFinding
+	check := func(kind, id, key string, status ReconcileStatus) {
+		expected[key] = true
+		if status != "" {
+			findings = append(findings, ReconcileFinding{Status: status, Kind: kind, ID: id, Key: key})
+		}
+	}
+
+	samples := request.Samples
+	request.Samples = nil
+	key, err := layout.RequestKey(request, nil)
+	if err != nil {
+		return nil, RequestManifest{}, err
+	}
+	status, hash, err := reconcileStatus(ctx, store, key, bucketName, request)
+	if err != nil {
+		return nil, RequestManifest{}, err
+	}
+	check(requestKind, request.IgoRequestID, key, status)
+	want := RequestManifest{Request: ManifestObject{Key: key, Hash: hash}}
+	for _, sample := range samples {
+		key, err := layout.IGOSampleKey(sample, nil)
+		if err != nil {
+			return nil, RequestManifest{}, err
+		}
+		status, hash, err := reconcileStatus(ctx, store, key, bucketName, sample)
+		if err != nil {
+			return nil, RequestManifest{}, err
+		}
+		check(sampleKind, sample.PrimaryID, key, status)
+		want.setSample(sample.PrimaryID, PutResult{Key: key, Hash: hash})
+	}
+
+	key = layout.ManifestKey(request.IgoRequestID)
+	manifest, err := get[RequestManifest](ctx, store, key, bucketName)
+	switch {
+	case errors.Is(err, ErrObjectNotFound):
+		check(manifestKind, request.IgoRequestID, key, MissingObject)
+	case err != nil:
+		return nil, manifest, fmt.Errorf("Failed to reconcile %s:%s: %w", bucketName, key, err)
+	case manifest.Deleted || !sameManifestObjects(manifest, want):
+		check(manifestKind, request.IgoRequestID, key, StaleObject)
+	default:
+		check(manifestKind, request.IgoRequestID, key, "")
+	}
+	return findings, manifest, nil
+}
+
+// sameManifestObjects reports whether two manifests list the same request and samples, in any order
+func sameManifestObjects(m, other RequestManifest) bool {
+	if m.Request != other.Request || len(m.Samples) != len(other.Samples) {
+		return false
+	}
+	objects := make(map[string]ManifestObject, len(m.Samples))
+	for _, sample := range m.Samples {
+		objects[sample.PrimaryID] = sample.ManifestObject
+	}
+	for _, sample := range other.Samples {
+		if object, found := objects[sample.PrimaryID]; !found || object != sample.ManifestObject {
+			return false
+		}
+	}
+	return true
+}
+
+// reconcileStatus compares the object at bucketKey with t, it returns an empty status when they match along
+// with the content hash of t
+func reconcileStatus[T any](ctx context.Context, store ObjectStore, bucketKey, bucketName string, t T) (ReconcileStatus, string, error) {
+	_, hash, err := encode(t)
+	if err != nil {
+		return "", "", err
+	}
+	info, err := store.HeadObject(ctx, bucketKey, bucketName)
+	if errors.Is(err, ErrObjectNotFound) {
+		return MissingObject, hash, nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to reconcile %s:%s: %w", bucketName, bucketKey, err)
+	}
+	stored := info.Metadata[ContentHashMetadataKey]
+	if stored == "" {
+		// objects written before content hashes were recorded are hashed here
+		data, err := store.GetObject(ctx, bucketKey, bucketName)
+		if err != nil {
+			return "", "", fmt.Errorf("Failed to reconcile %s:%s: %w", bucketName, bucketKey, err)
+		}
+		if stored, err = contentHash(data); err != nil {
+			return StaleObject, hash, nil
+		}
+	}
+	if stored != hash {
+		return StaleObject, hash, nil
+	}
+	return "", hash, nil
+}
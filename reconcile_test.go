@@ -0,0 +1,208 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "igo"
+	request := testRequest(t)
+	second := request.Samples[0]
+	second.PrimaryID = "22022_CC_4"
+	request.Samples = append(request.Samples, second)
+	// write the request as the gateway would, then lose one sample and let another go stale
+	store := NewMemoryObjectStore()
+	written := request
+	written.Samples = nil
+	if _, err := PutRequest(ctx, store, "IGO_TEST_REQUEST_request.json", bucket, written); err != nil {
+		t.Fatalf("cannot PutRequest: %q", err)
+	}
+	missing, stale := request.Samples[0], request.Samples[1]
+	for _, sample := range request.Samples[2:] {
+		if _, err := PutIGOSample(ctx, store, sample.PrimaryID+"_sample.json", bucket, sample); err != nil {
+			t.Fatalf("cannot PutIGOSample: %q", err)
+		}
+	}
+	outdated := stale
+	outdated.OncotreeCode = "MEL"
+	if _, err := PutIGOSample(ctx, store, stale.PrimaryID+"_sample.json", bucket, outdated); err != nil {
+		t.Fatalf("cannot PutIGOSample: %q", err)
+	}
+	// objects SMILE does not know about, ones under the prefixes starting with _ are not orphans
+	if err := store.PutObject(ctx, "ORPHAN_1_sample.json", bucket, []byte(`{}`), nil); err != nil {
+		t.Fatalf("cannot PutObject: %q", err)
+	}
+	if err := store.PutObject(ctx, "_staging/IGO_TEST_REQUEST/1/ORPHAN_2_sample.json", bucket, []byte(`{}`), nil); err != nil {
+		t.Fatalf("cannot PutObject: %q", err)
+	}
+	// deleted samples are not orphans
+	if _, err := put[Tombstone](ctx, store, "DELETED_1_sample.json", bucket, sampleTombstone(request.IgoRequestID, "DELETED_1", "")); err != nil {
+		t.Fatalf("cannot put tombstone: %q", err)
+	}
+
+	report, err := Reconcile(ctx, store, bucket, OverwriteLayout, []SmileRequest{request}, false)
+	if err != nil {
+		t.Fatalf("cannot Reconcile: %q", err)
+	}
+	want := []ReconcileFinding{
+		{Status: MissingObject, Kind: sampleKind, ID: missing.PrimaryID, Key: missing.PrimaryID + "_sample.json"},
+		{Status: StaleObject, Kind: sampleKind, ID: stale.PrimaryID, Key: stale.PrimaryID + "_sample.json"},
+		// the request was written without its manifest, the committed_ tables do not show it
+		{Status: MissingObject, Kind: manifestKind, ID: request.IgoRequestID, Key: "IGO_TEST_REQUEST_manifest.json"},
+		{Status: OrphanedObject, Kind: sampleKind, Key: "ORPHAN_1_sample.json"},
+	}
+	if !reflect.DeepEqual(report.Findings, want) {
+		t.Errorf("got findings %+v want %+v", report.Findings, want)
+	}
+	if report.NumChecked != 2+len(request.Samples) || report.Unrepaired() != 3 {
+		t.Errorf("got %d checked and %d unrepaired want %d and 3", report.NumChecked, report.Unrepaired(), 2+len(request.Samples))
+	}
+
+	report, err = Reconcile(ctx, store, bucket, OverwriteLayout, []SmileRequest{request}, true)
+	if err != nil {
+		t.Fatalf("cannot Reconcile: %q", err)
+	}
+	if report.Unrepaired() != 0 {
+		t.Errorf("got %d unrepaired findings after repair want 0", report.Unrepaired())
+	}
+	gotSample, err := GetSampleObject(ctx, store, stale.PrimaryID+"_sample.json", bucket)
+	if err != nil {
+		t.Fatalf("cannot get sample: %q", err)
+	}
+	if !reflect.DeepEqual(gotSample, stale) {
+		t.Errorf("got %v want the stale sample repaired to %v", gotSample, stale)
+	}
+	manifest, err := get[RequestManifest](ctx, store, "IGO_TEST_REQUEST_manifest.json", bucket)
+	if err != nil {
+		t.Fatalf("cannot get manifest: %q", err)
+	}
+	if len(manifest.Samples) != len(request.Samples) {
+		t.Errorf("got %d samples in the repaired manifest want %d", len(manifest.Samples), len(request.Samples))
+	}
+	report, err = Reconcile(ctx, store, bucket, OverwriteLayout, []SmileRequest{request}, false)
+	if err != nil {
+		t.Fatalf("cannot Reconcile: %q", err)
+	}
+	if len(report.Findings) != 1 || report.Findings[0].Status != OrphanedObject {
+		t.Errorf("got findings %+v after repair want only the orphan", report.Findings)
+	}
+
+	// a sample missing from the manifest leaves the manifest stale, a repair keeps its message sequence
+	manifest.Samples = manifest.Samples[1:]
+	manifest.MessageSequence = 42
+	if _, err := put[RequestManifest](ctx, store, "IGO_TEST_REQUEST_manifest.json", bucket, manifest); err != nil {
+		t.Fatalf("cannot put manifest: %q", err)
+	}
+	report, err = Reconcile(ctx, store, bucket, OverwriteLayout, []SmileRequest{request}, true)
+	if err != nil {
+		t.Fatalf("cannot Reconcile: %q", err)
+	}
+	wantManifest := ReconcileFinding{Status: StaleObject, Kind: manifestKind, ID: request.IgoRequestID, Key: "IGO_TEST_REQUEST_manifest.json", Repaired: true}
+	if len(report.Findings) != 2 || report.Findings[0] != wantManifest {
+		t.Errorf("got findings %+v want %+v and the orphan", report.Findings, wantManifest)
+	}
+	if manifest, err = get[RequestManifest](ctx, store, "IGO_TEST_REQUEST_manifest.json", bucket); err != nil {
+		t.Fatalf("cannot get manifest: %q", err)
+	}
+	if len(manifest.Samples) != len(request.Samples) || manifest.MessageSequence != 42 {
+		t.Errorf("got manifest of %d samples at sequence %d want %d samples at 42", len(manifest.Samples), manifest.MessageSequence, len(request.Samples))
+	}
+
+	if _, err := Reconcile(ctx, store, bucket, VersionedLayout, []SmileRequest{request}, false); err == nil {
+		t.Errorf("expected the versioned layout to be rejected")
+	}
+}
+
+func TestReconcileKeyTemplates(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "igo"
+	templates, err := ParseKeyTemplates("igo/{{.IgoProjectID}}/{{.IgoRequestID}}/request.json", "igo/{{.AdditionalProperties.IgoRequestID}}/{{.PrimaryID}}/sample.json", "")
+	if err != nil {
+		t.Fatalf("cannot ParseKeyTemplates: %q", err)
+	}
+	layout, err := OverwriteLayout.WithKeyTemplates(templates)
+	if err != nil {
+		t.Fatalf("cannot WithKeyTemplates: %q", err)
+	}
+	request := testRequest(t)
+	store := NewMemoryObjectStore()
+	if _, err := CommitIGORequest(ctx, store, bucket, layout, request, &Message{Sequence: 1}); err != nil {
+		t.Fatalf("cannot CommitIGORequest: %q", err)
+	}
+	lost, err := layout.IGOSampleKey(request.Samples[0], nil)
+	if err != nil {
+		t.Fatalf("cannot render sample key: %q", err)
+	}
+	if err := store.DeleteObject(ctx, lost, bucket); err != nil {
+		t.Fatalf("cannot DeleteObject: %q", err)
+	}
+	// templated keys are all below a path, only the prefixes starting with _ hold no orphans
+	for _, key := range []string{"igo/OTHER_REQUEST/ORPHAN_1/sample.json", "_audit/embargo/ORPHAN_2_sample.json"} {
+		if err := store.PutObject(ctx, key, bucket, []byte(`{}`), nil); err != nil {
+			t.Fatalf("cannot PutObject: %q", err)
+		}
+	}
+
+	report, err := Reconcile(ctx, store, bucket, layout, []SmileRequest{request}, true)
+	if err != nil {
+		t.Fatalf("cannot Reconcile: %q", err)
+	}
+	want := []ReconcileFinding{
+		{Status: MissingObject, Kind: sampleKind, ID: request.Samples[0].PrimaryID, Key: lost, Repaired: true},
+		{Status: OrphanedObject, Kind: sampleKind, Key: "igo/OTHER_REQUEST/ORPHAN_1/sample.json"},
+	}
+	if !reflect.DeepEqual(report.Findings, want) {
+		t.Errorf("got findings %+v want %+v", report.Findings, want)
+	}
+	if _, err := GetSampleObject(ctx, store, lost, bucket); err != nil {
+		t.Errorf("lost sample was not repaired: %q", err)
+	}
+}
+
+func TestLoadSmileRequests(t *testing.T) {
+	request := testRequest(t)
+	array, err := json.Marshal([]SmileRequest{request})
+	if err != nil {
+		t.Fatalf("cannot marshal requests: %q", err)
+	}
+	dir := t.TempDir()
+	sources := map[string][]byte{
+		"array":  array,
+		"single": []byte(RequestJSON),
+		"quoted": []byte(strconv.Quote(RequestJSON)),
+	}
+	for name, data := range sources {
+		path := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatalf("cannot write %s: %q", path, err)
+		}
+		requests, err := LoadSmileRequests(context.Background(), path)
+		if err != nil {
+			t.Fatalf("cannot LoadSmileRequests %s: %q", name, err)
+		}
+		if !reflect.DeepEqual(requests, []SmileRequest{request}) {
+			t.Errorf("got %v from %s want the test request", requests, name)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(array)
+	}))
+	defer server.Close()
+	requests, err := LoadSmileRequests(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("cannot LoadSmileRequests from %s: %q", server.URL, err)
+	}
+	if !reflect.DeepEqual(requests, []SmileRequest{request}) {
+		t.Errorf("got %v from %s want the test request", requests, server.URL)
+	}
+}
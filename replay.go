@@ -0,0 +1,106 @@
+package smile_databricks_gateway
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReplayStart is where a replay begins in a stream: at a stream sequence, or at the first message
+// published at or after a time when Sequence is 0
+type ReplayStart struct {
+	Sequence uint64
+	Time     time.Time
+}
+
+// ReplayableMessageSource is a MessageSource whose stream can be consumed again from a point in the past
+type ReplayableMessageSource interface {
+	MessageSource
+	// SubscribeFrom delivers the messages matching subjectFilter from start on with an ephemeral consumer.
+	// handler is passed each message along with the number of matching messages in the stream after it.
+	// SubscribeFrom reports whether there was nothing to deliver when it subscribed.
+	SubscribeFrom(subjectFilter string, start ReplayStart, handler func(msg *Message, pending uint64)) (bool, error)
+}
+
+// ReplaySource re-consumes a stream from a point in the past, so that a SmileService run with it lands every
+// message since then again.  Done is closed once it has caught up with the stream.
+type ReplaySource struct {
+	ReplayableMessageSource
+	start ReplayStart
+
+	done     chan struct{}
+	doneOnce sync.Once
+	counts   ReplayCounts
+}
+
+// ReplayCounts counts the deliveries of a replay by how they were settled, a message naked and redelivered is counted for each delivery
+type ReplayCounts struct {
+	Acked  atomic.Int64
+	Naked  atomic.Int64
+	Termed atomic.Int64
+}
+
+var _ MessageSource = (*ReplaySource)(nil)
+
+func NewReplaySource(source ReplayableMessageSource, start ReplayStart) *ReplaySource {
+	return &ReplaySource{ReplayableMessageSource: source, start: start, done: make(chan struct{})}
+}
+
+// Subscribe replays the messages matching subjectFilter, consumer is not used as the consumer is ephemeral
+func (r *ReplaySource) Subscribe(consumer, subjectFilter string, handler MessageHandler) error {
+	empty, err := r.SubscribeFrom(subjectFilter, r.start, func(msg *Message, pending uint64) {
+		msg.acker = replayAcker{msg.acker, &r.counts}
+		handler(msg)
+		// the last message in the stream has been handed off
+		if pending == 0 {
+			r.finish()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if empty {
+		// nothing to replay
+		r.finish()
+	}
+	return nil
+}
+
+func (r *ReplaySource) finish() {
+	r.doneOnce.Do(func() { close(r.done) })
+}
+
+// Done is closed once every message in the stream when the replay caught up with it has been handed off
+func (r *ReplaySource) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *ReplaySource) Counts() *ReplayCounts {
+	return &r.counts
+}
+
+// replayAcker counts settlements, messages naked when the replay is done are not redelivered
+type replayAcker struct {
+	Acknowledger
+	counts *ReplayCounts
+}
+
+func (a replayAcker) Ack() error {
+	a.counts.Acked.Add(1)
+	return a.Acknowledger.Ack()
+}
+
+func (a replayAcker) Nak() error {
+	a.counts.Naked.Add(1)
+	return a.Acknowledger.Nak()
+}
+
+func (a replayAcker) NakWithDelay(delay time.Duration) error {
+	a.counts.Naked.Add(1)
+	return a.Acknowledger.NakWithDelay(delay)
+}
+
+func (a replayAcker) Term() error {
+	a.counts.Termed.Add(1)
+	return a.Acknowledger.Term()
+}
@@ -0,0 +1,97 @@
+package smile_databricks_gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestReplaySource(t *testing.T) {
+	first := testRequest(t)
+	second := testRequest(t)
+	second.IgoRequestID = "IGO_TEST_REQUEST_2"
+	second.Samples[0].PrimaryID = "22022_CC_4"
+	// Run shuts its message source down, each replay has a stream of its own
+	newSource := func(t *testing.T) *ChannelMessageSource {
+		t.Helper()
+		source := NewChannelMessageSource()
+		for _, request := range []SmileRequest{first, second} {
+			data, err := json.Marshal(request)
+			if err != nil {
+				t.Fatalf("cannot marshal request: %q", err)
+			}
+			source.Publish(testNewRequestFilter, []byte(strconv.Quote(string(data))))
+			// so that the messages are published at different times
+			time.Sleep(time.Millisecond)
+		}
+		return source
+	}
+
+	tests := []struct {
+		name string
+		// where the replay starts in the messages published
+		start     func(published []Message) ReplayStart
+		wantAcked int64
+		// the keys of the requests the replay would write, and those it would not
+		wantKeys   []string
+		unwantKeys []string
+	}{
+		{"FromSequence", func([]Message) ReplayStart { return ReplayStart{Sequence: 2} }, 1,
+			[]string{"IGO_TEST_REQUEST_2_request.json"}, []string{"IGO_TEST_REQUEST_request.json"}},
+		{"FromTime", func(published []Message) ReplayStart { return ReplayStart{Time: published[1].Timestamp} }, 1,
+			[]string{"IGO_TEST_REQUEST_2_request.json"}, []string{"IGO_TEST_REQUEST_request.json"}},
+		{"FromBeginning", func([]Message) ReplayStart { return ReplayStart{Sequence: 1} }, 2,
+			[]string{"IGO_TEST_REQUEST_request.json", "IGO_TEST_REQUEST_2_request.json"}, nil},
+		{"NothingToReplay", func(published []Message) ReplayStart { return ReplayStart{Time: published[1].Timestamp.Add(time.Hour)} }, 0,
+			nil, []string{"IGO_TEST_REQUEST_request.json", "IGO_TEST_REQUEST_2_request.json"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			store := NewDryRunObjectStore(NewMemoryObjectStore(), &out)
+			source := newSource(t)
+			replaySource := NewReplaySource(source, tt.start(source.Published(testNewRequestFilter)))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error)
+			go func() {
+				done <- NewSmileService(replaySource, store, DefaultSmileServiceOptions()).Run(ctx, testConsumer, testSubjectFilter, testNewRequestFilter, testUpdateRequestFilter,
+					testUpdateSampleFilter, testDeleteFilter, testIGOBucket, testReleaseTEMPOFilter, testUpdateTEMPOFilter, testTEMPOBucket, noop.NewTracerProvider().Tracer("test"), "")
+			}()
+			select {
+			case <-replaySource.Done():
+			case <-time.After(testMessageSettledDuration):
+				t.Fatalf("replay did not catch up within %v", testMessageSettledDuration)
+			}
+			// the messages handed off are drained before Run returns
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("cannot Run: %q", err)
+			}
+
+			counts := replaySource.Counts()
+			if counts.Acked.Load() != tt.wantAcked || counts.Naked.Load() != 0 || counts.Termed.Load() != 0 {
+				t.Errorf("got %d acked, %d naked and %d terminated want %d acked", counts.Acked.Load(), counts.Naked.Load(), counts.Termed.Load(), tt.wantAcked)
+			}
+			for _, key := range tt.wantKeys {
+				if !strings.Contains(out.String(), "would put\t"+testIGOBucket+":"+key+"\t") {
+					t.Errorf("got dry run output %q want a put of %s", out.String(), key)
+				}
+			}
+			for _, key := range tt.unwantKeys {
+				if strings.Contains(out.String(), ":"+key+"\t") {
+					t.Errorf("got dry run output %q want no put of %s", out.String(), key)
+				}
+			}
+			if keys, _ := store.store.ListObjects(context.Background(), "", testIGOBucket); len(keys) != 0 {
+				t.Errorf("got objects %v written through the dry run want none", keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RetryPolicy decides how often and how long apart a failed object store operation is attempted again
+type RetryPolicy struct {
+	// attempts including the first, 1 disables retries
+	MaxAttempts int
+	// the delay before the first retry, doubled for each retry after it up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// the fraction of each delay that is randomized, 0 for none and 1 for anywhere between 0 and the delay,
+	// so that writers failing together do not retry together
+	Jitter float64
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   200 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+		Jitter:      0.5,
+	}
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("Invalid retry policy: at least 1 attempt is required, got %d", p.MaxAttempts)
+	}
+	if p.BaseDelay < 0 || p.MaxDelay < p.BaseDelay {
+		return fmt.Errorf("Invalid retry policy: delays must satisfy 0 <= base (%s) <= max (%s)", p.BaseDelay, p.MaxDelay)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("Invalid retry policy: jitter must be between 0 and 1, got %v", p.Jitter)
+	}
+	return nil
+}
+
+// delay returns how long to wait before retry number retry (1 for the first retry)
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxDelay)
+	return d - time.Duration(p.Jitter*rand.Float64()*float64(d))
+}
+
+// isRetryable reports whether an operation that failed with err can succeed if attempted again
+func isRetryable(err error) bool {
+	// a missing object stays missing
+	return !errors.Is(err, ErrObjectNotFound) && ClassifyError(err) == TransientError
+}
+
+// RetryingObjectStore retries the operations of an ObjectStore that fail transiently, recording each
+// retry as an event on the span of the context the operation is called with
+type RetryingObjectStore struct {
+	store  ObjectStore
+	policy RetryPolicy
+}
+
+var _ ObjectStore = (*RetryingObjectStore)(nil)
+
+func NewRetryingObjectStore(store ObjectStore, policy RetryPolicy) (*RetryingObjectStore, error) {
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return &RetryingObjectStore{store: store, policy: policy}, nil
+}
+
+const (
+	retryingStoreOpMsg  = "Transient object store failure, retrying"
+	retriesExhaustedMsg = "Object store operation failed after all attempts"
+	StoreOperationKey   = "Store Operation"
+	AttemptKey          = "Attempt"
+	RetryDelayKey       = "Retry Delay"
+	StoreErrorKey       = "Store Error"
+)
+
+func (r *RetryingObjectStore) PutObject(ctx context.Context, bucketKey, bucketName string, content []byte, metadata map[string]string) error {
+	return r.do(ctx, "PutObject", bucketKey, func() error {
+		return r.store.PutObject(ctx, bucketKey, bucketName, content, metadata)
+	})
+}
+
+func (r *RetryingObjectStore) GetObject(ctx context.Context, bucketKey, bucketName string) ([]byte, error) {
+	var data []byte
+	err := r.do(ctx, "GetObject", bucketKey, func() (err error) {
+		data, err = r.store.GetObject(ctx, bucketKey, bucketName)
+		return err
+	})
+	return data, err
+}
+
+func (r *RetryingObjectStore) DeleteObject(ctx context.Context, bucketKey, bucketName string) error {
+	return r.do(ctx, "DeleteObject", bucketKey, func() error {
+		return r.store.DeleteObject(ctx, bucketKey, bucketName)
+	})
+}
+
+func (r *RetryingObjectStore) ListObjects(ctx context.Context, prefix, bucketName string) ([]string, error) {
+	var keys []string
+	err := r.do(ctx, "ListObjects", prefix, func() (err error) {
+		keys, err = r.store.ListObjects(ctx, prefix, bucketName)
+		return err
+	})
+	return keys, err
+}
+
+func (r *RetryingObjectStore) HeadObject(ctx context.Context, bucketKey, bucketName string) (ObjectInfo, error) {
+	var info ObjectInfo
+	err := r.do(ctx, "HeadObject", bucketKey, func() (err error) {
+		info, err = r.store.HeadObject(ctx, bucketKey, bucketName)
+		return err
+	})
+	return info, err
+}
+
+// do runs op until it succeeds, fails with an error that is not retryable, runs out of attempts or ctx is done
+func (r *RetryingObjectStore) do(ctx context.Context, operation, bucketKey string, op func() error) error {
+	span := trace.SpanFromContext(ctx)
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+		if attempt == r.policy.MaxAttempts {
+			if r.policy.MaxAttempts > 1 {
+				span.AddEvent(retriesExhaustedMsg, trace.WithAttributes(attribute.String(StoreOperationKey, operation),
+					attribute.String(ObjectKeyKey, bucketKey), attribute.Int(AttemptKey, attempt)))
+			}
+			return err
+		}
+		delay := r.policy.delay(attempt)
+		span.AddEvent(retryingStoreOpMsg, trace.WithAttributes(attribute.String(StoreOperationKey, operation),
+			attribute.String(ObjectKeyKey, bucketKey), attribute.Int(AttemptKey, attempt),
+			attribute.String(RetryDelayKey, delay.String()), attribute.String(StoreErrorKey, err.Error())))
+		objectStoreRetries.WithLabelValues(operation).Inc()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
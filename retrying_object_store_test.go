@@ -0,0 +1,129 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// flakyObjectStore fails the first failures puts with err
+type flakyObjectStore struct {
+	ObjectStore
+	err      error
+	failures int32
+	attempts atomic.Int32
+}
+
+func (f *flakyObjectStore) PutObject(ctx context.Context, bucketKey, bucketName string, content []byte, metadata map[string]string) error {
+	if f.attempts.Add(1) <= f.failures {
+		return f.err
+	}
+	return f.ObjectStore.PutObject(ctx, bucketKey, bucketName, content, metadata)
+}
+
+func TestRetryingObjectStore(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond, Jitter: 0.5}
+	throttled := errors.New("SlowDown: please reduce your request rate")
+
+	tests := []struct {
+		name         string
+		err          error
+		failures     int32
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{"Succeeds", throttled, 0, 1, false},
+		{"TransientFailureIsRetried", throttled, 2, 3, false},
+		{"AttemptsAreExhausted", throttled, 5, 3, true},
+		{"PermanentFailureIsNotRetried", permanentError(errors.New("NoSuchBucket")), 5, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &flakyObjectStore{ObjectStore: NewMemoryObjectStore(), err: tt.err, failures: tt.failures}
+			retryingStore, err := NewRetryingObjectStore(store, policy)
+			if err != nil {
+				t.Fatalf("cannot create retrying store: %q", err)
+			}
+			err = retryingStore.PutObject(context.Background(), "key", "bucket", []byte("{}"), nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got err %v want error %v", err, tt.wantErr)
+			}
+			if got := store.attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("got %d attempts want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+
+	t.Run("MissingObjectIsNotRetried", func(t *testing.T) {
+		retryingStore, _ := NewRetryingObjectStore(NewMemoryObjectStore(), policy)
+		if _, err := retryingStore.GetObject(context.Background(), "missing", "bucket"); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("got err %v want %v", err, ErrObjectNotFound)
+		}
+	})
+
+	t.Run("RetriesAreSpanEvents", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		ctx, span := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test").Start(context.Background(), "write")
+		store := &flakyObjectStore{ObjectStore: NewMemoryObjectStore(), err: throttled, failures: 5}
+		retryingStore, _ := NewRetryingObjectStore(store, policy)
+		retryingStore.PutObject(ctx, "key", "bucket", []byte("{}"), nil)
+		span.End()
+
+		var events []string
+		for _, event := range recorder.Ended()[0].Events() {
+			events = append(events, event.Name)
+		}
+		want := []string{retryingStoreOpMsg, retryingStoreOpMsg, retriesExhaustedMsg}
+		if len(events) != len(want) {
+			t.Fatalf("got events %v want %v", events, want)
+		}
+		for i := range want {
+			if events[i] != want[i] {
+				t.Errorf("got events %v want %v", events, want)
+			}
+		}
+	})
+
+	t.Run("CancelStopsRetrying", func(t *testing.T) {
+		slow := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Minute, MaxDelay: time.Minute}
+		store := &flakyObjectStore{ObjectStore: NewMemoryObjectStore(), err: throttled, failures: 5}
+		retryingStore, _ := NewRetryingObjectStore(store, slow)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if err := retryingStore.PutObject(ctx, "key", "bucket", []byte("{}"), nil); !errors.Is(err, throttled) {
+			t.Errorf("got err %v want %v", err, throttled)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("cancelled put took %s", elapsed)
+		}
+	})
+
+	t.Run("DelaysBackOffExponentially", func(t *testing.T) {
+		backoff := RetryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, Jitter: 0.5}
+		for retry, maxDelay := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+			for i := 0; i < 100; i++ {
+				if delay := backoff.delay(retry + 1); delay > maxDelay || delay < maxDelay/2 {
+					t.Fatalf("got delay %s for retry %d want between %s and %s", delay, retry+1, maxDelay/2, maxDelay)
+				}
+			}
+		}
+	})
+
+	t.Run("InvalidPolicy", func(t *testing.T) {
+		for _, invalid := range []RetryPolicy{
+			{MaxAttempts: 0},
+			{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Millisecond},
+			{MaxAttempts: 3, Jitter: 1.5},
+		} {
+			if _, err := NewRetryingObjectStore(NewMemoryObjectStore(), invalid); err == nil {
+				t.Errorf("expected an error for %+v", invalid)
+			}
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// how far through a session the next one is loaded in the background, early enough that a saml2aws
+// run completes before the current session expires
+const sessionRefreshFraction = 0.8
+
+// s3ClientHolder shares one S3 client between concurrent writers.  The client is created on first use,
+// sessions that expire are loaded again in the background before they do, and only one load runs at a
+// time, writers that need a client while it runs wait for it.
+type s3ClientHolder struct {
+	credentialProvider AWSCredentialProvider
+
+	mu           sync.Mutex
+	client       *s3.Client
+	sessionStart time.Time
+	// the in-flight load, nil when none is running
+	refreshing *clientRefresh
+	// the error from the last load, nil once a load succeeds
+	refreshErr   error
+	refreshTimer *time.Timer
+	stopped      bool
+}
+
+type clientRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+func newS3ClientHolder(credentialProvider AWSCredentialProvider) *s3ClientHolder {
+	return &s3ClientHolder{credentialProvider: credentialProvider}
+}
+
+// get returns a client whose session has not expired, waiting for a load when there is none
+func (h *s3ClientHolder) get(ctx context.Context) (*s3.Client, error) {
+	for {
+		h.mu.Lock()
+		if h.client != nil && !h.sessionIsExpired() {
+			client := h.client
+			h.mu.Unlock()
+			return client, nil
+		}
+		refresh := h.startRefresh()
+		h.mu.Unlock()
+
+		select {
+		case <-refresh.done:
+			if refresh.err != nil {
+				return nil, refresh.err
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Failed to wait for S3 client: %w", ctx.Err())
+		}
+	}
+}
+
+// startRefresh returns the in-flight load, starting one if none is running, h.mu must be held
+func (h *s3ClientHolder) startRefresh() *clientRefresh {
+	if h.refreshing != nil {
+		return h.refreshing
+	}
+	refresh := &clientRefresh{done: make(chan struct{})}
+	h.refreshing = refresh
+	go h.refresh(refresh)
+	return refresh
+}
+
+func (h *s3ClientHolder) refresh(refresh *clientRefresh) {
+	// the load is shared by every waiter, so it is not cancelled with any one of them
+	cfg, err := h.credentialProvider.LoadConfig(context.Background())
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		credentialRefreshes.WithLabelValues(errorOutcome).Inc()
+		refresh.err = fmt.Errorf("Failed to create S3 client: %q", err)
+		h.refreshErr = refresh.err
+	} else {
+		cfg.Credentials = cacheCredentials(cfg.Credentials)
+		// a session load runs a provider like saml2aws, whose credentials the SDK then reads without refreshing them
+		if h.credentialProvider.SessionDuration() != 0 {
+			credentialRefreshes.WithLabelValues(successOutcome).Inc()
+		}
+		// failed operations are retried by RetryingObjectStore, with the policy it is configured with
+		h.client = s3.NewFromConfig(cfg, func(o *s3.Options) { o.Retryer = aws.NopRetryer{} })
+		h.sessionStart = time.Now()
+		h.refreshErr = nil
+		h.scheduleRefresh()
+	}
+	h.refreshing = nil
+	close(refresh.done)
+}
+
+// scheduleRefresh loads the next session in the background before the current one expires, h.mu must be held
+func (h *s3ClientHolder) scheduleRefresh() {
+	sessionDuration := h.credentialProvider.SessionDuration()
+	if sessionDuration == 0 || h.stopped {
+		return
+	}
+	if h.refreshTimer != nil {
+		h.refreshTimer.Stop()
+	}
+	h.refreshTimer = time.AfterFunc(time.Duration(float64(sessionDuration)*sessionRefreshFraction), func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if !h.stopped {
+			h.startRefresh()
+		}
+	})
+}
+
+// stop cancels the background refresh, clients are still loaded on demand
+func (h *s3ClientHolder) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopped = true
+	if h.refreshTimer != nil {
+		h.refreshTimer.Stop()
+	}
+}
+
+// status describes the current session, it fails when there is no session that has not expired and the
+// last load failed.  A failed background load is only reported while the current session is still valid.
+func (h *s3ClientHolder) status() (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.refreshErr != nil && (h.client == nil || h.sessionIsExpired()) {
+		return "", h.refreshErr
+	}
+	if h.client == nil {
+		if h.refreshing != nil {
+			return "session is being created", nil
+		}
+		return "no session yet, one is created on first use", nil
+	}
+	sessionDuration := h.credentialProvider.SessionDuration()
+	if sessionDuration == 0 {
+		return fmt.Sprintf("session started %s, credentials are refreshed before they expire", formatAge(h.sessionStart)), nil
+	}
+	detail := fmt.Sprintf("session started %s, expires after %s", formatAge(h.sessionStart), sessionDuration)
+	if h.refreshing != nil {
+		detail += ", next session is being loaded"
+	} else if h.refreshErr != nil {
+		detail += fmt.Sprintf(", loading the next session failed: %v", h.refreshErr)
+	}
+	return detail, nil
+}
+
+// cacheCredentials caches provider, counting each retrieval, unless it is already cached.  The SDK caches the
+// credentials of the configuration it loads, the providers of aws_credentials.go count their own retrievals.
+func cacheCredentials(provider aws.CredentialsProvider) aws.CredentialsProvider {
+	if _, ok := provider.(*aws.CredentialsCache); ok || provider == nil {
+		return provider
+	}
+	return aws.NewCredentialsCache(countingCredentialsProvider{provider})
+}
+
+// h.mu must be held
+func (h *s3ClientHolder) sessionIsExpired() bool {
+	sessionDuration := h.credentialProvider.SessionDuration()
+	return sessionDuration != 0 && time.Since(h.sessionStart) >= sessionDuration
+}
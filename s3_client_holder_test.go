@@ -0,0 +1,161 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// slowCredentialProvider stands in for saml2aws, each load takes loadTime and sessions last sessionDuration
+type slowCredentialProvider struct {
+	loadTime        time.Duration
+	sessionDuration time.Duration
+	loads           atomic.Int32
+	inFlight        atomic.Int32
+	overlapping     atomic.Bool
+	fail            atomic.Bool
+}
+
+func (p *slowCredentialProvider) LoadConfig(ctx context.Context) (aws.Config, error) {
+	if p.inFlight.Add(1) > 1 {
+		p.overlapping.Store(true)
+	}
+	defer p.inFlight.Add(-1)
+	p.loads.Add(1)
+	time.Sleep(p.loadTime)
+	if p.fail.Load() {
+		return aws.Config{}, errors.New("saml2aws failed")
+	}
+	return aws.Config{Region: "us-east-1", Credentials: aws.AnonymousCredentials{}}, nil
+}
+
+func (p *slowCredentialProvider) SessionDuration() time.Duration {
+	return p.sessionDuration
+}
+
+func (h *s3ClientHolder) isRefreshing() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.refreshing != nil
+}
+
+func TestS3ClientHolder(t *testing.T) {
+	t.Run("ConcurrentWritersShareOneLoad", func(t *testing.T) {
+		provider := &slowCredentialProvider{loadTime: 50 * time.Millisecond}
+		holder := newS3ClientHolder(provider)
+		defer holder.stop()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client, err := holder.get(context.Background())
+				if err != nil || client == nil {
+					t.Errorf("got client %v err %v", client, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if loads := provider.loads.Load(); loads != 1 {
+			t.Errorf("got %d loads want 1", loads)
+		}
+	})
+
+	t.Run("SessionIsRefreshedInTheBackground", func(t *testing.T) {
+		provider := &slowCredentialProvider{loadTime: 5 * time.Millisecond, sessionDuration: 100 * time.Millisecond}
+		holder := newS3ClientHolder(provider)
+		defer holder.stop()
+
+		// hammer the holder across several sessions
+		deadline := time.Now().Add(500 * time.Millisecond)
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for time.Now().Before(deadline) {
+					client, err := holder.get(context.Background())
+					if err != nil || client == nil {
+						t.Errorf("got client %v err %v", client, err)
+						return
+					}
+					holder.status()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if provider.overlapping.Load() {
+			t.Errorf("sessions were loaded concurrently")
+		}
+		// one load on first use then one for each session after, all but the first ahead of expiry
+		if loads := provider.loads.Load(); loads < 4 || loads > 8 {
+			t.Errorf("got %d loads want one per session", loads)
+		}
+	})
+
+	t.Run("FailedLoadIsReported", func(t *testing.T) {
+		provider := &slowCredentialProvider{loadTime: time.Millisecond}
+		provider.fail.Store(true)
+		holder := newS3ClientHolder(provider)
+		defer holder.stop()
+
+		if _, err := holder.get(context.Background()); err == nil {
+			t.Fatalf("expected an error when the session cannot be loaded")
+		}
+		if _, err := holder.status(); err == nil {
+			t.Errorf("expected status to report the failed load")
+		}
+		provider.fail.Store(false)
+		if _, err := holder.get(context.Background()); err != nil {
+			t.Fatalf("cannot get client after the provider recovered: %q", err)
+		}
+		if _, err := holder.status(); err != nil {
+			t.Errorf("got status error %q after a successful load", err)
+		}
+	})
+
+	t.Run("FailedBackgroundLoadIsReportedOnceTheSessionExpires", func(t *testing.T) {
+		provider := &slowCredentialProvider{loadTime: time.Millisecond, sessionDuration: 500 * time.Millisecond}
+		holder := newS3ClientHolder(provider)
+		defer holder.stop()
+
+		if _, err := holder.get(context.Background()); err != nil {
+			t.Fatalf("cannot get client: %q", err)
+		}
+		sessionStart := time.Now()
+		provider.fail.Store(true)
+		// wait for the background load ahead of expiry to fail
+		for provider.loads.Load() < 2 || holder.isRefreshing() {
+			if time.Since(sessionStart) > time.Second {
+				t.Fatalf("session was not loaded in the background")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if _, err := holder.status(); err != nil {
+			t.Errorf("got status error %q while the session is still valid", err)
+		}
+		time.Sleep(time.Until(sessionStart.Add(provider.sessionDuration)))
+		if _, err := holder.status(); err == nil {
+			t.Errorf("expected status to report the failed load once the session expired")
+		}
+	})
+
+	t.Run("WaitingWriterIsCancelled", func(t *testing.T) {
+		provider := &slowCredentialProvider{loadTime: time.Second}
+		holder := newS3ClientHolder(provider)
+		defer holder.stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := holder.get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got err %v want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
@@ -22,7 +22,7 @@ type SmileRequest struct {
 	QcAccessEmails     string        `json:"qcAccessEmails"`
 	IsCmoRequest       bool          `json:"isCmoRequest"`
 	BicAnalysis        bool          `json:"bicAnalysis"`
-	Samples            []SmileSample `json:"samples",omitempty`
+	Samples            []SmileSample `json:"samples"`
 	PooledNormals      []string      `json:"pooledNormals"`
 	IgoProjectID       string        `json:"igoProjectId"`
 }
@@ -3,13 +3,14 @@ package smile_databricks_gateway
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
-	nm "github.com/mskcc/nats-messaging-go"
 	st "github.mskcc.org/cdsi/cdsi-protobuf/smile/generated/v1/go"
 	"google.golang.org/protobuf/proto"
 
@@ -19,40 +20,84 @@ import (
 )
 
 type SmileService struct {
-	awsS3Service  *AWSS3Service
-	natsMessaging *nm.Messaging
+	objectStore   ObjectStore
+	messageSource MessageSource
+	options       SmileServiceOptions
+	started       time.Time
+	// unix nanoseconds of the last ack, 0 until a message is acked
+	lastAck atomic.Int64
+}
+
+// SmileServiceOptions tunes how SmileService settles messages it could not process
+type SmileServiceOptions struct {
+	// messages that fail after this many deliveries are terminated instead of naked, 0 means no limit
+	MaxDeliver int
+	// how long the message source waits before redelivering a message that failed transiently
+	NakDelay time.Duration
+	// subject undecodable messages are republished on, empty to disable
+	DeadLetterSubject string
+	// prefix undecodable messages are written under in the bucket they were destined for, empty to disable
+	QuarantinePrefix string
+	// the keys requests and samples are written to
+	Layout Layout
+	// the number of messages of each type processed concurrently
+	Workers int
+	// the number of messages of each type queued for a worker before the subscriber blocks
+	IGORequestBufSize  int
+	IGOSampleBufSize   int
+	TEMPOSampleBufSize int
+	// how long in-flight messages are given to finish on shutdown before their writes are cancelled, 0 for no limit
+	DrainTimeout time.Duration
+	// how often staged commits that were abandoned are finished or removed, 0 to disable
+	StagingCleanupInterval time.Duration
+	// how long a staged commit must have gone untouched before it is considered abandoned
+	StagingMaxAge time.Duration
+	// prefix the embargo decisions made for TEMPO samples are recorded under in the TEMPO bucket, empty to disable
+	EmbargoAuditPrefix string
+}
+
+func DefaultSmileServiceOptions() SmileServiceOptions {
+	return SmileServiceOptions{
+		MaxDeliver:             5,
+		NakDelay:               30 * time.Second,
+		Layout:                 OverwriteLayout,
+		Workers:                4,
+		IGORequestBufSize:      1,
+		IGOSampleBufSize:       1,
+		TEMPOSampleBufSize:     1,
+		DrainTimeout:           60 * time.Second,
+		StagingCleanupInterval: 10 * time.Minute,
+		StagingMaxAge:          time.Hour,
+		EmbargoAuditPrefix:     "_audit/embargo/",
+	}
 }
 
 type IGORequestAdapter struct {
 	Requests []SmileRequest
-	Msg      *nm.Msg
+	Msg      *Message
 	SpanCtx  context.Context
 }
 
 type IGOSampleAdapter struct {
 	Samples []SmileSample
-	Msg     *nm.Msg
+	Msg     *Message
 	SpanCtx context.Context
 }
 
+type IGODeletionAdapter struct {
+	Deletion IGODeletion
+	Msg      *Message
+	SpanCtx  context.Context
+}
+
 type TEMPOSampleAdapter struct {
 	Samples []*st.TempoSample
-	Msg     *nm.Msg
+	Msg     *Message
 	SpanCtx context.Context
 }
 
-const (
-	igoRequestBufSize  = 1
-	igoSampleBufSize   = 1
-	tempoSampleBufSize = 1
-)
-
-func NewSmileService(url, certPath, keyPath, consumer, password string, awsS3Service *AWSS3Service) (*SmileService, error) {
-	natsMessaging, err := nm.NewSecureMessaging(url, certPath, keyPath, consumer, password)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create a nats messaging client: %q", err)
-	}
-	return &SmileService{awsS3Service: awsS3Service, natsMessaging: natsMessaging}, nil
+func NewSmileService(messageSource MessageSource, objectStore ObjectStore, options SmileServiceOptions) *SmileService {
+	return &SmileService{objectStore: objectStore, messageSource: messageSource, options: options, started: time.Now()}
 }
 
 const (
@@ -61,7 +106,6 @@ const (
 	newIGOReqS3WriteErrMsg    = "Error writing new IGO request into S3 bucket"
 	newIGOReqS3WriteSucMsg    = "Successfully wrote new IGO request into S3 bucket"
 	succProcessNewIGOReqMsg   = "Successfully processed new IGO request: %s"
-	newIGOSampleS3WriteErrMsg = "Error writing new IGO sample into S3 bucket"
 	newIGOSampleS3WriteSucMsg = "Successfully wrote new IGO sample into S3 bucket"
 	NumSamplesWrittenKey      = "Num Samples Written"
 	updateIGOReqS3WriteMsg    = "Attempting to update an IGO request in an S3 bucket"
@@ -84,89 +128,146 @@ const (
 	succProcessTEMPOUpdatedMsg        = "Successfully processed updated TEMPO Samples"
 	TEMPOSampleNamesKey               = "TEMPO Sample Names"
 	TEMPOSampleNameKey                = "TEMPO Sample Name"
+	TEMPOEmbargoDecisionMsg           = "Checked embargo of TEMPO sample"
+	TEMPOEmbargoRedactErrMsg          = "Error redacting embargoed TEMPO sample from S3 bucket"
+	TEMPOEmbargoAuditErrMsg           = "Error writing TEMPO embargo audit into S3 bucket"
+	TEMPOEmbargoAuditSucMsg           = "Successfully wrote TEMPO embargo audit into S3 bucket"
+	EmbargoActionKey                  = "Embargo Action"
+	EmbargoReasonKey                  = "Embargo Reason"
 
 	errSlackNotifMsg  = "Error sending slack notification"
 	succSlackNotifMsg = "Successfully sent slack notification"
+
+	nakMsg          = "Transient failure, message will be redelivered"
+	termMsg         = "Permanent failure, message will not be redelivered"
+	ErrorClassKey   = "Error Class"
+	NumDeliveredKey = "Num Delivered"
+
+	deadLetterErrMsg     = "Error republishing undecodable message to dead-letter subject"
+	deadLetterSucMsg     = "Republished undecodable message to dead-letter subject"
+	quarantineErrMsg     = "Error quarantining undecodable message"
+	quarantineSucMsg     = "Quarantined undecodable message"
+	DeadLetterSubjectKey = "Dead-Letter Subject"
+	QuarantineKeyKey     = "Quarantine Key"
+
+	skippedUnchangedMsg = "Skipped writing unchanged object"
+
+	commitSucMsg           = "Committed staged objects"
+	abortErrMsg            = "Error removing staged objects"
+	supersededCommitMsg    = "Dropped staged objects, a newer message has already written the request"
+	NumObjectsCommittedKey = "Num Objects Committed"
+	ObjectKeyKey           = "Object Key"
+
+	manifestS3WriteErrMsg = "Error writing request manifest into S3 bucket"
+	manifestS3WriteSucMsg = "Successfully wrote request manifest into S3 bucket"
+
+	deleteIGOS3WriteMsg    = "Attempting to delete IGO samples from an S3 bucket"
+	deleteIGOS3WriteErrMsg = "Error deleting IGO samples from an S3 bucket"
+	deleteIGOS3WriteSucMsg = "Successfully deleted IGO samples from an S3 bucket"
+	sampleTombstoneSucMsg  = "Successfully staged tombstone of deleted IGO sample"
+	requestTombstoneSucMsg = "Successfully staged tombstone of withdrawn IGO request"
+	succProcessedDelIGOMsg = "Successfully processed IGO deletion: %s"
+	NumSamplesDeletedKey   = "Num Samples Deleted"
+	manifestS3ReadErrMsg   = "Error reading request manifest from S3 bucket"
+	droppedSamplesMsg      = "IGO request update dropped samples, they will be deleted"
+	DroppedSamplesKey      = "Dropped Samples"
+	emptySampleListMsg     = "IGO request update lists no samples, its samples are kept"
+	droppedSamplesReason   = "dropped from request update"
+	IGORequestRedactedKey  = "IGO Request Redacted"
 )
 
-func (ss *SmileService) Run(ctx context.Context, consumer, subjectFilter, newIGORequestFilter, updateIGORequestFilter, updateIGOSampleFilter, igoAWSBucket, releaseTEMPOSamplesFilter, updateTEMPOSampleFilter, tempoAWSBucket string, tracer trace.Tracer, slackURL string) error {
-	newIGORequestChan := make(chan IGORequestAdapter, igoRequestBufSize)
-	updateIGORequestChan := make(chan IGORequestAdapter, igoRequestBufSize)
-	updateIGOSampleChan := make(chan IGOSampleAdapter, igoSampleBufSize)
-	releaseTEMPOSamplesChan := make(chan TEMPOSampleAdapter, tempoSampleBufSize)
-	updateTEMPOSamplesChan := make(chan TEMPOSampleAdapter, tempoSampleBufSize)
+func (ss *SmileService) Run(ctx context.Context, consumer, subjectFilter, newIGORequestFilter, updateIGORequestFilter, updateIGOSampleFilter, deleteIGOFilter, igoAWSBucket, releaseTEMPOSamplesFilter, updateTEMPOSampleFilter, tempoAWSBucket string, tracer trace.Tracer, slackURL string) error {
+	// in-flight work outlives ctx so that it can finish during shutdown, its writes are cancelled if the drain times out
+	workCtx, cancelWork := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelWork()
+	// messages about the same request or sample are processed in the order they were received, whatever their flow
+	sequencer := newKeySequencer()
+	newIGORequestPool := newWorkerPool(newIGORequestFlow, ss.options.Workers, ss.options.IGORequestBufSize, sequencer, func(ra IGORequestAdapter) {
+		nrCtx, nrSpan := tracer.Start(ra.SpanCtx, newIGOReqS3WriteMsg)
+		nrSpan.SetAttributes(attribute.String(IGORequestIdKey, ra.Requests[0].IgoRequestID))
+		ss.processNewIGORequest(nrCtx, nrSpan, ra, igoAWSBucket, slackURL)
+	})
+	updateIGORequestPool := newWorkerPool(updateIGORequestFlow, ss.options.Workers, ss.options.IGORequestBufSize, sequencer, func(ra IGORequestAdapter) {
+		urCtx, urSpan := tracer.Start(ra.SpanCtx, updateIGOReqS3WriteMsg)
+		urSpan.SetAttributes(attribute.String(IGORequestIdKey, ra.Requests[0].IgoRequestID))
+		ss.processUpdateIGORequest(urCtx, urSpan, ra, igoAWSBucket, slackURL)
+	})
+	updateIGOSamplePool := newWorkerPool(updateIGOSampleFlow, ss.options.Workers, ss.options.IGOSampleBufSize, sequencer, func(sa IGOSampleAdapter) {
+		usCtx, usSpan := tracer.Start(sa.SpanCtx, updateIGOSampleS3WriteMsg)
+		usSpan.SetAttributes(attribute.String(IGORequestIdKey, sa.Samples[0].AdditionalProperties.IgoRequestID))
+		usSpan.SetAttributes(attribute.String(IGOSampleNameKey, sa.Samples[0].SampleName))
+		ss.processUpdateIGOSample(usCtx, usSpan, sa, igoAWSBucket, slackURL)
+	})
+	deleteIGOPool := newWorkerPool(deleteIGOFlow, ss.options.Workers, ss.options.IGORequestBufSize, sequencer, func(da IGODeletionAdapter) {
+		dCtx, dSpan := tracer.Start(da.SpanCtx, deleteIGOS3WriteMsg)
+		dSpan.SetAttributes(attribute.String(IGORequestIdKey, da.Deletion.IgoRequestID), attribute.Bool(IGORequestRedactedKey, da.Deletion.Redacted))
+		ss.processIGODeletion(dCtx, dSpan, da, igoAWSBucket, slackURL)
+	})
+	releaseTEMPOSamplesPool := newWorkerPool(releaseTEMPOSamplesFlow, ss.options.Workers, ss.options.TEMPOSampleBufSize, sequencer, func(tsa TEMPOSampleAdapter) {
+		tsaCtx, tsaSpan := tracer.Start(tsa.SpanCtx, TEMPOReleasedWriteMsg)
+		ss.processTEMPOSamples(tsaCtx, tsaSpan, tsa, TEMPOReleasedSamplesS3WriteErrMsg, TEMPOReleasedSamplesS3WriteSucMsg, succProcessTEMPOReleasedMsg, tempoAWSBucket, slackURL)
+	})
+	updateTEMPOSamplesPool := newWorkerPool(updateTEMPOSamplesFlow, ss.options.Workers, ss.options.TEMPOSampleBufSize, sequencer, func(tsa TEMPOSampleAdapter) {
+		tsaCtx, tsaSpan := tracer.Start(tsa.SpanCtx, TEMPOUpdatedWriteMsg)
+		ss.processTEMPOSamples(tsaCtx, tsaSpan, tsa, TEMPOUpdatedSamplesS3WriteErrMsg, TEMPOUpdatedSamplesS3WriteSucMsg, succProcessTEMPOUpdatedMsg, tempoAWSBucket, slackURL)
+	})
+	drain := func() {
+		newIGORequestPool.stop()
+		updateIGORequestPool.stop()
+		updateIGOSamplePool.stop()
+		deleteIGOPool.stop()
+		releaseTEMPOSamplesPool.stop()
+		updateTEMPOSamplesPool.stop()
+		newIGORequestPool.wait()
+		updateIGORequestPool.wait()
+		updateIGOSamplePool.wait()
+		deleteIGOPool.wait()
+		releaseTEMPOSamplesPool.wait()
+		updateTEMPOSamplesPool.wait()
+	}
+
 	// a nats consumer can only have one subject filter when created, so we need to have a single event handler
-	err := ss.subscribeToSubjects(ctx, consumer, subjectFilter, newIGORequestChan, updateIGORequestChan, updateIGOSampleChan, newIGORequestFilter, updateIGORequestFilter, updateIGOSampleFilter,
-		releaseTEMPOSamplesChan, updateTEMPOSamplesChan, releaseTEMPOSamplesFilter, updateTEMPOSampleFilter, tracer)
+	err := ss.subscribeToSubjects(workCtx, consumer, subjectFilter, newIGORequestPool, updateIGORequestPool, updateIGOSamplePool, deleteIGOPool, newIGORequestFilter, updateIGORequestFilter, updateIGOSampleFilter, deleteIGOFilter, igoAWSBucket,
+		releaseTEMPOSamplesPool, updateTEMPOSamplesPool, releaseTEMPOSamplesFilter, updateTEMPOSampleFilter, tempoAWSBucket, tracer)
 	if err != nil {
+		drain()
 		return err
 	}
 
-	var nigorwg sync.WaitGroup
-	var uigorwg sync.WaitGroup
-	var uigoswg sync.WaitGroup
-	var trswg sync.WaitGroup
-	var tuswg sync.WaitGroup
-	for {
-		select {
-		case ra := <-newIGORequestChan:
-			nrCtx, nrSpan := tracer.Start(ra.SpanCtx, newIGOReqS3WriteMsg)
-			nrSpan.SetAttributes(attribute.String(IGORequestIdKey, ra.Requests[0].IgoRequestID))
-			nigorwg.Add(1)
-			go ss.processNewIGORequest(nrCtx, nigorwg, nrSpan, ra, igoAWSBucket, slackURL)
-		case ra := <-updateIGORequestChan:
-			urCtx, urSpan := tracer.Start(ra.SpanCtx, updateIGOReqS3WriteMsg)
-			urSpan.SetAttributes(attribute.String(IGORequestIdKey, ra.Requests[0].IgoRequestID))
-			uigorwg.Add(1)
-			go ss.processUpdateIGORequest(urCtx, uigorwg, urSpan, ra, igoAWSBucket, slackURL)
-		case sa := <-updateIGOSampleChan:
-			usCtx, usSpan := tracer.Start(sa.SpanCtx, updateIGOSampleS3WriteMsg)
-			usSpan.SetAttributes(attribute.String(IGORequestIdKey, sa.Samples[0].AdditionalProperties.IgoRequestID))
-			usSpan.SetAttributes(attribute.String(IGOSampleNameKey, sa.Samples[0].SampleName))
-			uigoswg.Add(1)
-			go ss.processUpdateIGOSample(usCtx, uigoswg, usSpan, sa, igoAWSBucket, slackURL)
-		case tsa := <-releaseTEMPOSamplesChan:
-			tsaCtx, tsaSpan := tracer.Start(tsa.SpanCtx, TEMPOReleasedWriteMsg)
-			trswg.Add(1)
-			go ss.processTEMPOSamples(tsaCtx, trswg, tsaSpan, tsa, TEMPOReleasedSamplesS3WriteErrMsg, TEMPOReleasedSamplesS3WriteSucMsg, succProcessTEMPOReleasedMsg, tempoAWSBucket, slackURL)
-		case tsa := <-updateTEMPOSamplesChan:
-			tsaCtx, tsaSpan := tracer.Start(tsa.SpanCtx, TEMPOUpdatedWriteMsg)
-			tuswg.Add(1)
-			go ss.processTEMPOSamples(tsaCtx, tuswg, tsaSpan, tsa, TEMPOUpdatedSamplesS3WriteErrMsg, TEMPOUpdatedSamplesS3WriteSucMsg, succProcessTEMPOUpdatedMsg, tempoAWSBucket, slackURL)
-		case <-ctx.Done():
-			log.Println("Context canceled, returning...")
-			nigorwg.Wait()
-			uigorwg.Wait()
-			uigoswg.Wait()
-			trswg.Wait()
-			tuswg.Wait()
-			ss.natsMessaging.Shutdown()
-			return nil
-		}
+	if ss.options.StagingCleanupInterval > 0 {
+		go ss.cleanupStaging(ctx, igoAWSBucket)
 	}
+
+	<-ctx.Done()
+	log.Println("Context canceled, draining in-flight messages...")
+	if ss.options.DrainTimeout > 0 {
+		drainTimer := time.AfterFunc(ss.options.DrainTimeout, func() {
+			log.Println("Drain timed out, cancelling in-flight writes...")
+			cancelWork()
+		})
+		defer drainTimer.Stop()
+	}
+	// in-flight writes must be finished and acked while the message source is still connected
+	drain()
+	ss.messageSource.Shutdown()
+	log.Println("Drained in-flight messages, returning...")
+	return nil
 }
 
-func (ss *SmileService) processNewIGORequest(nrCtx context.Context, nigorwg sync.WaitGroup, nrSpan trace.Span, ra IGORequestAdapter, igoAWSBucket, slackURL string) {
-	defer nigorwg.Done()
-	filename := fmt.Sprintf("%s_request.json", ra.Requests[0].IgoRequestID)
-	// pull samples out of request and persist them separately
+func (ss *SmileService) processNewIGORequest(nrCtx context.Context, nrSpan trace.Span, ra IGORequestAdapter, igoAWSBucket, slackURL string) {
 	samples := ra.Requests[0].Samples
-	ra.Requests[0].Samples = nil
-	err := ss.awsS3Service.PutRequest(filename, igoAWSBucket, ra.Requests[0])
-	if handleError(err, newIGOReqS3WriteErrMsg, nrSpan) {
+	committed, err := CommitIGORequest(nrCtx, ss.objectStore, igoAWSBucket, ss.options.Layout, ra.Requests[0], ra.Msg)
+	if ss.handleStoreError(err, newIGOReqS3WriteErrMsg, nrSpan, ra.Msg) {
 		return
 	}
-	for _, sample := range samples {
-		filename := fmt.Sprintf("%s_sample.json", sample.PrimaryID)
-		err := ss.awsS3Service.PutIGOSample(filename, igoAWSBucket, sample)
-		if handleError(err, newIGOSampleS3WriteErrMsg, nrSpan) {
-			return
-		}
-		nrSpan.AddEvent(newIGOSampleS3WriteSucMsg, trace.WithAttributes(attribute.String(IGOSampleNameKey, sample.PrimaryID)))
+	if !committed {
+		ss.ackSuperseded(nrSpan, ra.Requests[0].IgoRequestID, ra.Msg)
+		return
 	}
 	nrSpan.SetAttributes(attribute.Int(NumSamplesWrittenKey, len(samples)))
 	nrSpan.AddEvent(newIGOReqS3WriteSucMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, ra.Requests[0].IgoRequestID), attribute.Int(NumSamplesWrittenKey, len(samples))))
-	ra.Msg.ProviderMsg.Ack()
+	messagesWritten.WithLabelValues(ra.Msg.Subject).Inc()
+	ss.ack(ra.Msg)
 	mesg := fmt.Sprintf("{\"text\":\"New IGO request written to Databricks S3 bucket:\n\tRequest Id: %s\"}", ra.Requests[0].IgoRequestID)
 	err = NotifyViaSlack(nrCtx, mesg, slackURL)
 	if handleError(err, errSlackNotifMsg, nrSpan) {
@@ -177,19 +278,102 @@ func (ss *SmileService) processNewIGORequest(nrCtx context.Context, nigorwg sync
 	nrSpan.End()
 }
 
-func (ss *SmileService) processUpdateIGORequest(urCtx context.Context, uigorwg sync.WaitGroup, urSpan trace.Span, ra IGORequestAdapter, igoAWSBucket, slackURL string) {
-	defer uigorwg.Done()
+// CommitIGORequest writes a request with its samples pulled out of it and persisted separately.  The
+// request, its samples and its manifest are staged and committed together, the manifest landing last so that
+// the committed_ tables of the DLT pipeline never show part of a request.  The manifest lists the samples of
+// request and only those.  It reports whether the request was written, it is not when a message newer than
+// msg has since written it.  Events are recorded on the span of ctx.
+func CommitIGORequest(ctx context.Context, store ObjectStore, bucketName string, layout Layout, request SmileRequest, msg *Message) (bool, error) {
+	span := trace.SpanFromContext(ctx)
+	samples := request.Samples
+	request.Samples = nil
+	commit := NewStagedCommit(store, bucketName, request.IgoRequestID, msg)
+	requestKey, err := layout.RequestKey(request, msg)
+	if err != nil {
+		return false, err
+	}
+	requestResult, err := StageRequest(ctx, commit, requestKey, request)
+	if err != nil {
+		return false, abortCommit(ctx, commit, err)
+	}
+	addSkippedEvent(span, requestResult)
+	sampleResults := make([]PutResult, 0, len(samples))
+	for _, sample := range samples {
+		sampleKey, err := layout.IGOSampleKey(sample, msg)
+		if err != nil {
+			return false, abortCommit(ctx, commit, err)
+		}
+		result, err := StageIGOSample(ctx, commit, sampleKey, sample)
+		if err != nil {
+			return false, abortCommit(ctx, commit, err)
+		}
+		addSkippedEvent(span, result)
+		sampleResults = append(sampleResults, result)
+		span.AddEvent(newIGOSampleS3WriteSucMsg, trace.WithAttributes(attribute.String(IGOSampleNameKey, sample.PrimaryID)))
+	}
+	// the manifest is staged last so that it lands after the objects it lists
+	result, err := StageManifest(ctx, commit, layout.ManifestKey(request.IgoRequestID), request.IgoRequestID, msg, func(m *RequestManifest) {
+		m.setRequest(requestResult)
+		m.Samples = []ManifestSample{}
+		for i, sample := range samples {
+			m.setSample(sample.PrimaryID, sampleResults[i])
+		}
+	})
+	if err != nil {
+		return false, abortCommit(ctx, commit, err)
+	}
+	addSkippedEvent(span, result)
+	// a commit that fails part way is finished by its redelivery, or by the staging cleanup
+	committed, err := commit.Commit(ctx)
+	if err != nil || !committed {
+		return false, err
+	}
+	span.AddEvent(commitSucMsg, trace.WithAttributes(attribute.Int(NumObjectsCommittedKey, len(commit.objects))))
+	return true, nil
+}
+
+// ackSuperseded settles a message whose commit was dropped because a newer message had already written its
+// request, nothing was written so nothing is notified
+func (ss *SmileService) ackSuperseded(span trace.Span, igoRequestID string, msg *Message) {
+	span.AddEvent(supersededCommitMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, igoRequestID)))
+	ss.ack(msg)
+	span.SetStatus(codes.Ok, supersededCommitMsg)
+	span.End()
+}
+
+// abortCommit removes what was staged for commit before err, objects left behind are removed by the staging cleanup
+func abortCommit(ctx context.Context, commit *StagedCommit, err error) error {
+	if abortErr := commit.Abort(ctx); abortErr != nil {
+		trace.SpanFromContext(ctx).AddEvent(fmt.Sprintf("%s: %v", abortErrMsg, abortErr))
+	}
+	return err
+}
+
+func (ss *SmileService) processUpdateIGORequest(urCtx context.Context, urSpan trace.Span, ra IGORequestAdapter, igoAWSBucket, slackURL string) {
 	// last request is most recently updated
 	indLast := len(ra.Requests) - 1
-	filename := fmt.Sprintf("%s_request.json", ra.Requests[indLast].IgoRequestID)
-	err := ss.awsS3Service.PutRequest(filename, igoAWSBucket, ra.Requests[indLast])
-	if handleError(err, upIGOReqS3WriteErrMsg, urSpan) {
+	if ss.deleteDroppedSamples(urCtx, urSpan, ra.Requests[indLast], igoAWSBucket, ra.Msg) {
 		return
 	}
-	urSpan.AddEvent(upIGOReqS3WriteSucMsg)
-	ra.Msg.ProviderMsg.Ack()
+	if len(ra.Requests[indLast].Samples) > 0 {
+		// samples carried by an update are split out of the request as they are for a new request
+		committed, err := CommitIGORequest(urCtx, ss.objectStore, igoAWSBucket, ss.options.Layout, ra.Requests[indLast], ra.Msg)
+		if ss.handleStoreError(err, upIGOReqS3WriteErrMsg, urSpan, ra.Msg) {
+			return
+		}
+		if !committed {
+			ss.ackSuperseded(urSpan, ra.Requests[indLast].IgoRequestID, ra.Msg)
+			return
+		}
+		urSpan.SetAttributes(attribute.Int(NumSamplesWrittenKey, len(ra.Requests[indLast].Samples)))
+		urSpan.AddEvent(upIGOReqS3WriteSucMsg)
+	} else if ss.updateIGORequest(urCtx, urSpan, ra.Requests[indLast], igoAWSBucket, ra.Msg) {
+		return
+	}
+	messagesWritten.WithLabelValues(ra.Msg.Subject).Inc()
+	ss.ack(ra.Msg)
 	mesg := fmt.Sprintf("{\"text\":\"Updated IGO request written to Databricks S3 bucket:\n\tRequest Id: %s\"}", ra.Requests[indLast].IgoRequestID)
-	err = NotifyViaSlack(urCtx, mesg, slackURL)
+	err := NotifyViaSlack(urCtx, mesg, slackURL)
 	if handleError(err, errSlackNotifMsg, urSpan) {
 		return
 	}
@@ -198,17 +382,82 @@ func (ss *SmileService) processUpdateIGORequest(urCtx context.Context, uigorwg s
 	urSpan.End()
 }
 
-func (ss *SmileService) processUpdateIGOSample(usCtx context.Context, uigoswg sync.WaitGroup, usSpan trace.Span, sa IGOSampleAdapter, igoAWSBucket, slackURL string) {
-	defer uigoswg.Done()
+// updateIGORequest writes a request that carries no samples and records it in the manifest, it returns true
+// if msg was settled because of an error
+func (ss *SmileService) updateIGORequest(ctx context.Context, span trace.Span, request SmileRequest, igoAWSBucket string, msg *Message) bool {
+	filename, err := ss.options.Layout.RequestKey(request, msg)
+	if ss.handleStoreError(err, upIGOReqS3WriteErrMsg, span, msg) {
+		return true
+	}
+	result, err := PutRequest(ctx, ss.objectStore, filename, igoAWSBucket, request)
+	if ss.handleStoreError(err, upIGOReqS3WriteErrMsg, span, msg) {
+		return true
+	}
+	addSkippedEvent(span, result)
+	span.AddEvent(upIGOReqS3WriteSucMsg)
+	requestResult := result
+	result, err = UpdateManifest(ctx, ss.objectStore, ss.options.Layout.ManifestKey(request.IgoRequestID), igoAWSBucket, request.IgoRequestID, msg, func(m *RequestManifest) {
+		m.setRequest(requestResult)
+	})
+	if ss.handleStoreError(err, manifestS3WriteErrMsg, span, msg) {
+		return true
+	}
+	addSkippedEvent(span, result)
+	span.AddEvent(manifestS3WriteSucMsg)
+	return false
+}
+
+// deleteDroppedSamples replaces the samples an updated request no longer lists with tombstones, it returns
+// true if msg was settled because of an error
+func (ss *SmileService) deleteDroppedSamples(ctx context.Context, span trace.Span, request SmileRequest, igoAWSBucket string, msg *Message) bool {
+	// an empty sample list is taken for a metadata only update rather than the removal of every sample
+	if request.Samples != nil && len(request.Samples) == 0 {
+		span.AddEvent(emptySampleListMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, request.IgoRequestID)))
+	}
+	dropped, err := droppedPrimaryIDs(ctx, ss.objectStore, igoAWSBucket, ss.options.Layout.ManifestKey(request.IgoRequestID), request)
+	if ss.handleStoreError(err, manifestS3ReadErrMsg, span, msg) {
+		return true
+	}
+	if len(dropped) == 0 {
+		return false
+	}
+	span.AddEvent(droppedSamplesMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, request.IgoRequestID), attribute.StringSlice(DroppedSamplesKey, dropped)))
+	deletion := IGODeletion{IgoRequestID: request.IgoRequestID, PrimaryIDs: dropped, Reason: droppedSamplesReason}
+	numDeleted, err := CommitIGODeletion(ctx, ss.objectStore, igoAWSBucket, ss.options.Layout, deletion, msg)
+	if ss.handleStoreError(err, deleteIGOS3WriteErrMsg, span, msg) {
+		return true
+	}
+	span.AddEvent(deleteIGOS3WriteSucMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, request.IgoRequestID), attribute.Int(NumSamplesDeletedKey, numDeleted)))
+	return false
+}
+
+func (ss *SmileService) processUpdateIGOSample(usCtx context.Context, usSpan trace.Span, sa IGOSampleAdapter, igoAWSBucket, slackURL string) {
 	// last sample is most recently updated
 	indLast := len(sa.Samples) - 1
-	filename := fmt.Sprintf("%s_sample.json", sa.Samples[indLast].PrimaryID)
-	err := ss.awsS3Service.PutIGOSample(filename, igoAWSBucket, sa.Samples[indLast])
-	if handleError(err, upIGOSampleS3WriteErrMsg, usSpan) {
+	filename, err := ss.options.Layout.IGOSampleKey(sa.Samples[indLast], sa.Msg)
+	if ss.handleStoreError(err, upIGOSampleS3WriteErrMsg, usSpan, sa.Msg) {
 		return
 	}
+	result, err := PutIGOSample(usCtx, ss.objectStore, filename, igoAWSBucket, sa.Samples[indLast])
+	if ss.handleStoreError(err, upIGOSampleS3WriteErrMsg, usSpan, sa.Msg) {
+		return
+	}
+	addSkippedEvent(usSpan, result)
 	usSpan.AddEvent(upIGOSampleS3WriteSucMsg)
-	sa.Msg.ProviderMsg.Ack()
+	// a sample that does not name its request cannot be added to a manifest
+	if igoRequestID := sa.Samples[indLast].AdditionalProperties.IgoRequestID; igoRequestID != "" {
+		sampleResult := result
+		result, err = UpdateManifest(usCtx, ss.objectStore, ss.options.Layout.ManifestKey(igoRequestID), igoAWSBucket, igoRequestID, sa.Msg, func(m *RequestManifest) {
+			m.setSample(sa.Samples[indLast].PrimaryID, sampleResult)
+		})
+		if ss.handleStoreError(err, manifestS3WriteErrMsg, usSpan, sa.Msg) {
+			return
+		}
+		addSkippedEvent(usSpan, result)
+		usSpan.AddEvent(manifestS3WriteSucMsg)
+	}
+	messagesWritten.WithLabelValues(sa.Msg.Subject).Inc()
+	ss.ack(sa.Msg)
 	mesg := fmt.Sprintf("{\"text\":\"Updated IGO sample written to Databricks S3 bucket:\n\tSample Name: %s\"}", sa.Samples[indLast].PrimaryID)
 	err = NotifyViaSlack(usCtx, mesg, slackURL)
 	if handleError(err, errSlackNotifMsg, usSpan) {
@@ -219,20 +468,74 @@ func (ss *SmileService) processUpdateIGOSample(usCtx context.Context, uigoswg sy
 	usSpan.End()
 }
 
-func (ss *SmileService) processTEMPOSamples(tsaCtx context.Context, tsawg sync.WaitGroup, tsaSpan trace.Span, tsa TEMPOSampleAdapter, samplePutErrMsg, samplePutSucMsg, sucProcessMsg, tempoAWSBucket, slackURL string) {
-	defer tsawg.Done()
+func (ss *SmileService) processIGODeletion(dCtx context.Context, dSpan trace.Span, da IGODeletionAdapter, igoAWSBucket, slackURL string) {
+	numDeleted, err := CommitIGODeletion(dCtx, ss.objectStore, igoAWSBucket, ss.options.Layout, da.Deletion, da.Msg)
+	if ss.handleStoreError(err, deleteIGOS3WriteErrMsg, dSpan, da.Msg) {
+		return
+	}
+	dSpan.SetAttributes(attribute.Int(NumSamplesDeletedKey, numDeleted))
+	dSpan.AddEvent(deleteIGOS3WriteSucMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, da.Deletion.IgoRequestID), attribute.Int(NumSamplesDeletedKey, numDeleted)))
+	messagesWritten.WithLabelValues(da.Msg.Subject).Inc()
+	ss.ack(da.Msg)
+	mesg := fmt.Sprintf("{\"text\":\"IGO samples deleted from Databricks S3 bucket:\n\tRequest Id: %s\n\tSamples: %s\"}", da.Deletion.IgoRequestID, da.Deletion.PrimaryIDs)
+	if da.Deletion.Redacted {
+		mesg = fmt.Sprintf("{\"text\":\"IGO request withdrawn from Databricks S3 bucket:\n\tRequest Id: %s\"}", da.Deletion.IgoRequestID)
+	}
+	err = NotifyViaSlack(dCtx, mesg, slackURL)
+	if handleError(err, errSlackNotifMsg, dSpan) {
+		return
+	}
+	dSpan.AddEvent(succSlackNotifMsg)
+	dSpan.SetStatus(codes.Ok, fmt.Sprintf(succProcessedDelIGOMsg, da.Deletion.IgoRequestID))
+	dSpan.End()
+}
+
+func (ss *SmileService) processTEMPOSamples(tsaCtx context.Context, tsaSpan trace.Span, tsa TEMPOSampleAdapter, samplePutErrMsg, samplePutSucMsg, sucProcessMsg, tempoAWSBucket, slackURL string) {
+	decisions := make([]EmbargoDecision, 0, len(tsa.Samples))
+	numWritten := 0
 	for _, sample := range tsa.Samples {
-		filename := fmt.Sprintf("%s_clinical.json", sample.PrimaryId)
-		err := ss.awsS3Service.PutTEMPOSample(filename, tempoAWSBucket, *sample)
-		if handleError(err, samplePutErrMsg, tsaSpan) {
+		decision := EmbargoDecision{PrimaryID: sample.PrimaryId, AccessLevel: sample.AccessLevel, EmbargoDate: sample.EmbargoDate}
+		embargoed, reason := underEmbargo(sample, time.Now())
+		decision.Reason = reason
+		if embargoed {
+			// embargoed clinical data must never reach Databricks, whatever the subject it arrived on
+			removed, err := RedactTEMPOSample(tsaCtx, ss.objectStore, tempoAWSBucket, ss.options.Layout, sample, reason, tsa.Msg)
+			if ss.handleStoreError(err, TEMPOEmbargoRedactErrMsg, tsaSpan, tsa.Msg) {
+				return
+			}
+			decision.Action, decision.RemovedKeys = WithheldSample, removed
+			if len(removed) != 0 {
+				decision.Action = RedactedSample
+			}
+		} else {
+			result, err := WriteTEMPOSample(tsaCtx, ss.objectStore, tempoAWSBucket, ss.options.Layout, sample, tsa.Msg)
+			if ss.handleStoreError(err, samplePutErrMsg, tsaSpan, tsa.Msg) {
+				return
+			}
+			addSkippedEvent(tsaSpan, result)
+			tsaSpan.AddEvent(samplePutSucMsg, trace.WithAttributes(attribute.String(TEMPOSampleNameKey, sample.PrimaryId)))
+			decision.Action = ReleasedSample
+			numWritten++
+		}
+		tsaSpan.AddEvent(TEMPOEmbargoDecisionMsg, trace.WithAttributes(attribute.String(TEMPOSampleNameKey, sample.PrimaryId),
+			attribute.String(EmbargoActionKey, string(decision.Action)), attribute.String(EmbargoReasonKey, decision.Reason)))
+		decisions = append(decisions, decision)
+	}
+	if ss.options.EmbargoAuditPrefix != "" {
+		key, err := WriteEmbargoAudit(tsaCtx, ss.objectStore, ss.options.EmbargoAuditPrefix, tempoAWSBucket, tsa.Msg, decisions)
+		if ss.handleStoreError(err, TEMPOEmbargoAuditErrMsg, tsaSpan, tsa.Msg) {
 			return
 		}
-		tsaSpan.AddEvent(samplePutSucMsg, trace.WithAttributes(attribute.String(TEMPOSampleNameKey, sample.PrimaryId)))
+		tsaSpan.AddEvent(TEMPOEmbargoAuditSucMsg, trace.WithAttributes(attribute.String(ObjectKeyKey, key)))
+	}
+	// decisions are only counted once they have been carried out and audited
+	for _, decision := range decisions {
+		embargoDecisions.WithLabelValues(string(decision.Action)).Inc()
 	}
-	tsaSpan.SetAttributes(attribute.Int(NumSamplesWrittenKey, len(tsa.Samples)))
-	tsa.Msg.ProviderMsg.Ack()
-	mesg := fmt.Sprintf("{\"text\":\"TEMPO samples written to Databricks S3 bucket:\n\t%s: %s\"}", TEMPOSampleNamesKey, tsa.Samples)
-	err := NotifyViaSlack(tsaCtx, mesg, slackURL)
+	tsaSpan.SetAttributes(attribute.Int(NumSamplesWrittenKey, numWritten))
+	messagesWritten.WithLabelValues(tsa.Msg.Subject).Inc()
+	ss.ack(tsa.Msg)
+	err := NotifyViaSlack(tsaCtx, tempoSlackMessage(decisions), slackURL)
 	if handleError(err, errSlackNotifMsg, tsaSpan) {
 		return
 	}
@@ -241,6 +544,25 @@ func (ss *SmileService) processTEMPOSamples(tsaCtx context.Context, tsawg sync.W
 	tsaSpan.End()
 }
 
+// tempoSlackMessage names the TEMPO samples that were written, samples under embargo are only counted so that
+// nothing about them reaches Slack
+func tempoSlackMessage(decisions []EmbargoDecision) string {
+	released := make([]string, 0, len(decisions))
+	numWithheld, numRedacted := 0, 0
+	for _, decision := range decisions {
+		switch decision.Action {
+		case ReleasedSample:
+			released = append(released, decision.PrimaryID)
+		case WithheldSample:
+			numWithheld++
+		case RedactedSample:
+			numRedacted++
+		}
+	}
+	return fmt.Sprintf("{\"text\":\"TEMPO samples written to Databricks S3 bucket:\n\t%s: %s\n\tSamples withheld under embargo: %d\n\tSamples redacted under embargo: %d\"}",
+		TEMPOSampleNamesKey, strings.Join(released, ", "), numWithheld, numRedacted)
+}
+
 const (
 	incomingNewReqMsg      = "Received new request"
 	processingNewReqErrMsg = "Error unmarshaling new request"
@@ -257,6 +579,11 @@ const (
 	handingOffRequestToRunLoopMsg = "Handing off request for writing to S3 bucket connected to Databricks"
 	handingOffSampleToRunLoopMsg  = "Handing off sample for writing to an S3 bucket connected to Databricks"
 
+	incomingDelMsg                 = "Received sample deletion or request redaction"
+	processingDelErrMsg            = "Error unmarshaling sample deletion or request redaction"
+	processingDelSucMsg            = "Successfully unmarshaled sample deletion or request redaction"
+	handingOffDeletionToRunLoopMsg = "Handing off deletion for writing to an S3 bucket connected to Databricks"
+
 	incomingReleaseTEMPOSamplesMsg      = "Received release TEMPO samples message"
 	processingReleaseTEMPOSamplesErrMsg = "Error unmarshaling release TEMPO samples message"
 	processingReleaseTEMPOSamplesSucMsg = "Successfully unmarshaled release TEMPO samples message"
@@ -268,68 +595,148 @@ const (
 	handingOffTEMPOSamplesToRunLoopMsg = "Handing off TEMPO samples for writing to S3 bucket connected to Databricks"
 )
 
-func (ss *SmileService) subscribeToSubjects(ctx context.Context, consumer, subjectFilter string, newRequestCh, upRequestCh chan IGORequestAdapter, upSampleCh chan IGOSampleAdapter, newRequestFilter, updateRequestFilter, updateSampleFilter string,
-	releaseTEMPOSamplesCh, updateTEMPOSampleCh chan TEMPOSampleAdapter, releaseTEMPOSamplesFilter, updateTEMPOSampleFilter string, tracer trace.Tracer) error {
-	err := ss.natsMessaging.Subscribe(consumer, subjectFilter, func(m *nm.Msg) {
+func (ss *SmileService) subscribeToSubjects(ctx context.Context, consumer, subjectFilter string, newRequestPool, upRequestPool *workerPool[IGORequestAdapter], upSamplePool *workerPool[IGOSampleAdapter], deletePool *workerPool[IGODeletionAdapter], newRequestFilter, updateRequestFilter, updateSampleFilter, deleteFilter, igoAWSBucket string,
+	releaseTEMPOSamplesPool, updateTEMPOSamplePool *workerPool[TEMPOSampleAdapter], releaseTEMPOSamplesFilter, updateTEMPOSampleFilter, tempoAWSBucket string, tracer trace.Tracer) error {
+	err := ss.messageSource.Subscribe(consumer, subjectFilter, func(m *Message) {
+		messagesReceived.WithLabelValues(m.Subject).Inc()
 		switch {
 		case m.Subject == newRequestFilter:
 			subscribeCtx, nrSpan := tracer.Start(ctx, incomingNewReqMsg)
 			nr, err := unMarshal[SmileRequest](string(m.Data))
-			if handleError(err, processingNewReqErrMsg, nrSpan) {
+			if ss.handleDecodeError(subscribeCtx, err, processingNewReqErrMsg, nrSpan, m, igoAWSBucket) {
 				break
 			}
+			messagesDecoded.WithLabelValues(m.Subject).Inc()
 			nrSpan.AddEvent(processingNewReqSucMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, nr.IgoRequestID)))
 			nrSpan.AddEvent(handingOffRequestToRunLoopMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, nr.IgoRequestID)))
 			nrSpan.End()
-			newRequestCh <- IGORequestAdapter{[]SmileRequest{nr}, m, subscribeCtx}
+			ss.handOff(newRequestPool.submit(newIGORequestKeys(nr), IGORequestAdapter{[]SmileRequest{nr}, m, subscribeCtx}), m)
 		case m.Subject == updateRequestFilter:
 			subscribeCtx, urSpan := tracer.Start(ctx, incomingUpReqMsg)
 			ru, err := unMarshal[[]SmileRequest](string(m.Data))
-			if handleError(err, processingUpReqErrMsg, urSpan) {
+			if err == nil && len(ru) == 0 {
+				err = errors.New("request update carries no requests")
+			}
+			if ss.handleDecodeError(subscribeCtx, err, processingUpReqErrMsg, urSpan, m, igoAWSBucket) {
 				break
 			}
+			messagesDecoded.WithLabelValues(m.Subject).Inc()
 			urSpan.AddEvent(processingUpReqSucMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, ru[0].IgoRequestID)))
 			urSpan.AddEvent(handingOffRequestToRunLoopMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, ru[0].IgoRequestID)))
 			urSpan.End()
-			upRequestCh <- IGORequestAdapter{ru, m, subscribeCtx}
+			ss.handOff(upRequestPool.submit(updateIGORequestKeys(ru), IGORequestAdapter{ru, m, subscribeCtx}), m)
 		case m.Subject == updateSampleFilter:
 			subscribeCtx, usSpan := tracer.Start(ctx, incomingUpSampMsg)
 			su, err := unMarshal[[]SmileSample](string(m.Data))
-			if handleError(err, processingUpSampErrMsg, usSpan) {
+			if err == nil && len(su) == 0 {
+				err = errors.New("sample update carries no samples")
+			}
+			if ss.handleDecodeError(subscribeCtx, err, processingUpSampErrMsg, usSpan, m, igoAWSBucket) {
 				break
 			}
+			messagesDecoded.WithLabelValues(m.Subject).Inc()
 			usSpan.AddEvent(processingUpSampSucMsg, trace.WithAttributes(attribute.String(IGOSampleNameKey, su[0].SampleName)))
 			usSpan.AddEvent(handingOffSampleToRunLoopMsg, trace.WithAttributes(attribute.String(IGOSampleNameKey, su[0].SampleName)))
 			usSpan.End()
-			upSampleCh <- IGOSampleAdapter{su, m, subscribeCtx}
+			ss.handOff(upSamplePool.submit(updateIGOSampleKeys(su), IGOSampleAdapter{su, m, subscribeCtx}), m)
+		case m.Subject == deleteFilter:
+			subscribeCtx, dSpan := tracer.Start(ctx, incomingDelMsg)
+			d, err := unMarshal[IGODeletion](string(m.Data))
+			if err == nil && d.IgoRequestID == "" {
+				err = errors.New("deletion does not name an IGO request")
+			}
+			if ss.handleDecodeError(subscribeCtx, err, processingDelErrMsg, dSpan, m, igoAWSBucket) {
+				break
+			}
+			messagesDecoded.WithLabelValues(m.Subject).Inc()
+			dSpan.AddEvent(processingDelSucMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, d.IgoRequestID)))
+			dSpan.AddEvent(handingOffDeletionToRunLoopMsg, trace.WithAttributes(attribute.String(IGORequestIdKey, d.IgoRequestID)))
+			dSpan.End()
+			ss.handOff(deletePool.submit(igoDeletionKeys(d), IGODeletionAdapter{d, m, subscribeCtx}), m)
 		case m.Subject == releaseTEMPOSamplesFilter:
 			subscribeCtx, rtsSpan := tracer.Start(ctx, incomingReleaseTEMPOSamplesMsg)
 			tempoSamples, err := protoUnMarshal(m.Data)
-			if handleError(err, processingReleaseTEMPOSamplesErrMsg, rtsSpan) {
+			if ss.handleDecodeError(subscribeCtx, err, processingReleaseTEMPOSamplesErrMsg, rtsSpan, m, tempoAWSBucket) {
 				break
 			}
+			messagesDecoded.WithLabelValues(m.Subject).Inc()
 			rtsSpan.AddEvent(processingReleaseTEMPOSamplesSucMsg, trace.WithAttributes(attribute.String(TEMPOSampleNamesKey, buildStringFromTEMPOSamples(tempoSamples))))
 			rtsSpan.AddEvent(handingOffTEMPOSamplesToRunLoopMsg, trace.WithAttributes(attribute.String(TEMPOSampleNamesKey, buildStringFromTEMPOSamples(tempoSamples))))
 			rtsSpan.End()
-			releaseTEMPOSamplesCh <- TEMPOSampleAdapter{tempoSamples, m, subscribeCtx}
+			ss.handOff(releaseTEMPOSamplesPool.submit(tempoSampleKeys(tempoSamples), TEMPOSampleAdapter{tempoSamples, m, subscribeCtx}), m)
 		case m.Subject == updateTEMPOSampleFilter:
 			subscribeCtx, utsSpan := tracer.Start(ctx, incomingUpTEMPOSamplesMsg)
 			tempoSamples, err := protoUnMarshal(m.Data)
-			if handleError(err, processingUpTEMPOSamplesErrMsg, utsSpan) {
+			if ss.handleDecodeError(subscribeCtx, err, processingUpTEMPOSamplesErrMsg, utsSpan, m, tempoAWSBucket) {
 				break
 			}
+			messagesDecoded.WithLabelValues(m.Subject).Inc()
 			utsSpan.AddEvent(processingUpTEMPOSamplesSucMsg, trace.WithAttributes(attribute.String(TEMPOSampleNamesKey, buildStringFromTEMPOSamples(tempoSamples))))
 			utsSpan.AddEvent(handingOffTEMPOSamplesToRunLoopMsg, trace.WithAttributes(attribute.String(TEMPOSampleNamesKey, buildStringFromTEMPOSamples(tempoSamples))))
 			utsSpan.End()
-			updateTEMPOSampleCh <- TEMPOSampleAdapter{tempoSamples, m, subscribeCtx}
+			ss.handOff(updateTEMPOSamplePool.submit(tempoSampleKeys(tempoSamples), TEMPOSampleAdapter{tempoSamples, m, subscribeCtx}), m)
 		default:
 			// not interested in message, Ack it so we don't get it again
-			m.ProviderMsg.Ack()
+			ss.ack(m)
 		}
 	})
 	return err
 }
 
+// handOff naks a message that arrived after shutdown began so that it is redelivered once the gateway restarts
+func (ss *SmileService) handOff(submitted bool, m *Message) {
+	if !submitted {
+		m.NakWithDelay(ss.options.NakDelay)
+	}
+}
+
+// the entity keys messages are ordered by, see keySequencer
+func newIGORequestKeys(request SmileRequest) []string {
+	keys := igoSampleKeys(request.Samples)
+	return append(keys, "request:"+request.IgoRequestID)
+}
+
+func igoRequestKeys(requests []SmileRequest) []string {
+	keys := make([]string, 0, len(requests))
+	for _, request := range requests {
+		keys = append(keys, "request:"+request.IgoRequestID)
+	}
+	return keys
+}
+
+// request updates also write the samples the latest request carries
+func updateIGORequestKeys(requests []SmileRequest) []string {
+	keys := igoRequestKeys(requests)
+	return append(keys, igoSampleKeys(requests[len(requests)-1].Samples)...)
+}
+
+func igoSampleKeys(samples []SmileSample) []string {
+	keys := make([]string, 0, len(samples))
+	for _, sample := range samples {
+		keys = append(keys, "sample:"+sample.PrimaryID)
+	}
+	return keys
+}
+
+// sample updates also change the manifest of the request they belong to
+func updateIGOSampleKeys(samples []SmileSample) []string {
+	keys := igoSampleKeys(samples)
+	for _, sample := range samples {
+		if igoRequestID := sample.AdditionalProperties.IgoRequestID; igoRequestID != "" {
+			keys = append(keys, "request:"+igoRequestID)
+		}
+	}
+	return keys
+}
+
+func tempoSampleKeys(tempoSamples []*st.TempoSample) []string {
+	keys := make([]string, 0, len(tempoSamples))
+	for _, tempoSample := range tempoSamples {
+		keys = append(keys, "tempo:"+tempoSample.PrimaryId)
+	}
+	return keys
+}
+
 func buildStringFromTEMPOSamples(tempoSamples []*st.TempoSample) string {
 	var builder strings.Builder
 	for lc, tempoSample := range tempoSamples {
@@ -361,6 +768,87 @@ func protoUnMarshal(data []byte) ([]*st.TempoSample, error) {
 	return tempoSamples.TempoSamples, nil
 }
 
+// handleStoreError settles msg according to the class of a storage error: transient failures are
+// naked for delayed redelivery until MaxDeliver is reached, permanent failures are terminated
+func (ss *SmileService) handleStoreError(err error, message string, span trace.Span, msg *Message) bool {
+	if err == nil {
+		return false
+	}
+	ss.settle(msg, ClassifyError(err), span)
+	return handleError(err, message, span)
+}
+
+// handleDecodeError records a message that cannot be decoded on the dead-letter subject and under the
+// quarantine prefix of bucketName (when configured) and terminates it.  If it could not be recorded
+// the message is naked so that it is not lost.
+func (ss *SmileService) handleDecodeError(ctx context.Context, err error, message string, span trace.Span, msg *Message, bucketName string) bool {
+	if err == nil {
+		return false
+	}
+	class := PermanentError
+	if ss.options.DeadLetterSubject != "" {
+		if dlErr := ss.messageSource.PublishMessage(ss.options.DeadLetterSubject, msg.Data, deadLetterHeader(msg, err)); dlErr != nil {
+			span.AddEvent(fmt.Sprintf("%s: %v", deadLetterErrMsg, dlErr))
+			class = TransientError
+		} else {
+			span.AddEvent(deadLetterSucMsg, trace.WithAttributes(attribute.String(DeadLetterSubjectKey, ss.options.DeadLetterSubject)))
+		}
+	}
+	if ss.options.QuarantinePrefix != "" {
+		if key, qErr := QuarantineMessage(ctx, ss.objectStore, ss.options.QuarantinePrefix, bucketName, msg, err); qErr != nil {
+			span.AddEvent(fmt.Sprintf("%s: %v", quarantineErrMsg, qErr))
+			class = TransientError
+		} else {
+			span.AddEvent(quarantineSucMsg, trace.WithAttributes(attribute.String(QuarantineKeyKey, key)))
+		}
+	}
+	ss.settle(msg, class, span)
+	return handleError(err, message, span)
+}
+
+// settle naks msg for delayed redelivery after a transient failure until MaxDeliver is reached,
+// otherwise it is terminated
+func (ss *SmileService) settle(msg *Message, class ErrorClass, span trace.Span) {
+	messagesFailed.WithLabelValues(msg.Subject, class.String()).Inc()
+	attrs := trace.WithAttributes(attribute.String(ErrorClassKey, class.String()), attribute.Int64(NumDeliveredKey, int64(msg.NumDelivered)))
+	if class == TransientError && (ss.options.MaxDeliver <= 0 || msg.NumDelivered < uint64(ss.options.MaxDeliver)) {
+		span.AddEvent(nakMsg, attrs)
+		msg.NakWithDelay(ss.options.NakDelay)
+		return
+	}
+	span.AddEvent(termMsg, attrs)
+	msg.Term()
+}
+
+func (ss *SmileService) ack(msg *Message) {
+	messagesAcked.WithLabelValues(msg.Subject).Inc()
+	ss.lastAck.Store(time.Now().UnixNano())
+	msg.Ack()
+}
+
+// LastMessageHealthCheck reports how long ago a message was last processed successfully.  SMILE can
+// be quiet for long periods so it never fails, it is there for whoever is looking into an incident.
+func (ss *SmileService) LastMessageHealthCheck() HealthCheck {
+	return HealthCheck{
+		Name:     "last message",
+		Liveness: true,
+		Check: func(ctx context.Context) (string, error) {
+			lastAck := ss.lastAck.Load()
+			if lastAck == 0 {
+				return fmt.Sprintf("no message processed since start %s", formatAge(ss.started)), nil
+			}
+			return fmt.Sprintf("last message processed %s", formatAge(time.Unix(0, lastAck))), nil
+		},
+	}
+}
+
+// addSkippedEvent records on span that a write was skipped because the stored object was already up to date
+func addSkippedEvent(span trace.Span, result PutResult) {
+	if result.Skipped {
+		span.AddEvent(skippedUnchangedMsg, trace.WithAttributes(attribute.String(ObjectKeyKey, result.Key)))
+	}
+}
+
 func handleError(err error, message string, span trace.Span) bool {
 	if err != nil {
 		msg := fmt.Sprintf("%s: %v", message, err)
@@ -371,3 +859,25 @@ func handleError(err error, message string, span trace.Span) bool {
 	}
 	return false
 }
+
+// cleanupStaging finishes or removes abandoned staged commits in bucketName until ctx is done
+func (ss *SmileService) cleanupStaging(ctx context.Context, bucketName string) {
+	ticker := time.NewTicker(ss.options.StagingCleanupInterval)
+	defer ticker.Stop()
+	for {
+		cleanup, err := CleanupStaging(ctx, ss.objectStore, bucketName, ss.options.StagingMaxAge)
+		if err != nil {
+			log.Printf("Error cleaning up staging in %s: %v\n", bucketName, err)
+		}
+		stagedCommitsCleanedUp.WithLabelValues(finishedAction).Add(float64(cleanup.Finished))
+		stagedCommitsCleanedUp.WithLabelValues(removedAction).Add(float64(cleanup.Removed))
+		if cleanup.Finished != 0 || cleanup.Removed != 0 {
+			log.Printf("Cleaned up staging in %s: finished %d and removed %d abandoned commits\n", bucketName, cleanup.Finished, cleanup.Removed)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,1066 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	st "github.mskcc.org/cdsi/cdsi-protobuf/smile/generated/v1/go"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	testConsumer               = "smile-databricks-gateway-test"
+	testSubjectFilter          = "MDB_STREAM.server-gateway.>"
+	testNewRequestFilter       = "MDB_STREAM.server-gateway.igo-new-request"
+	testUpdateRequestFilter    = "MDB_STREAM.server-gateway.igo-update-request"
+	testUpdateSampleFilter     = "MDB_STREAM.server-gateway.igo-update-sample"
+	testDeleteFilter           = "MDB_STREAM.server-gateway.igo-delete"
+	testReleaseTEMPOFilter     = "MDB_STREAM.server-gateway.tempo-release-samples"
+	testUpdateTEMPOFilter      = "MDB_STREAM.server-gateway.tempo-update-sample-embargo"
+	testIGOBucket              = "igo-test-bucket"
+	testTEMPOBucket            = "tempo-test-bucket"
+	testMessageSettledDuration = 5 * time.Second
+)
+
+type testGateway struct {
+	source *ChannelMessageSource
+	store  ObjectStore
+	cancel context.CancelFunc
+	// closed when Run returns
+	done chan struct{}
+	// the bodies of the Slack notifications sent, once there is room for them
+	slackMessages chan string
+}
+
+// startTestGateway runs a SmileService wired to in-process messaging and storage
+func startTestGateway(t *testing.T) *testGateway {
+	t.Helper()
+	return startTestGatewayWithOptions(t, NewMemoryObjectStore(), DefaultSmileServiceOptions())
+}
+
+func startTestGatewayWithOptions(t *testing.T, store ObjectStore, options SmileServiceOptions) *testGateway {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	tg := &testGateway{source: NewChannelMessageSource(), store: store, cancel: cancel, done: make(chan struct{}), slackMessages: make(chan string, 16)}
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		select {
+		case tg.slackMessages <- string(body):
+		default:
+		}
+	}))
+	t.Cleanup(slack.Close)
+
+	smileService := NewSmileService(tg.source, tg.store, options)
+	go func() {
+		defer close(tg.done)
+		smileService.Run(ctx, testConsumer, testSubjectFilter, testNewRequestFilter, testUpdateRequestFilter, testUpdateSampleFilter, testDeleteFilter, testIGOBucket,
+			testReleaseTEMPOFilter, testUpdateTEMPOFilter, testTEMPOBucket, noop.NewTracerProvider().Tracer("test"), slack.URL)
+	}()
+	t.Cleanup(tg.stop)
+	return tg
+}
+
+// nextSlackMessage returns the body of the next Slack notification, which is sent after the message is settled
+func (tg *testGateway) nextSlackMessage(t *testing.T) string {
+	t.Helper()
+	select {
+	case message := <-tg.slackMessages:
+		return message
+	case <-time.After(testMessageSettledDuration):
+		t.Fatalf("no Slack notification was sent within %v", testMessageSettledDuration)
+		return ""
+	}
+}
+
+// stop cancels the gateway and waits for Run to drain and return
+func (tg *testGateway) stop() {
+	tg.cancel()
+	<-tg.done
+}
+
+// publishJSON publishes v the way SMILE does, as a quoted JSON string
+func (tg *testGateway) publishJSON(t *testing.T, subject string, v any) *ChannelAck {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("cannot marshal message: %q", err)
+	}
+	return tg.source.Publish(subject, []byte(strconv.Quote(string(data))))
+}
+
+func waitForAck(t *testing.T, ack *ChannelAck) {
+	t.Helper()
+	waitForSettlement(t, ack, 1, 0, 0)
+}
+
+func waitForSettlement(t *testing.T, ack *ChannelAck, acks, naks, terms int) {
+	t.Helper()
+	select {
+	case <-ack.Settled():
+	case <-time.After(testMessageSettledDuration):
+		t.Fatalf("message was not settled within %v", testMessageSettledDuration)
+	}
+	if ack.Acks() != acks || ack.Naks() != naks || ack.Terms() != terms {
+		t.Fatalf("got %d acks, %d naks and %d terms, want %d, %d and %d", ack.Acks(), ack.Naks(), ack.Terms(), acks, naks, terms)
+	}
+}
+
+// failingObjectStore fails the first failures puts with err
+type failingObjectStore struct {
+	ObjectStore
+	mu       sync.Mutex
+	failures int
+	err      error
+}
+
+func (f *failingObjectStore) PutObject(ctx context.Context, bucketKey, bucketName string, content []byte, metadata map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures != 0 {
+		f.failures--
+		return f.err
+	}
+	return f.ObjectStore.PutObject(ctx, bucketKey, bucketName, content, metadata)
+}
+
+// keyFailingObjectStore fails every put of a key ending with suffix
+type keyFailingObjectStore struct {
+	ObjectStore
+	suffix string
+	err    error
+}
+
+func (k *keyFailingObjectStore) PutObject(ctx context.Context, bucketKey, bucketName string, content []byte, metadata map[string]string) error {
+	if strings.HasSuffix(bucketKey, k.suffix) {
+		return k.err
+	}
+	return k.ObjectStore.PutObject(ctx, bucketKey, bucketName, content, metadata)
+}
+
+// listRecordingObjectStore records the prefixes listed
+type listRecordingObjectStore struct {
+	ObjectStore
+	mu       sync.Mutex
+	prefixes []string
+}
+
+func (l *listRecordingObjectStore) ListObjects(ctx context.Context, prefix, bucketName string) ([]string, error) {
+	l.mu.Lock()
+	l.prefixes = append(l.prefixes, prefix)
+	l.mu.Unlock()
+	return l.ObjectStore.ListObjects(ctx, prefix, bucketName)
+}
+
+// blockingObjectStore holds puts until release is closed, recording how many were held at once
+type blockingObjectStore struct {
+	ObjectStore
+	release chan struct{}
+	once    sync.Once
+	// called with mu held to decide whether a put is held, nil holds every put
+	block   func(bucketKey string) bool
+	mu      sync.Mutex
+	held    int
+	maxHeld int
+}
+
+func newBlockingObjectStore() *blockingObjectStore {
+	return &blockingObjectStore{ObjectStore: NewMemoryObjectStore(), release: make(chan struct{})}
+}
+
+// startBlockedTestGateway runs a SmileService writing to store, held puts are released before the gateway
+// drains at cleanup, also when a test fails
+func startBlockedTestGateway(t *testing.T, store *blockingObjectStore, options SmileServiceOptions) *testGateway {
+	t.Helper()
+	tg := startTestGatewayWithOptions(t, store, options)
+	t.Cleanup(store.unblock)
+	return tg
+}
+
+// unblock releases held puts and lets all further puts through
+func (b *blockingObjectStore) unblock() {
+	b.once.Do(func() { close(b.release) })
+}
+
+// blockFirstPut holds only the first put of bucketKey
+func (b *blockingObjectStore) blockFirstPut(bucketKey string) {
+	blocked := false
+	b.block = func(key string) bool {
+		if key != bucketKey || blocked {
+			return false
+		}
+		blocked = true
+		return true
+	}
+}
+
+func (b *blockingObjectStore) PutObject(ctx context.Context, bucketKey, bucketName string, content []byte, metadata map[string]string) error {
+	b.mu.Lock()
+	if b.block != nil && !b.block(bucketKey) {
+		b.mu.Unlock()
+		return b.ObjectStore.PutObject(ctx, bucketKey, bucketName, content, metadata)
+	}
+	b.held++
+	b.maxHeld = max(b.maxHeld, b.held)
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.held--
+		b.mu.Unlock()
+	}()
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return b.ObjectStore.PutObject(ctx, bucketKey, bucketName, content, metadata)
+}
+
+// waitForHeld waits until n puts are being held
+func (b *blockingObjectStore) waitForHeld(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testMessageSettledDuration)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		held := b.held
+		b.mu.Unlock()
+		if held >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d puts were not held within %v", n, testMessageSettledDuration)
+}
+
+func testRequest(t *testing.T) SmileRequest {
+	t.Helper()
+	request, err := UnmarshalT[SmileRequest]([]byte(RequestJSON))
+	if err != nil {
+		t.Fatalf("cannot unmarshal request: %q", err)
+	}
+	return request
+}
+
+func TestSmileService(t *testing.T) {
+	t.Run("NewIGORequest", func(t *testing.T) {
+		tg := startTestGateway(t)
+		request := testRequest(t)
+		waitForAck(t, tg.publishJSON(t, testNewRequestFilter, request))
+
+		gotRequest, err := GetRequestObject(context.Background(), tg.store, "IGO_TEST_REQUEST_request.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get request: %q", err)
+		}
+		if len(gotRequest.Samples) != 0 {
+			t.Errorf("request was written with %d samples, want samples split out", len(gotRequest.Samples))
+		}
+		gotSample, err := GetSampleObject(context.Background(), tg.store, "22022_CC_3_sample.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get sample: %q", err)
+		}
+		if !reflect.DeepEqual(gotSample, request.Samples[0]) {
+			t.Errorf("got %v want %v", gotSample, request.Samples[0])
+		}
+	})
+
+	t.Run("UpdateIGORequest", func(t *testing.T) {
+		tg := startTestGateway(t)
+		original := testRequest(t)
+		original.Samples = nil
+		updated := original
+		updated.ProjectManagerName = "homer simpson"
+		waitForAck(t, tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{original, updated}))
+
+		gotRequest, err := GetRequestObject(context.Background(), tg.store, "IGO_TEST_REQUEST_request.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get request: %q", err)
+		}
+		if gotRequest.ProjectManagerName != updated.ProjectManagerName {
+			t.Errorf("got project manager %q want %q", gotRequest.ProjectManagerName, updated.ProjectManagerName)
+		}
+	})
+
+	t.Run("UpdateIGORequestSplitsSamples", func(t *testing.T) {
+		tg := startTestGateway(t)
+		updated := testRequest(t)
+		updated.ProjectManagerName = "homer simpson"
+		waitForAck(t, tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{updated}))
+
+		gotRequest, err := GetRequestObject(context.Background(), tg.store, "IGO_TEST_REQUEST_request.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get request: %q", err)
+		}
+		if gotRequest.ProjectManagerName != updated.ProjectManagerName || gotRequest.Samples != nil {
+			t.Errorf("got request %+v want the update without its samples", gotRequest)
+		}
+		for _, sample := range updated.Samples {
+			gotSample, err := GetSampleObject(context.Background(), tg.store, sample.PrimaryID+"_sample.json", testIGOBucket)
+			if err != nil {
+				t.Fatalf("cannot get sample %s: %q", sample.PrimaryID, err)
+			}
+			if !reflect.DeepEqual(gotSample, sample) {
+				t.Errorf("got sample %v want %v", gotSample, sample)
+			}
+		}
+		manifest, err := get[RequestManifest](context.Background(), tg.store, "IGO_TEST_REQUEST_manifest.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get manifest: %q", err)
+		}
+		if len(manifest.Samples) != len(updated.Samples) {
+			t.Errorf("got manifest samples %+v want the %d samples of the update", manifest.Samples, len(updated.Samples))
+		}
+	})
+
+	t.Run("UpdateIGOSample", func(t *testing.T) {
+		tg := startTestGateway(t)
+		original := testRequest(t).Samples[0]
+		updated := original
+		updated.OncotreeCode = "MEL"
+		waitForAck(t, tg.publishJSON(t, testUpdateSampleFilter, []SmileSample{original, updated}))
+
+		gotSample, err := GetSampleObject(context.Background(), tg.store, "22022_CC_3_sample.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get sample: %q", err)
+		}
+		if gotSample.OncotreeCode != updated.OncotreeCode {
+			t.Errorf("got oncotree code %q want %q", gotSample.OncotreeCode, updated.OncotreeCode)
+		}
+	})
+
+	for _, subject := range []string{testReleaseTEMPOFilter, testUpdateTEMPOFilter} {
+		t.Run("TEMPOSamples "+subject, func(t *testing.T) {
+			tg := startTestGateway(t)
+			data, err := proto.Marshal(&st.TempoSampleUpdateMessage{TempoSamples: []*st.TempoSample{
+				{PrimaryId: "12345_A_1", CmoSampleName: "C-ABCDEF-P001-d01"},
+				{PrimaryId: "12345_A_2", CmoSampleName: "C-ABCDEF-N001-d01"},
+			}})
+			if err != nil {
+				t.Fatalf("cannot marshal TEMPO samples: %q", err)
+			}
+			waitForAck(t, tg.source.Publish(subject, data))
+
+			keys, err := tg.store.ListObjects(context.Background(), "", testTEMPOBucket)
+			if err != nil {
+				t.Fatalf("cannot list TEMPO bucket: %q", err)
+			}
+			auditKeys := slices.DeleteFunc(slices.Clone(keys), func(key string) bool { return !strings.HasPrefix(key, "_audit/embargo/") })
+			keys = slices.DeleteFunc(keys, func(key string) bool { return strings.HasPrefix(key, "_audit/embargo/") })
+			want := []string{"12345_A_1_clinical.json", "12345_A_2_clinical.json"}
+			if !reflect.DeepEqual(keys, want) {
+				t.Errorf("got keys %v want %v", keys, want)
+			}
+			if len(auditKeys) != 1 {
+				t.Errorf("got audit records %v want one for the message", auditKeys)
+			}
+		})
+	}
+
+	t.Run("EmbargoedTEMPOSamplesAreRedacted", func(t *testing.T) {
+		tg := startTestGateway(t)
+		publish := func(subject string, samples ...*st.TempoSample) {
+			t.Helper()
+			data, err := proto.Marshal(&st.TempoSampleUpdateMessage{TempoSamples: samples})
+			if err != nil {
+				t.Fatalf("cannot marshal TEMPO samples: %q", err)
+			}
+			waitForAck(t, tg.source.Publish(subject, data))
+		}
+		future := time.Now().AddDate(1, 0, 0).Format(time.DateOnly)
+		past := time.Now().AddDate(-1, 0, 0).Format(time.DateOnly)
+		publish(testReleaseTEMPOFilter,
+			&st.TempoSample{PrimaryId: "12345_A_1", AccessLevel: "MSK Public", EmbargoDate: past},
+			&st.TempoSample{PrimaryId: "12345_A_2", AccessLevel: "MSK Embargo", EmbargoDate: future})
+		if _, err := tg.store.HeadObject(context.Background(), "12345_A_1_clinical.json", testTEMPOBucket); err != nil {
+			t.Errorf("released sample was not written: %q", err)
+		}
+		if _, err := tg.store.HeadObject(context.Background(), "12345_A_2_clinical.json", testTEMPOBucket); err == nil {
+			t.Errorf("embargoed sample was written")
+		}
+		// nothing about an embargoed sample reaches Slack
+		slackMessage := tg.nextSlackMessage(t)
+		if !strings.Contains(slackMessage, "12345_A_1") || strings.Contains(slackMessage, "12345_A_2") || strings.Contains(slackMessage, "Embargo") {
+			t.Errorf("got Slack notification %q want only the released sample named", slackMessage)
+		}
+		if !strings.Contains(slackMessage, "withheld under embargo: 1") {
+			t.Errorf("got Slack notification %q want the withheld sample counted", slackMessage)
+		}
+
+		// a released sample that goes back under embargo is redacted
+		publish(testUpdateTEMPOFilter, &st.TempoSample{PrimaryId: "12345_A_1", EmbargoDate: future})
+		tombstone, err := get[Tombstone](context.Background(), tg.store, "12345_A_1_clinical.json", testTEMPOBucket)
+		if err != nil {
+			t.Fatalf("cannot get tombstone: %q", err)
+		}
+		if !tombstone.Deleted || tombstone.PrimaryID != "12345_A_1" {
+			t.Errorf("got %+v want the embargoed sample replaced by a tombstone", tombstone)
+		}
+
+		auditKeys, err := tg.store.ListObjects(context.Background(), "_audit/embargo/", testTEMPOBucket)
+		if err != nil {
+			t.Fatalf("cannot list audit records: %q", err)
+		}
+		var actions []EmbargoAction
+		for _, key := range auditKeys {
+			audit, err := get[EmbargoAudit](context.Background(), tg.store, key, testTEMPOBucket)
+			if err != nil {
+				t.Fatalf("cannot get audit record: %q", err)
+			}
+			for _, decision := range audit.Decisions {
+				actions = append(actions, decision.Action)
+			}
+		}
+		if want := []EmbargoAction{ReleasedSample, WithheldSample, RedactedSample}; !reflect.DeepEqual(actions, want) {
+			t.Errorf("got audited actions %v want %v", actions, want)
+		}
+	})
+
+	t.Run("TransientFailureIsRedelivered", func(t *testing.T) {
+		store := &failingObjectStore{ObjectStore: NewMemoryObjectStore(), failures: 2, err: errors.New("SlowDown")}
+		tg := startTestGatewayWithOptions(t, store, SmileServiceOptions{MaxDeliver: 5, NakDelay: time.Millisecond})
+		waitForSettlement(t, tg.publishJSON(t, testNewRequestFilter, testRequest(t)), 1, 2, 0)
+		if _, err := GetRequestObject(context.Background(), tg.store, "IGO_TEST_REQUEST_request.json", testIGOBucket); err != nil {
+			t.Fatalf("cannot get request: %q", err)
+		}
+	})
+
+	t.Run("TransientFailureStopsAtMaxDeliver", func(t *testing.T) {
+		store := &failingObjectStore{ObjectStore: NewMemoryObjectStore(), failures: -1, err: errors.New("SlowDown")}
+		tg := startTestGatewayWithOptions(t, store, SmileServiceOptions{MaxDeliver: 3, NakDelay: time.Millisecond})
+		waitForSettlement(t, tg.publishJSON(t, testNewRequestFilter, testRequest(t)), 0, 2, 1)
+	})
+
+	t.Run("PermanentFailureIsTerminated", func(t *testing.T) {
+		store := &failingObjectStore{ObjectStore: NewMemoryObjectStore(), failures: -1, err: permanentError(errors.New("NoSuchBucket"))}
+		tg := startTestGatewayWithOptions(t, store, SmileServiceOptions{MaxDeliver: 3, NakDelay: time.Millisecond})
+		waitForSettlement(t, tg.publishJSON(t, testUpdateSampleFilter, []SmileSample{testRequest(t).Samples[0]}), 0, 0, 1)
+	})
+
+	t.Run("NewIGORequestIsCommittedWhole", func(t *testing.T) {
+		store := &keyFailingObjectStore{ObjectStore: NewMemoryObjectStore(), suffix: "22022_CC_3_sample.json", err: permanentError(errors.New("KeyTooLongError"))}
+		tg := startTestGatewayWithOptions(t, store, DefaultSmileServiceOptions())
+		waitForSettlement(t, tg.publishJSON(t, testNewRequestFilter, testRequest(t)), 0, 0, 1)
+
+		// neither the request nor the samples staged before the failure land
+		keys, err := tg.store.ListObjects(context.Background(), "", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot list objects: %q", err)
+		}
+		if len(keys) != 0 {
+			t.Errorf("got objects %v after a failed commit want none", keys)
+		}
+	})
+
+	t.Run("SupersededRequestIsAckedWithoutNotification", func(t *testing.T) {
+		tg := startTestGateway(t)
+		// a newer message than the one about to be published has written the request
+		newer := RequestManifest{IgoRequestID: "IGO_TEST_REQUEST", Samples: []ManifestSample{}, MessageSequence: 100}
+		if _, err := put[RequestManifest](context.Background(), tg.store, "IGO_TEST_REQUEST_manifest.json", testIGOBucket, newer); err != nil {
+			t.Fatalf("cannot put manifest: %q", err)
+		}
+		waitForAck(t, tg.publishJSON(t, testNewRequestFilter, testRequest(t)))
+
+		keys, err := tg.store.ListObjects(context.Background(), "", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot list objects: %q", err)
+		}
+		if !reflect.DeepEqual(keys, []string{"IGO_TEST_REQUEST_manifest.json"}) {
+			t.Errorf("got objects %v after a superseded commit want only the newer manifest", keys)
+		}
+		select {
+		case message := <-tg.slackMessages:
+			t.Errorf("got Slack notification %q of a request that was not written", message)
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+
+	t.Run("RequestManifestTracksUpdates", func(t *testing.T) {
+		tg := startTestGateway(t)
+		request := testRequest(t)
+		waitForAck(t, tg.publishJSON(t, testNewRequestFilter, request))
+
+		manifest, err := get[RequestManifest](context.Background(), tg.store, "IGO_TEST_REQUEST_manifest.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get manifest: %q", err)
+		}
+		if manifest.IgoRequestID != request.IgoRequestID || manifest.Request.Key != "IGO_TEST_REQUEST_request.json" {
+			t.Errorf("got manifest %+v of the wrong request", manifest)
+		}
+		if len(manifest.Samples) != len(request.Samples) {
+			t.Fatalf("got %d samples in the manifest want %d", len(manifest.Samples), len(request.Samples))
+		}
+		for i, sample := range manifest.Samples {
+			info, err := tg.store.HeadObject(context.Background(), sample.Key, testIGOBucket)
+			if err != nil {
+				t.Fatalf("cannot head %s: %q", sample.Key, err)
+			}
+			if sample.PrimaryID != request.Samples[i].PrimaryID || sample.Hash != info.Metadata[ContentHashMetadataKey] {
+				t.Errorf("got manifest sample %+v want %s with hash %s", sample, request.Samples[i].PrimaryID, info.Metadata[ContentHashMetadataKey])
+			}
+		}
+
+		updated := request.Samples[0]
+		updated.OncotreeCode = "MEL"
+		waitForAck(t, tg.publishJSON(t, testUpdateSampleFilter, []SmileSample{updated}))
+		updatedManifest, err := get[RequestManifest](context.Background(), tg.store, "IGO_TEST_REQUEST_manifest.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get manifest: %q", err)
+		}
+		if updatedManifest.Samples[0].Hash == manifest.Samples[0].Hash {
+			t.Errorf("manifest hash of %s was not updated", updated.PrimaryID)
+		}
+		if updatedManifest.MessageSequence <= manifest.MessageSequence {
+			t.Errorf("got manifest sequence %d want later than %d", updatedManifest.MessageSequence, manifest.MessageSequence)
+		}
+		if !reflect.DeepEqual(updatedManifest.Samples[1:], manifest.Samples[1:]) {
+			t.Errorf("got samples %v want %v unchanged", updatedManifest.Samples[1:], manifest.Samples[1:])
+		}
+	})
+
+	t.Run("SampleDeletionWritesTombstones", func(t *testing.T) {
+		tg := startTestGateway(t)
+		request := testRequest(t)
+		kept := request.Samples[0]
+		kept.PrimaryID = "22022_CC_4"
+		request.Samples = append(request.Samples, kept)
+		waitForAck(t, tg.publishJSON(t, testNewRequestFilter, request))
+		deleted := request.Samples[0].PrimaryID
+		deletion := IGODeletion{IgoRequestID: request.IgoRequestID, PrimaryIDs: []string{deleted}, Reason: "sample failed QC"}
+		waitForAck(t, tg.publishJSON(t, testDeleteFilter, deletion))
+
+		tombstone, err := get[Tombstone](context.Background(), tg.store, deleted+"_sample.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get tombstone: %q", err)
+		}
+		if want := sampleTombstone(request.IgoRequestID, deleted, "sample failed QC"); !reflect.DeepEqual(tombstone, want) {
+			t.Errorf("got tombstone %+v want %+v", tombstone, want)
+		}
+		if _, err := GetSampleObject(context.Background(), tg.store, kept.PrimaryID+"_sample.json", testIGOBucket); err != nil {
+			t.Errorf("sample that was not deleted is gone: %q", err)
+		}
+		manifest, err := get[RequestManifest](context.Background(), tg.store, "IGO_TEST_REQUEST_manifest.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get manifest: %q", err)
+		}
+		if len(manifest.Samples) != 1 || manifest.Samples[0].PrimaryID != kept.PrimaryID || manifest.Deleted {
+			t.Errorf("got manifest %+v want only %s", manifest, kept.PrimaryID)
+		}
+
+		// a redelivered deletion has nothing left to do
+		waitForAck(t, tg.publishJSON(t, testDeleteFilter, deletion))
+	})
+
+	t.Run("RequestRedactionWithdrawsEverySample", func(t *testing.T) {
+		tg := startTestGateway(t)
+		request := testRequest(t)
+		waitForAck(t, tg.publishJSON(t, testNewRequestFilter, request))
+		waitForAck(t, tg.publishJSON(t, testDeleteFilter, IGODeletion{IgoRequestID: request.IgoRequestID, Redacted: true}))
+
+		requestTombstone, err := get[Tombstone](context.Background(), tg.store, "IGO_TEST_REQUEST_request.json", testIGOBucket)
+		if err != nil || !requestTombstone.Deleted {
+			t.Errorf("got request %+v want a tombstone: %v", requestTombstone, err)
+		}
+		for _, sample := range request.Samples {
+			if !isTombstone(context.Background(), tg.store, sample.PrimaryID+"_sample.json", testIGOBucket) {
+				t.Errorf("sample %s of the withdrawn request was not replaced by a tombstone", sample.PrimaryID)
+			}
+		}
+		manifest, err := get[RequestManifest](context.Background(), tg.store, "IGO_TEST_REQUEST_manifest.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get manifest: %q", err)
+		}
+		if !manifest.Deleted || len(manifest.Samples) != 0 {
+			t.Errorf("got manifest %+v want it deleted with no samples", manifest)
+		}
+
+		// a request published again is no longer withdrawn
+		waitForAck(t, tg.publishJSON(t, testNewRequestFilter, request))
+		manifest, err = get[RequestManifest](context.Background(), tg.store, "IGO_TEST_REQUEST_manifest.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get manifest: %q", err)
+		}
+		if manifest.Deleted || len(manifest.Samples) != len(request.Samples) {
+			t.Errorf("got manifest %+v want the request restored", manifest)
+		}
+	})
+
+	t.Run("RequestUpdateDroppingSamplesDeletesThem", func(t *testing.T) {
+		tg := startTestGateway(t)
+		request := testRequest(t)
+		dropped := request.Samples[0]
+		dropped.PrimaryID = "22022_CC_4"
+		request.Samples = append(request.Samples, dropped)
+		waitForAck(t, tg.publishJSON(t, testNewRequestFilter, request))
+
+		// an update without a sample list leaves the samples alone
+		withoutSamples := request
+		withoutSamples.Samples = nil
+		waitForAck(t, tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{withoutSamples}))
+		if isTombstone(context.Background(), tg.store, dropped.PrimaryID+"_sample.json", testIGOBucket) {
+			t.Fatalf("sample %s was deleted by an update without a sample list", dropped.PrimaryID)
+		}
+		// nor does one with an empty sample list
+		withoutSamples.Samples = []SmileSample{}
+		waitForAck(t, tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{withoutSamples}))
+		for _, sample := range request.Samples {
+			if isTombstone(context.Background(), tg.store, sample.PrimaryID+"_sample.json", testIGOBucket) {
+				t.Fatalf("sample %s was deleted by an update with an empty sample list", sample.PrimaryID)
+			}
+		}
+
+		updated := request
+		updated.Samples = request.Samples[:1]
+		waitForAck(t, tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{updated}))
+		tombstone, err := get[Tombstone](context.Background(), tg.store, dropped.PrimaryID+"_sample.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get tombstone: %q", err)
+		}
+		if want := sampleTombstone(request.IgoRequestID, dropped.PrimaryID, droppedSamplesReason); !reflect.DeepEqual(tombstone, want) {
+			t.Errorf("got %+v want the dropped sample replaced by %+v", tombstone, want)
+		}
+		manifest, err := get[RequestManifest](context.Background(), tg.store, "IGO_TEST_REQUEST_manifest.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get manifest: %q", err)
+		}
+		if len(manifest.Samples) != 1 || manifest.Samples[0].PrimaryID != updated.Samples[0].PrimaryID {
+			t.Errorf("got manifest samples %+v want only %s", manifest.Samples, updated.Samples[0].PrimaryID)
+		}
+
+		// an update dropping the sample that is redelivered after a newer one listing it does not delete it
+		store := &failingObjectStore{ObjectStore: NewMemoryObjectStore()}
+		options := DefaultSmileServiceOptions()
+		options.NakDelay = 500 * time.Millisecond
+		tg = startTestGatewayWithOptions(t, store, options)
+		waitForAck(t, tg.publishJSON(t, testNewRequestFilter, request))
+		store.mu.Lock()
+		store.failures, store.err = 1, errors.New("SlowDown")
+		store.mu.Unlock()
+		older := tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{updated})
+		for deadline := time.Now().Add(testMessageSettledDuration); older.Naks() == 0; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("update was not naked within %v", testMessageSettledDuration)
+			}
+		}
+		newer := request
+		newer.ProjectManagerName = "homer simpson"
+		waitForAck(t, tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{newer}))
+		waitForSettlement(t, older, 1, 1, 0)
+		if isTombstone(context.Background(), tg.store, dropped.PrimaryID+"_sample.json", testIGOBucket) {
+			t.Errorf("sample %s was deleted by an update older than the one listing it", dropped.PrimaryID)
+		}
+		if manifest, err = get[RequestManifest](context.Background(), tg.store, "IGO_TEST_REQUEST_manifest.json", testIGOBucket); err != nil {
+			t.Fatalf("cannot get manifest: %q", err)
+		}
+		if len(manifest.Samples) != len(newer.Samples) {
+			t.Errorf("got manifest samples %+v want the %d of the newer update", manifest.Samples, len(newer.Samples))
+		}
+		gotRequest, err := GetRequestObject(context.Background(), tg.store, "IGO_TEST_REQUEST_request.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get request: %q", err)
+		}
+		if gotRequest.ProjectManagerName != newer.ProjectManagerName {
+			t.Errorf("got project manager %q want the newer %q", gotRequest.ProjectManagerName, newer.ProjectManagerName)
+		}
+	})
+
+	t.Run("KeyTemplatesPartitionObjects", func(t *testing.T) {
+		templates, err := ParseKeyTemplates("igo/{{.IgoProjectID}}/{{.IgoRequestID}}/request.json", "igo/{{.AdditionalProperties.IgoRequestID}}/{{.PrimaryID}}/sample.json", "")
+		if err != nil {
+			t.Fatalf("cannot ParseKeyTemplates: %q", err)
+		}
+		options := DefaultSmileServiceOptions()
+		if options.Layout, err = OverwriteLayout.WithKeyTemplates(templates); err != nil {
+			t.Fatalf("cannot apply key templates: %q", err)
+		}
+		tg := startTestGatewayWithOptions(t, NewMemoryObjectStore(), options)
+		request := testRequest(t)
+		waitForAck(t, tg.publishJSON(t, testNewRequestFilter, request))
+
+		keys, err := tg.store.ListObjects(context.Background(), "", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot list objects: %q", err)
+		}
+		want := []string{"IGO_TEST_REQUEST_manifest.json", "igo/22022/IGO_TEST_REQUEST/request.json", "igo/IGO_TEST_REQUEST/22022_CC_3/sample.json"}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("got keys %v want %v", keys, want)
+		}
+
+		// a withdrawal carries no project, its tombstones replace the objects listed in the manifest
+		waitForAck(t, tg.publishJSON(t, testDeleteFilter, IGODeletion{IgoRequestID: request.IgoRequestID, Redacted: true}))
+		for _, key := range want[1:] {
+			if !isTombstone(context.Background(), tg.store, key, testIGOBucket) {
+				t.Errorf("%s was not replaced by a tombstone", key)
+			}
+		}
+	})
+
+	t.Run("DeletionWithoutRequestIsTerminated", func(t *testing.T) {
+		tg := startTestGateway(t)
+		waitForSettlement(t, tg.publishJSON(t, testDeleteFilter, IGODeletion{PrimaryIDs: []string{"22022_CC_3"}}), 0, 0, 1)
+	})
+
+	t.Run("EmptyUpdateIsTerminated", func(t *testing.T) {
+		tg := startTestGateway(t)
+		waitForSettlement(t, tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{}), 0, 0, 1)
+		waitForSettlement(t, tg.publishJSON(t, testUpdateSampleFilter, []SmileSample{}), 0, 0, 1)
+	})
+
+	t.Run("UndecodableMessageIsDeadLettered", func(t *testing.T) {
+		options := DefaultSmileServiceOptions()
+		options.DeadLetterSubject = "MDB_STREAM.dead-letter"
+		options.QuarantinePrefix = "_quarantine/"
+		tg := startTestGatewayWithOptions(t, NewMemoryObjectStore(), options)
+		waitForSettlement(t, tg.source.Publish(testNewRequestFilter, []byte("not a request")), 0, 0, 1)
+
+		deadLetters := tg.source.Published(options.DeadLetterSubject)
+		if len(deadLetters) != 1 {
+			t.Fatalf("got %d dead-lettered messages want 1", len(deadLetters))
+		}
+		if got := deadLetters[0].Header[DeadLetterSubjectHeader]; !reflect.DeepEqual(got, []string{testNewRequestFilter}) {
+			t.Errorf("got original subject header %v want %v", got, testNewRequestFilter)
+		}
+		if got := deadLetters[0].Header[DeadLetterNumDeliveredHeader]; !reflect.DeepEqual(got, []string{"1"}) {
+			t.Errorf("got delivery count header %v want 1", got)
+		}
+		if len(deadLetters[0].Header[DeadLetterErrorHeader]) != 1 {
+			t.Errorf("dead-lettered message has no error header")
+		}
+
+		keys, err := ListQuarantinedMessages(context.Background(), tg.store, options.QuarantinePrefix, testIGOBucket)
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("got quarantined keys %v (%v) want a single key", keys, err)
+		}
+		qm, err := GetQuarantinedMessage(context.Background(), tg.store, keys[0], testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get quarantined message: %q", err)
+		}
+		if qm.Subject != testNewRequestFilter || string(qm.Data) != "not a request" {
+			t.Errorf("unexpected quarantined message: %+v", qm)
+		}
+
+		// once re-driven the message is back on its subject and out of quarantine
+		if err := RedriveQuarantinedMessage(context.Background(), tg.store, tg.source, keys[0], testIGOBucket); err != nil {
+			t.Fatalf("cannot re-drive quarantined message: %q", err)
+		}
+		if got := len(tg.source.Published(testNewRequestFilter)); got != 2 {
+			t.Errorf("got %d messages on %s want 2", got, testNewRequestFilter)
+		}
+		if keys, _ := ListQuarantinedMessages(context.Background(), tg.store, options.QuarantinePrefix, testIGOBucket); len(keys) != 0 {
+			t.Errorf("got quarantined keys %v want none", keys)
+		}
+	})
+
+	t.Run("VersionedLayoutKeepsEveryVersion", func(t *testing.T) {
+		options := DefaultSmileServiceOptions()
+		options.Layout = VersionedLayout
+		tg := startTestGatewayWithOptions(t, NewMemoryObjectStore(), options)
+		original := testRequest(t)
+		original.Samples = nil
+		updated := original
+		updated.ProjectManagerName = "homer simpson"
+		waitForAck(t, tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{original}))
+		waitForAck(t, tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{updated}))
+
+		prefix := fmt.Sprintf("requests/dt=%s/IGO_TEST_REQUEST/", time.Now().UTC().Format(time.DateOnly))
+		keys, err := tg.store.ListObjects(context.Background(), prefix, testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot list versions: %q", err)
+		}
+		if len(keys) != 2 {
+			t.Fatalf("got versions %v want 2", keys)
+		}
+		for i, key := range keys {
+			want := fmt.Sprintf("%s%020d_", prefix, i+1)
+			if !strings.HasPrefix(key, want) || !strings.HasSuffix(key, "_request.json") {
+				t.Errorf("got key %q want %s<uuid>_request.json", key, want)
+			}
+		}
+		// versions sort by message sequence so the last is the latest
+		gotRequest, err := GetRequestObject(context.Background(), tg.store, keys[1], testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get request: %q", err)
+		}
+		if gotRequest.ProjectManagerName != updated.ProjectManagerName {
+			t.Errorf("got project manager %q want %q", gotRequest.ProjectManagerName, updated.ProjectManagerName)
+		}
+	})
+
+	t.Run("EmbargoedVersionedTEMPOSampleIsRedactedWithoutListing", func(t *testing.T) {
+		store := &listRecordingObjectStore{ObjectStore: NewMemoryObjectStore()}
+		options := DefaultSmileServiceOptions()
+		options.Layout = VersionedLayout
+		tg := startTestGatewayWithOptions(t, store, options)
+		publish := func(sample *st.TempoSample) {
+			t.Helper()
+			data, err := proto.Marshal(&st.TempoSampleUpdateMessage{TempoSamples: []*st.TempoSample{sample}})
+			if err != nil {
+				t.Fatalf("cannot marshal TEMPO samples: %q", err)
+			}
+			waitForAck(t, tg.source.Publish(testUpdateTEMPOFilter, data))
+		}
+		publish(&st.TempoSample{PrimaryId: "12345_A_1", AccessLevel: "MSK Public"})
+		publish(&st.TempoSample{PrimaryId: "12345_A_1", AccessLevel: "MSK Public", CmoSampleName: "C-000001-P001-d01"})
+		publish(&st.TempoSample{PrimaryId: "12345_A_1", AccessLevel: "MSK Embargo"})
+
+		store.mu.Lock()
+		if slices.ContainsFunc(store.prefixes, func(prefix string) bool { return strings.HasPrefix("clinical/", prefix) }) {
+			t.Errorf("got listings %v want the redaction to read the clinical index", store.prefixes)
+		}
+		store.mu.Unlock()
+		keys, err := store.ListObjects(context.Background(), "clinical/", testTEMPOBucket)
+		if err != nil {
+			t.Fatalf("cannot list clinical data: %q", err)
+		}
+		if len(keys) != 1 || !isTombstone(context.Background(), store, keys[0], testTEMPOBucket) {
+			t.Errorf("got clinical data %v want only a tombstone", keys)
+		}
+		index, err := get[clinicalIndex](context.Background(), store, clinicalIndexKey("12345_A_1"), testTEMPOBucket)
+		if err != nil {
+			t.Fatalf("cannot get clinical index: %q", err)
+		}
+		if want := []clinicalVersion{{Key: keys[0], Deleted: true}}; !reflect.DeepEqual(index.Versions, want) {
+			t.Errorf("got indexed versions %+v want %+v", index.Versions, want)
+		}
+	})
+
+	t.Run("WorkersBoundConcurrency", func(t *testing.T) {
+		store := newBlockingObjectStore()
+		options := DefaultSmileServiceOptions()
+		options.Workers = 2
+		tg := startBlockedTestGateway(t, store, options)
+		var acks []*ChannelAck
+		for i := 0; i < 5; i++ {
+			request := testRequest(t)
+			request.IgoRequestID = fmt.Sprintf("IGO_TEST_REQUEST_%d", i)
+			request.Samples = nil
+			acks = append(acks, tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{request}))
+		}
+		store.waitForHeld(t, options.Workers)
+		// give any worker beyond the limit the chance to start a put
+		time.Sleep(50 * time.Millisecond)
+		store.unblock()
+		for _, ack := range acks {
+			waitForAck(t, ack)
+		}
+		if store.maxHeld != options.Workers {
+			t.Errorf("got %d concurrent puts want %d", store.maxHeld, options.Workers)
+		}
+	})
+
+	t.Run("ShutdownDrainsInFlightMessages", func(t *testing.T) {
+		store := newBlockingObjectStore()
+		tg := startBlockedTestGateway(t, store, DefaultSmileServiceOptions())
+		request := testRequest(t)
+		request.Samples = nil
+		ack := tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{request})
+		store.waitForHeld(t, 1)
+
+		tg.cancel()
+		select {
+		case <-tg.done:
+			t.Fatalf("Run returned before the in-flight write finished")
+		case <-time.After(50 * time.Millisecond):
+		}
+		// messages arriving once shutdown has begun are left for redelivery
+		late := tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{request})
+		deadline := time.Now().Add(testMessageSettledDuration)
+		for late.Naks() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if late.Naks() != 1 || late.Acks() != 0 {
+			t.Fatalf("got %d acks and %d naks for a message arriving during shutdown, want 0 and 1", late.Acks(), late.Naks())
+		}
+
+		store.unblock()
+		waitForAck(t, ack)
+		<-tg.done
+		if _, err := GetRequestObject(context.Background(), tg.store, "IGO_TEST_REQUEST_request.json", testIGOBucket); err != nil {
+			t.Errorf("in-flight request was not written: %q", err)
+		}
+	})
+
+	t.Run("DrainTimeoutCancelsInFlightWrites", func(t *testing.T) {
+		options := DefaultSmileServiceOptions()
+		options.DrainTimeout = 50 * time.Millisecond
+		store := newBlockingObjectStore()
+		tg := startBlockedTestGateway(t, store, options)
+		request := testRequest(t)
+		request.Samples = nil
+		ack := tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{request})
+		store.waitForHeld(t, 1)
+
+		tg.cancel()
+		select {
+		case <-tg.done:
+		case <-time.After(testMessageSettledDuration):
+			t.Fatalf("Run did not return after the drain timed out")
+		}
+		// the cancelled write is left for redelivery
+		if ack.Naks() != 1 || ack.Acks() != 0 {
+			t.Errorf("got %d acks and %d naks for a cancelled write, want 0 and 1", ack.Acks(), ack.Naks())
+		}
+	})
+
+	t.Run("UpdatesToTheSameRequestAreOrdered", func(t *testing.T) {
+		store := newBlockingObjectStore()
+		store.blockFirstPut("IGO_TEST_REQUEST_request.json")
+		tg := startBlockedTestGateway(t, store, DefaultSmileServiceOptions())
+		original := testRequest(t)
+		original.Samples = nil
+		updated := original
+		updated.ProjectManagerName = "homer simpson"
+		originalAck := tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{original})
+		updatedAck := tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{updated})
+		store.waitForHeld(t, 1)
+
+		// a free worker must not write the later update while the earlier one is held
+		time.Sleep(50 * time.Millisecond)
+		if _, err := GetRequestObject(context.Background(), tg.store, "IGO_TEST_REQUEST_request.json", testIGOBucket); !errors.Is(err, ErrObjectNotFound) {
+			t.Fatalf("later update was written before the earlier one: %v", err)
+		}
+		store.unblock()
+		waitForAck(t, originalAck)
+		waitForAck(t, updatedAck)
+
+		gotRequest, err := GetRequestObject(context.Background(), tg.store, "IGO_TEST_REQUEST_request.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get request: %q", err)
+		}
+		if gotRequest.ProjectManagerName != updated.ProjectManagerName {
+			t.Errorf("got project manager %q want %q from the latest message", gotRequest.ProjectManagerName, updated.ProjectManagerName)
+		}
+	})
+
+	t.Run("SampleUpdateIsOrderedAfterNewRequest", func(t *testing.T) {
+		store := newBlockingObjectStore()
+		store.blockFirstPut("22022_CC_3_sample.json")
+		tg := startBlockedTestGateway(t, store, DefaultSmileServiceOptions())
+		request := testRequest(t)
+		updated := request.Samples[0]
+		updated.OncotreeCode = "MEL"
+		requestAck := tg.publishJSON(t, testNewRequestFilter, request)
+		sampleAck := tg.publishJSON(t, testUpdateSampleFilter, []SmileSample{updated})
+		store.waitForHeld(t, 1)
+		time.Sleep(50 * time.Millisecond)
+		store.unblock()
+		waitForAck(t, requestAck)
+		waitForAck(t, sampleAck)
+
+		gotSample, err := GetSampleObject(context.Background(), tg.store, "22022_CC_3_sample.json", testIGOBucket)
+		if err != nil {
+			t.Fatalf("cannot get sample: %q", err)
+		}
+		if gotSample.OncotreeCode != updated.OncotreeCode {
+			t.Errorf("got oncotree code %q want %q from the latest message", gotSample.OncotreeCode, updated.OncotreeCode)
+		}
+	})
+
+	t.Run("DifferentKeysAreProcessedInParallel", func(t *testing.T) {
+		store := newBlockingObjectStore()
+		store.blockFirstPut("IGO_TEST_REQUEST_A_request.json")
+		tg := startBlockedTestGateway(t, store, DefaultSmileServiceOptions())
+		requestA := testRequest(t)
+		requestA.IgoRequestID = "IGO_TEST_REQUEST_A"
+		requestA.Samples = nil
+		requestB := requestA
+		requestB.IgoRequestID = "IGO_TEST_REQUEST_B"
+		ackA := tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{requestA})
+		ackB := tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{requestB})
+		store.waitForHeld(t, 1)
+
+		// B is not held up behind A
+		waitForAck(t, ackB)
+		store.unblock()
+		waitForAck(t, ackA)
+	})
+
+	t.Run("BackpressureIsMeasured", func(t *testing.T) {
+		store := newBlockingObjectStore()
+		options := DefaultSmileServiceOptions()
+		options.Workers = 1
+		options.IGORequestBufSize = 1
+		tg := startBlockedTestGateway(t, store, options)
+		blockedBefore := testutil.ToFloat64(subscriberBlockedSeconds.WithLabelValues(updateIGORequestFlow))
+		var acks []*ChannelAck
+		// one message held by the worker, one queued and one blocking the subscriber
+		for i := 0; i < 3; i++ {
+			request := testRequest(t)
+			request.IgoRequestID = fmt.Sprintf("IGO_TEST_REQUEST_%d", i)
+			request.Samples = nil
+			acks = append(acks, tg.publishJSON(t, testUpdateRequestFilter, []SmileRequest{request}))
+		}
+		store.waitForHeld(t, 1)
+		deadline := time.Now().Add(testMessageSettledDuration)
+		for testutil.ToFloat64(subscriberBlocked.WithLabelValues(updateIGORequestFlow)) != 1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := testutil.ToFloat64(subscriberBlocked.WithLabelValues(updateIGORequestFlow)); got != 1 {
+			t.Errorf("got subscriber blocked %v want 1", got)
+		}
+		if got := testutil.ToFloat64(queueDepth.WithLabelValues(updateIGORequestFlow)); got != 1 {
+			t.Errorf("got queue depth %v want 1", got)
+		}
+
+		store.unblock()
+		for _, ack := range acks {
+			waitForAck(t, ack)
+		}
+		if got := testutil.ToFloat64(subscriberBlocked.WithLabelValues(updateIGORequestFlow)); got != 0 {
+			t.Errorf("got subscriber blocked %v want 0", got)
+		}
+		if got := testutil.ToFloat64(subscriberBlockedSeconds.WithLabelValues(updateIGORequestFlow)); got <= blockedBefore {
+			t.Errorf("time blocked was not recorded")
+		}
+	})
+
+	t.Run("MessagesAreCounted", func(t *testing.T) {
+		counters := []prometheus.Counter{
+			messagesReceived.WithLabelValues(testNewRequestFilter),
+			messagesDecoded.WithLabelValues(testNewRequestFilter),
+			messagesWritten.WithLabelValues(testNewRequestFilter),
+			messagesAcked.WithLabelValues(testNewRequestFilter),
+			slackNotifications.WithLabelValues(sentOutcome),
+			messagesFailed.WithLabelValues(testNewRequestFilter, PermanentError.String()),
+		}
+		before := make([]float64, len(counters))
+		for i, counter := range counters {
+			before[i] = testutil.ToFloat64(counter)
+		}
+
+		tg := startTestGateway(t)
+		waitForAck(t, tg.publishJSON(t, testNewRequestFilter, testRequest(t)))
+		waitForSettlement(t, tg.source.Publish(testNewRequestFilter, []byte("not a request")), 0, 0, 1)
+		// the slack notification is sent after the ack
+		tg.stop()
+
+		want := []float64{2, 1, 1, 1, 1, 1}
+		for i, counter := range counters {
+			if got := testutil.ToFloat64(counter) - before[i]; got != want[i] {
+				t.Errorf("got %s increased by %v want %v", counter.Desc(), got, want[i])
+			}
+		}
+	})
+
+	t.Run("UninterestingSubjectIsAcked", func(t *testing.T) {
+		tg := startTestGateway(t)
+		waitForAck(t, tg.source.Publish("MDB_STREAM.server-gateway.something-else", []byte("{}")))
+		keys, _ := tg.store.ListObjects(context.Background(), "", testIGOBucket)
+		if len(keys) != 0 {
+			t.Errorf("got keys %v want none", keys)
+		}
+	})
+}
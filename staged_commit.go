@@ -0,0 +1,274 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// objects are staged under this prefix of the bucket they are destined for, the DLT pipeline ignores it
+const StagingPrefix = "_staging/"
+
+// the name of the record that marks a staged commit complete, staged objects are only promoted once it exists
+const commitRecordName = "_commit.json"
+
+// StagedCommit lands a set of objects together.  Objects are staged under StagingPrefix, then a commit record
+// listing them is written and they are promoted to their keys one at a time, in the order they were staged.
+// A commit interrupted after its record was written is finished by CleanupStaging, one interrupted before is
+// removed by it.  Promotion is not atomic, until a commit interrupted part way is finished some of its objects
+// are at their keys and the rest are not.  The request manifest is staged last, the committed_ tables of the
+// DLT pipeline only show requests and samples once it has landed.  A commit whose request manifest was since
+// written by a newer message is never promoted, its staged objects are removed instead.
+type StagedCommit struct {
+	store      ObjectStore
+	bucketName string
+	// the staging directory, _staging/<id>/<message sequence>/
+	prefix  string
+	objects []StagedObject
+	// the SMILE message sequence of the message carrying the objects
+	sequence uint64
+	// the key of the request manifest, empty until it is staged
+	manifestKey string
+}
+
+// StagedObject is an object waiting in staging to be promoted to Key
+type StagedObject struct {
+	StagingKey string `json:"stagingKey"`
+	Key        string `json:"key"`
+	Hash       string `json:"hash"`
+}
+
+type commitRecord struct {
+	Objects         []StagedObject `json:"objects"`
+	MessageSequence uint64         `json:"messageSequence"`
+	// records written before manifests were compared have none and are always promoted
+	ManifestKey string    `json:"manifestKey,omitempty"`
+	CommittedAt time.Time `json:"committedAt"`
+}
+
+// NewStagedCommit starts a commit of the objects for id carried by msg.  A redelivery of msg stages
+// into the same directory, so it completes or replaces whatever an earlier delivery left behind.
+func NewStagedCommit(store ObjectStore, bucketName, id string, msg *Message) *StagedCommit {
+	version := fmt.Sprintf("%0*d", sequenceWidth, msg.Sequence)
+	if msg.Sequence == 0 {
+		version = uuid.NewString()
+	}
+	return &StagedCommit{store: store, bucketName: bucketName, prefix: fmt.Sprintf("%s%s/%s/", StagingPrefix, id, version), sequence: msg.Sequence}
+}
+
+func StageRequest(ctx context.Context, commit *StagedCommit, bucketKey string, sr SmileRequest) (PutResult, error) {
+	result, err := stage[SmileRequest](ctx, commit, bucketKey, sr)
+	if err != nil {
+		return result, fmt.Errorf("Failed to StageRequest: '%s': %w", sr.IgoRequestID, err)
+	}
+	return result, nil
+}
+
+func StageIGOSample(ctx context.Context, commit *StagedCommit, bucketKey string, ss SmileSample) (PutResult, error) {
+	result, err := stage[SmileSample](ctx, commit, bucketKey, ss)
+	if err != nil {
+		return result, fmt.Errorf("Failed to StageSample: '%s': %w", ss.SampleName, err)
+	}
+	return result, nil
+}
+
+// stage writes t as JSON into staging, to be promoted to bucketKey on commit, unless the object at bucketKey
+// already holds the same content
+func stage[T any](ctx context.Context, commit *StagedCommit, bucketKey string, t T) (PutResult, error) {
+	result := PutResult{Key: bucketKey}
+	rJson, hash, err := encode(t)
+	if err != nil {
+		return result, err
+	}
+	result.Hash = hash
+	if isUnchanged(ctx, commit.store, bucketKey, commit.bucketName, hash) {
+		result.Skipped = true
+		return result, nil
+	}
+
+	stagingKey := commit.prefix + bucketKey
+	err = commit.store.PutObject(ctx, stagingKey, commit.bucketName, rJson, map[string]string{ContentHashMetadataKey: hash})
+	if err != nil {
+		return result, fmt.Errorf("Failed to stage object: %w", err)
+	}
+	commit.objects = append(commit.objects, StagedObject{StagingKey: stagingKey, Key: bucketKey, Hash: hash})
+	return result, nil
+}
+
+// Commit writes the commit record and promotes the staged objects to their keys.  It reports whether they were
+// promoted, they are only removed from staging when a newer message has since written the request manifest.
+func (c *StagedCommit) Commit(ctx context.Context) (bool, error) {
+	if len(c.objects) == 0 {
+		return true, nil
+	}
+	record := commitRecord{Objects: c.objects, MessageSequence: c.sequence, ManifestKey: c.manifestKey, CommittedAt: time.Now().UTC()}
+	if _, err := put[commitRecord](ctx, c.store, c.prefix+commitRecordName, c.bucketName, record); err != nil {
+		return false, fmt.Errorf("Failed to write commit record %s:%s: %w", c.bucketName, c.prefix, err)
+	}
+	return promote(ctx, c.store, c.bucketName, c.prefix, record)
+}
+
+// Abort removes the staged objects
+func (c *StagedCommit) Abort(ctx context.Context) error {
+	var errs []error
+	for _, object := range c.objects {
+		errs = append(errs, c.store.DeleteObject(ctx, object.StagingKey, c.bucketName))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("Failed to abort staged commit %s:%s: %w", c.bucketName, c.prefix, err)
+	}
+	return nil
+}
+
+// promote copies each staged object of a commit to its key, then removes the staging directory.  It can be
+// repeated, an object no longer in staging was promoted by an earlier attempt.  A commit superseded by a newer
+// message is only removed from staging, promote reports whether its objects were promoted.
+func promote(ctx context.Context, store ObjectStore, bucketName, prefix string, record commitRecord) (bool, error) {
+	superseded, err := isSuperseded(ctx, store, bucketName, record)
+	if err != nil {
+		return false, err
+	}
+	if !superseded {
+		for _, object := range record.Objects {
+			if err := promoteObject(ctx, store, bucketName, object); err != nil {
+				return false, err
+			}
+		}
+	}
+	for _, object := range record.Objects {
+		if err := store.DeleteObject(ctx, object.StagingKey, bucketName); err != nil {
+			return false, fmt.Errorf("Failed to remove object from staging: %w", err)
+		}
+	}
+	// the record goes last, until it is removed the commit can be finished again
+	if err := store.DeleteObject(ctx, prefix+commitRecordName, bucketName); err != nil {
+		return false, fmt.Errorf("Failed to remove commit record %s:%s: %w", bucketName, prefix, err)
+	}
+	return !superseded, nil
+}
+
+// promoteObject copies a staged object to its key, unless an earlier attempt already did
+func promoteObject(ctx context.Context, store ObjectStore, bucketName string, object StagedObject) error {
+	data, err := store.GetObject(ctx, object.StagingKey, bucketName)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read staged object: %w", err)
+	}
+	if err := store.PutObject(ctx, object.Key, bucketName, data, map[string]string{ContentHashMetadataKey: object.Hash}); err != nil {
+		return fmt.Errorf("Failed to promote staged object %s:%s: %w", bucketName, object.Key, err)
+	}
+	return nil
+}
+
+// isSuperseded reports whether the request manifest of a commit was written by a message newer than the one
+// the commit carries.  Promoting it would replace the newer objects with older ones, e.g. when a message is
+// terminated part way through its commit, a newer one succeeds and the staging cleanup then finds the first.
+func isSuperseded(ctx context.Context, store ObjectStore, bucketName string, record commitRecord) (bool, error) {
+	if record.ManifestKey == "" {
+		return false, nil
+	}
+	current, err := get[RequestManifest](ctx, store, record.ManifestKey, bucketName)
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Failed to read manifest %s:%s: %w", bucketName, record.ManifestKey, err)
+	}
+	return current.MessageSequence > record.MessageSequence, nil
+}
+
+// StagingCleanup counts what CleanupStaging did with the abandoned commits it found
+type StagingCleanup struct {
+	// commits whose record was written, which were finished
+	Finished int
+	// commits without a record, or superseded by a newer message, whose staged objects were removed
+	Removed int
+}
+
+// CleanupStaging finishes or removes the commits in bucketName last written to more than maxAge ago.  Younger
+// commits may still be in progress and are left alone.
+func CleanupStaging(ctx context.Context, store ObjectStore, bucketName string, maxAge time.Duration) (StagingCleanup, error) {
+	var cleanup StagingCleanup
+	keys, err := store.ListObjects(ctx, StagingPrefix, bucketName)
+	if err != nil {
+		return cleanup, fmt.Errorf("Failed to list staging %s:%s: %w", bucketName, StagingPrefix, err)
+	}
+	commits := make(map[string][]string)
+	var prefixes []string
+	for _, key := range keys {
+		prefix, ok := commitPrefix(key)
+		if !ok {
+			continue
+		}
+		if _, found := commits[prefix]; !found {
+			prefixes = append(prefixes, prefix)
+		}
+		commits[prefix] = append(commits[prefix], key)
+	}
+
+	var errs []error
+	for _, prefix := range prefixes {
+		abandoned, err := isAbandoned(ctx, store, bucketName, commits[prefix], maxAge)
+		if err != nil || !abandoned {
+			errs = append(errs, err)
+			continue
+		}
+		record, err := get[commitRecord](ctx, store, prefix+commitRecordName, bucketName)
+		switch {
+		case err == nil:
+			promoted, err := promote(ctx, store, bucketName, prefix, record)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if promoted {
+				cleanup.Finished++
+			} else {
+				cleanup.Removed++
+			}
+		case errors.Is(err, ErrObjectNotFound):
+			for _, key := range commits[prefix] {
+				errs = append(errs, store.DeleteObject(ctx, key, bucketName))
+			}
+			cleanup.Removed++
+		default:
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return cleanup, fmt.Errorf("Failed to clean up staging %s:%s: %w", bucketName, StagingPrefix, err)
+	}
+	return cleanup, nil
+}
+
+// commitPrefix returns the staging directory of a commit a staged key belongs to, _staging/<id>/<version>/
+func commitPrefix(key string) (string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(key, StagingPrefix), "/", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+	return StagingPrefix + parts[0] + "/" + parts[1] + "/", true
+}
+
+// isAbandoned reports whether none of the keys of a commit were written in the last maxAge
+func isAbandoned(ctx context.Context, store ObjectStore, bucketName string, keys []string, maxAge time.Duration) (bool, error) {
+	for _, key := range keys {
+		info, err := store.HeadObject(ctx, key, bucketName)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if time.Since(info.LastModified) < maxAge {
+			return false, nil
+		}
+	}
+	return true, nil
+}
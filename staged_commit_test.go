@@ -0,0 +1,216 @@
+package smile_databricks_gateway
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStagedCommit(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "igo"
+	request := testRequest(t)
+	samples := request.Samples
+	request.Samples = nil
+	msg := &Message{Sequence: 42}
+
+	stageAll := func(t *testing.T, store ObjectStore) *StagedCommit {
+		t.Helper()
+		commit := NewStagedCommit(store, bucket, request.IgoRequestID, msg)
+		if _, err := StageRequest(ctx, commit, "IGO_TEST_REQUEST_request.json", request); err != nil {
+			t.Fatalf("cannot StageRequest: %q", err)
+		}
+		for _, sample := range samples {
+			if _, err := StageIGOSample(ctx, commit, sample.PrimaryID+"_sample.json", sample); err != nil {
+				t.Fatalf("cannot StageIGOSample: %q", err)
+			}
+		}
+		return commit
+	}
+	stagedKeys := func(t *testing.T, store ObjectStore) []string {
+		t.Helper()
+		keys, err := store.ListObjects(ctx, StagingPrefix, bucket)
+		if err != nil {
+			t.Fatalf("cannot list staging: %q", err)
+		}
+		return keys
+	}
+
+	t.Run("CommitPromotesEveryObject", func(t *testing.T) {
+		store := NewMemoryObjectStore()
+		commit := stageAll(t, store)
+		if keys, _ := store.ListObjects(ctx, "", bucket); len(keys) != len(stagedKeys(t, store)) {
+			t.Fatalf("got objects %v outside staging before the commit", keys)
+		}
+		if _, err := commit.Commit(ctx); err != nil {
+			t.Fatalf("cannot Commit: %q", err)
+		}
+		gotRequest, err := GetRequestObject(ctx, store, "IGO_TEST_REQUEST_request.json", bucket)
+		if err != nil {
+			t.Fatalf("cannot get request: %q", err)
+		}
+		if !reflect.DeepEqual(gotRequest, request) {
+			t.Errorf("got %v want %v", gotRequest, request)
+		}
+		for _, sample := range samples {
+			info, err := store.HeadObject(ctx, sample.PrimaryID+"_sample.json", bucket)
+			if err != nil {
+				t.Fatalf("cannot head sample: %q", err)
+			}
+			if info.Metadata[ContentHashMetadataKey] == "" {
+				t.Errorf("promoted sample %s has no content hash", sample.PrimaryID)
+			}
+		}
+		if keys := stagedKeys(t, store); len(keys) != 0 {
+			t.Errorf("got staged objects %v after the commit want none", keys)
+		}
+	})
+
+	t.Run("UnchangedObjectsAreNotStaged", func(t *testing.T) {
+		store := NewMemoryObjectStore()
+		if _, err := stageAll(t, store).Commit(ctx); err != nil {
+			t.Fatalf("cannot Commit: %q", err)
+		}
+		commit := stageAll(t, store)
+		if len(commit.objects) != 0 {
+			t.Errorf("got %d objects staged for unchanged content want 0", len(commit.objects))
+		}
+	})
+
+	t.Run("AbortRemovesStagedObjects", func(t *testing.T) {
+		store := NewMemoryObjectStore()
+		if err := stageAll(t, store).Abort(ctx); err != nil {
+			t.Fatalf("cannot Abort: %q", err)
+		}
+		if keys, _ := store.ListObjects(ctx, "", bucket); len(keys) != 0 {
+			t.Errorf("got objects %v after an abort want none", keys)
+		}
+	})
+
+	t.Run("CleanupFinishesInterruptedCommits", func(t *testing.T) {
+		store := NewMemoryObjectStore()
+		commit := stageAll(t, store)
+		// promoting the samples fails after the commit record is written
+		commit.store = &keyFailingObjectStore{ObjectStore: store, suffix: "_sample.json", err: errors.New("SlowDown")}
+		if _, err := commit.Commit(ctx); err == nil {
+			t.Fatalf("expected the commit to fail")
+		}
+
+		// young commits may still be in progress
+		cleanup, err := CleanupStaging(ctx, store, bucket, time.Hour)
+		if err != nil {
+			t.Fatalf("cannot CleanupStaging: %q", err)
+		}
+		if cleanup != (StagingCleanup{}) {
+			t.Errorf("got cleanup %+v of a young commit want none", cleanup)
+		}
+		cleanup, err = CleanupStaging(ctx, store, bucket, 0)
+		if err != nil {
+			t.Fatalf("cannot CleanupStaging: %q", err)
+		}
+		if cleanup != (StagingCleanup{Finished: 1}) {
+			t.Errorf("got cleanup %+v want 1 finished", cleanup)
+		}
+		for _, sample := range samples {
+			if _, err := GetSampleObject(ctx, store, sample.PrimaryID+"_sample.json", bucket); err != nil {
+				t.Errorf("sample %s was not promoted: %q", sample.PrimaryID, err)
+			}
+		}
+		if keys := stagedKeys(t, store); len(keys) != 0 {
+			t.Errorf("got staged objects %v after the cleanup want none", keys)
+		}
+	})
+
+	t.Run("ManifestLandsOnlyOnceEveryObjectIsPromoted", func(t *testing.T) {
+		store := NewMemoryObjectStore()
+		commit := stageAll(t, store)
+		manifestKey := OverwriteLayout.ManifestKey(request.IgoRequestID)
+		if _, err := StageManifest(ctx, commit, manifestKey, request.IgoRequestID, msg, func(m *RequestManifest) {
+			for _, sample := range samples {
+				m.setSample(sample.PrimaryID, PutResult{Key: sample.PrimaryID + "_sample.json"})
+			}
+		}); err != nil {
+			t.Fatalf("cannot StageManifest: %q", err)
+		}
+		commit.store = &keyFailingObjectStore{ObjectStore: store, suffix: "_sample.json", err: errors.New("SlowDown")}
+		if _, err := commit.Commit(ctx); err == nil {
+			t.Fatalf("expected the commit to fail")
+		}
+		// the DLT pipeline only shows the request once its manifest has landed
+		if _, err := store.HeadObject(ctx, manifestKey, bucket); !errors.Is(err, ErrObjectNotFound) {
+			t.Fatalf("got manifest (%v) of a commit that was interrupted part way want none", err)
+		}
+		if _, err := CleanupStaging(ctx, store, bucket, 0); err != nil {
+			t.Fatalf("cannot CleanupStaging: %q", err)
+		}
+		if _, err := store.HeadObject(ctx, manifestKey, bucket); err != nil {
+			t.Errorf("manifest was not promoted once the commit was finished: %q", err)
+		}
+	})
+
+	t.Run("CleanupDoesNotPromoteSupersededCommits", func(t *testing.T) {
+		store := NewMemoryObjectStore()
+		commit := stageAll(t, store)
+		manifestKey := OverwriteLayout.ManifestKey(request.IgoRequestID)
+		if _, err := StageManifest(ctx, commit, manifestKey, request.IgoRequestID, msg, func(m *RequestManifest) {
+			m.setRequest(PutResult{Key: "IGO_TEST_REQUEST_request.json"})
+		}); err != nil {
+			t.Fatalf("cannot StageManifest: %q", err)
+		}
+		// the message is terminated after its commit record is written
+		commit.store = &keyFailingObjectStore{ObjectStore: store, suffix: "_sample.json", err: errors.New("SlowDown")}
+		if _, err := commit.Commit(ctx); err == nil {
+			t.Fatalf("expected the commit to fail")
+		}
+		// then a newer message for the request succeeds
+		newer := request
+		newer.Samples = slices.Clone(samples)
+		newer.Samples[0].OncotreeCode = "MEL"
+		if _, err := CommitIGORequest(ctx, store, bucket, OverwriteLayout, newer, &Message{Sequence: msg.Sequence + 1}); err != nil {
+			t.Fatalf("cannot CommitIGORequest: %q", err)
+		}
+
+		cleanup, err := CleanupStaging(ctx, store, bucket, 0)
+		if err != nil {
+			t.Fatalf("cannot CleanupStaging: %q", err)
+		}
+		if cleanup != (StagingCleanup{Removed: 1}) {
+			t.Errorf("got cleanup %+v want 1 removed", cleanup)
+		}
+		gotSample, err := GetSampleObject(ctx, store, newer.Samples[0].PrimaryID+"_sample.json", bucket)
+		if err != nil {
+			t.Fatalf("cannot get sample: %q", err)
+		}
+		if !reflect.DeepEqual(gotSample, newer.Samples[0]) {
+			t.Errorf("got %v want the newer sample %v", gotSample, newer.Samples[0])
+		}
+		manifest, err := get[RequestManifest](ctx, store, manifestKey, bucket)
+		if err != nil {
+			t.Fatalf("cannot get manifest: %q", err)
+		}
+		if manifest.MessageSequence != msg.Sequence+1 || len(manifest.Samples) != len(samples) {
+			t.Errorf("got manifest %+v want the one written by sequence %d", manifest, msg.Sequence+1)
+		}
+		if keys := stagedKeys(t, store); len(keys) != 0 {
+			t.Errorf("got staged objects %v after the cleanup want none", keys)
+		}
+	})
+
+	t.Run("CleanupRemovesAbandonedStaging", func(t *testing.T) {
+		store := NewMemoryObjectStore()
+		stageAll(t, store)
+		cleanup, err := CleanupStaging(ctx, store, bucket, 0)
+		if err != nil {
+			t.Fatalf("cannot CleanupStaging: %q", err)
+		}
+		if cleanup != (StagingCleanup{Removed: 1}) {
+			t.Errorf("got cleanup %+v want 1 removed", cleanup)
+		}
+		if keys, _ := store.ListObjects(ctx, "", bucket); len(keys) != 0 {
+			t.Errorf("got objects %v after the cleanup want none", keys)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package smile_databricks_gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// workerPool processes the messages of one flow on a fixed number of goroutines.  Once
+// stopped it accepts no more work, and wait returns when everything accepted is processed.
+type workerPool[T any] struct {
+	// labels the pool's metrics
+	flow string
+	// held for reading while submitting so that stop cannot close items under a sender
+	mu        sync.RWMutex
+	stopped   bool
+	items     chan sequencedItem[T]
+	sequencer *keySequencer
+	wg        sync.WaitGroup
+}
+
+type sequencedItem[T any] struct {
+	item T
+	turn *sequencerTurn
+}
+
+func newWorkerPool[T any](flow string, workers, bufSize int, sequencer *keySequencer, process func(T)) *workerPool[T] {
+	workers = max(workers, 1)
+	p := &workerPool[T]{flow: flow, items: make(chan sequencedItem[T], max(bufSize, 0)), sequencer: sequencer}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer p.wg.Done()
+			for si := range p.items {
+				queueDepth.WithLabelValues(p.flow).Set(float64(len(p.items)))
+				si.turn.wait()
+				process(si.item)
+				si.turn.leave()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues item for processing after all work submitted before it that shares one of
+// keys, blocking while the pool is busy.  It returns false when the pool has been stopped,
+// in which case the caller still owns item.
+func (p *workerPool[T]) submit(keys []string, item T) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		return false
+	}
+	si := sequencedItem[T]{item: item, turn: p.sequencer.enter(keys)}
+	select {
+	case p.items <- si:
+	default:
+		// every worker is busy and the queue is full, the message source cannot deliver until this returns
+		blocked := time.Now()
+		subscriberBlocked.WithLabelValues(p.flow).Set(1)
+		p.items <- si
+		subscriberBlocked.WithLabelValues(p.flow).Set(0)
+		subscriberBlockedSeconds.WithLabelValues(p.flow).Add(time.Since(blocked).Seconds())
+	}
+	queueDepth.WithLabelValues(p.flow).Set(float64(len(p.items)))
+	return true
+}
+
+// stop rejects further submissions, work already submitted is still processed
+func (p *workerPool[T]) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.items)
+	}
+}
+
+// wait blocks until the pool is stopped and all submitted work has been processed
+func (p *workerPool[T]) wait() {
+	p.wg.Wait()
+}
+
+// keySequencer orders work by entity key (an IGO request ID, a sample primary ID) across every
+// pool it is shared by: work runs only once all work entered before it with any of the same keys
+// has left, work with different keys runs in parallel.  Work must be entered from a single goroutine,
+// in the order it was received, for the order to be that of the message stream.
+type keySequencer struct {
+	mu sync.Mutex
+	// the done channel of the last work entered for each key
+	tails map[string]chan struct{}
+}
+
+type sequencerTurn struct {
+	sequencer *keySequencer
+	keys      []string
+	previous  []chan struct{}
+	done      chan struct{}
+}
+
+func newKeySequencer() *keySequencer {
+	return &keySequencer{tails: make(map[string]chan struct{})}
+}
+
+func (s *keySequencer) enter(keys []string) *sequencerTurn {
+	turn := &sequencerTurn{sequencer: s, done: make(chan struct{})}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		tail, ok := s.tails[key]
+		if tail == turn.done {
+			// key repeated within keys
+			continue
+		}
+		if ok {
+			turn.previous = append(turn.previous, tail)
+		}
+		s.tails[key] = turn.done
+		turn.keys = append(turn.keys, key)
+	}
+	return turn
+}
+
+// wait blocks until all work entered before this turn that shares a key has left
+func (t *sequencerTurn) wait() {
+	for _, previous := range t.previous {
+		<-previous
+	}
+}
+
+func (t *sequencerTurn) leave() {
+	t.sequencer.mu.Lock()
+	defer t.sequencer.mu.Unlock()
+	for _, key := range t.keys {
+		// forget keys nothing has been entered for since, so tails does not grow without bound
+		if t.sequencer.tails[key] == t.done {
+			delete(t.sequencer.tails, key)
+		}
+	}
+	close(t.done)
+}